@@ -0,0 +1,359 @@
+package bitcask_go
+
+// 在线备份
+// 只在很短的时间内持有数据库的锁：轮转活跃文件，记录下此时所有的数据文件，得到一个一致的时间点。
+// 之后的写入都进入新的活跃文件，记录下来的文件在数据库打开期间不会再修改（merge 只在下次启动时安装），
+// 所以不持有锁也可以放心地创建硬链接或者拷贝。
+//
+// 增量备份只保存上一次备份之后新增或者改变的文件，备份清单中记录这个时间点完整的文件列表，
+// 恢复时每个文件从备份链中最近一个包含它的备份中获取。
+// 安装 merge 会用新的文件替换 merge 边界之前的文件 id，文件名相同但内容不同，所以 merge 边界变化之后这些文件都需要重新备份。
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const BackupManifestFileName = "backup-manifest"
+
+// Manifest 备份清单，描述备份对应的一致性时间点
+type Manifest struct {
+	ID          string         `json:"id"`
+	ParentID    string         `json:"parent_id,omitempty"` // 增量备份基于的上一次备份，全量备份为空
+	CreatedAt   time.Time      `json:"created_at"`
+	SeqNo       uint64         `json:"seq_no"`        // 备份时的事务序列号
+	ActiveFid   uint32         `json:"active_fid"`    // 备份时的活跃文件，它之前的数据文件组成了这个时间点的全部数据
+	MergeFileId uint32         `json:"merge_file_id"` // 数据目录中已经安装的 merge 的边界，没有 merge 过时为 0
+	Files       []ManifestFile `json:"files"`         // 这个时间点所有的数据文件、hint 文件和 merge 完成标识
+}
+
+// ManifestFile 备份中的一个文件
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Included bool   `json:"included"` // 文件是否保存在这个备份的目录中，增量备份中没有变化的文件为 false
+}
+
+// backupCut 在锁内记录下的一致性时间点
+type backupCut struct {
+	seqNo       uint64
+	activeFid   uint32
+	hasActive   bool
+	mergeFileId uint32
+	fileNames   []string
+	snapshot    *index.BPlusTreeSnapshot // B+ 树索引在这个时间点的快照
+}
+
+// Backup 在线备份数据库到 dirPath，返回备份清单，dirPath 必须不存在或者是空目录
+// 不会再修改的文件通过硬链接备份，不支持时拷贝；B+ 树索引从同一时间点的快照写出。
+// 备份中会创建一个空的活跃文件，打开备份之后的写入不会修改和原数据库共享的文件。
+// merge 目录中还没有安装的数据不属于这个时间点，不会备份
+func (db *DB) Backup(dirPath string) (*Manifest, error) {
+	return db.backup(dirPath, nil)
+}
+
+// BackupIncremental 在线增量备份，只保存 since 之后新增或者改变的文件，since 必须是这个数据库最近一次备份的清单
+// B+ 树索引会被修改，每次都完整地写出快照。增量备份的目录不能直接打开，需要和之前的备份一起通过 Restore 恢复
+func (db *DB) BackupIncremental(dirPath string, since Manifest) (*Manifest, error) {
+	return db.backup(dirPath, &since)
+}
+
+func (db *DB) backup(dirPath string, since *Manifest) (*Manifest, error) {
+	if err := db.prepareBackupDir(dirPath); err != nil {
+		return nil, err
+	}
+
+	cut, err := db.backupCut()
+	if err != nil {
+		return nil, err
+	}
+	fs := db.options.FS
+	// 先写出 B+ 树索引的快照并立即关闭，快照的读事务会阻止 bolt 复用写入时释放的页
+	if cut.snapshot != nil {
+		bptreePath := filepath.Join(dirPath, index.BPTreeIndexFileName)
+		err := writeBackupFile(fs, bptreePath, func(w io.Writer) error {
+			_, err := cut.snapshot.WriteTo(w)
+			return err
+		})
+		_ = cut.snapshot.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if since != nil && since.ActiveFid > cut.activeFid {
+		return nil, ErrInvalidBackupChain
+	}
+
+	id, err := newManifestID()
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{
+		ID:          id,
+		CreatedAt:   time.Now(),
+		SeqNo:       cut.seqNo,
+		ActiveFid:   cut.activeFid,
+		MergeFileId: cut.mergeFileId,
+	}
+	var sinceSizes map[string]int64
+	if since != nil {
+		manifest.ParentID = since.ID
+		sinceSizes = make(map[string]int64, len(since.Files))
+		for _, file := range since.Files {
+			sinceSizes[file.Name] = file.Size
+		}
+	}
+
+	for _, name := range cut.fileNames {
+		srcPath := filepath.Join(db.options.DirPath, name)
+		info, err := fs.Stat(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		file := ManifestFile{Name: name, Size: info.Size(), Included: true}
+		if since != nil {
+			size, ok := sinceSizes[name]
+			file.Included = !ok || size != file.Size || (since.MergeFileId != cut.mergeFileId && replacedByMerge(name, cut.mergeFileId))
+		}
+		if file.Included {
+			if err := utils.LinkOrCopyFile(fs, srcPath, filepath.Join(dirPath, name)); err != nil {
+				return nil, err
+			}
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	if cut.hasActive && since == nil {
+		activePath := data.GetDataFileName(dirPath, cut.activeFid)
+		if err := writeBackupFile(fs, activePath, func(w io.Writer) error { return nil }); err != nil {
+			return nil, err
+		}
+	}
+
+	// 最后写入备份清单，有清单的备份才是完整的
+	if err := writeBackupFile(fs, filepath.Join(dirPath, BackupManifestFileName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(manifest)
+	}); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// replacedByMerge 文件是否由边界为 mergeFileId 的 merge 生成
+func replacedByMerge(name string, mergeFileId uint32) bool {
+	if name == data.HintFileName || name == data.MergeFinishedFileName {
+		return true
+	}
+	fid, err := strconv.ParseUint(strings.TrimSuffix(name, data.DataFileNameSuffix), 10, 32)
+	return err == nil && uint32(fid) < mergeFileId
+}
+
+func newManifestID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ReadManifest 读取备份目录中的备份清单，fs 为空时使用操作系统的文件系统
+func ReadManifest(fs fio.FileSystem, dirPath string) (*Manifest, error) {
+	if fs == nil {
+		fs = fio.OSFileSystem
+	}
+	file, err := fs.OpenFile(filepath.Join(dirPath, BackupManifestFileName), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(Manifest)
+	if err := json.NewDecoder(io.NewSectionReader(file, 0, info.Size())).Decode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Restore 从一个全量备份和之后依次基于它的增量备份中恢复出数据目录，targetDir 必须不存在或者是空目录
+// 备份和恢复出来的目录都在 fs 中，fs 为空时使用操作系统的文件系统。
+// 数据文件通过硬链接恢复，不支持时拷贝；B+ 树索引会被修改，总是拷贝
+func Restore(fs fio.FileSystem, backupChain []string, targetDir string) error {
+	if fs == nil {
+		fs = fio.OSFileSystem
+	}
+	if len(backupChain) == 0 {
+		return ErrInvalidBackupChain
+	}
+	manifests := make([]*Manifest, len(backupChain))
+	for i, dirPath := range backupChain {
+		manifest, err := ReadManifest(fs, dirPath)
+		if err != nil {
+			return err
+		}
+		// 第一个必须是全量备份，之后每一个都基于前一个
+		if (i == 0 && manifest.ParentID != "") || (i > 0 && manifest.ParentID != manifests[i-1].ID) {
+			return ErrInvalidBackupChain
+		}
+		manifests[i] = manifest
+	}
+
+	if err := fs.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(targetDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+	if _, err := fs.Stat(mergePathOf(targetDir)); err == nil {
+		return ErrRestoreDirNotEmpty
+	}
+
+	last := manifests[len(manifests)-1]
+	for _, file := range last.Files {
+		srcPath, err := findBackupFile(backupChain, manifests, file)
+		if err != nil {
+			return err
+		}
+		if err := utils.LinkOrCopyFile(fs, srcPath, filepath.Join(targetDir, file.Name)); err != nil {
+			return err
+		}
+	}
+
+	lastDir := backupChain[len(backupChain)-1]
+	bptreePath := filepath.Join(lastDir, index.BPTreeIndexFileName)
+	if _, err := fs.Stat(bptreePath); err == nil {
+		if err := utils.CopyFile(fs, bptreePath, filepath.Join(targetDir, index.BPTreeIndexFileName)); err != nil {
+			return err
+		}
+	}
+
+	// 空的活跃文件，恢复出来的数据库写入时不会修改和备份共享的文件
+	activePath := data.GetDataFileName(targetDir, last.ActiveFid)
+	return writeBackupFile(fs, activePath, func(w io.Writer) error { return nil })
+}
+
+// findBackupFile 从后往前找到最近一个保存了 file 的备份
+func findBackupFile(backupChain []string, manifests []*Manifest, file ManifestFile) (string, error) {
+	for i := len(manifests) - 1; i >= 0; i-- {
+		for _, f := range manifests[i].Files {
+			if f.Name != file.Name || !f.Included {
+				continue
+			}
+			// 同名文件之后没有改变过，大小一定相同
+			if f.Size != file.Size {
+				return "", ErrInvalidBackupChain
+			}
+			return filepath.Join(backupChain[i], file.Name), nil
+		}
+	}
+	return "", ErrInvalidBackupChain
+}
+
+// prepareBackupDir 创建备份目录，已经有数据或者 merge 目录的目录不能用于备份
+func (db *DB) prepareBackupDir(dirPath string) error {
+	fs := db.options.FS
+	if err := fs.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrBackupDirNotEmpty
+	}
+	// 打开备份时会安装 merge 目录中的数据，不能使用残留的 merge 目录
+	if _, err := fs.Stat(mergePathOf(dirPath)); err == nil {
+		return ErrBackupDirNotEmpty
+	}
+	return nil
+}
+
+// backupCut 加锁轮转活跃文件，记录一致的时间点
+func (db *DB) backupCut() (*backupCut, error) {
+	// 等待 B+ 树索引正在进行的更新，索引快照才能和数据文件一致
+	db.indexUpdateLock.Lock()
+	defer db.indexUpdateLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	cut := &backupCut{seqNo: atomic.LoadUint64(&db.seqNo)}
+	if db.activeFile != nil {
+		// 活跃文件中有数据时转换为旧的数据文件，备份的文件之后都不会再写入
+		if db.activeFile.WriteOffset > 0 {
+			if err := db.rotateActiveFile(); err != nil {
+				return nil, err
+			}
+		}
+		cut.activeFid = db.activeFile.FileId
+		cut.hasActive = true
+	}
+
+	var fileIds []int
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	sort.Ints(fileIds)
+	for _, fid := range fileIds {
+		cut.fileNames = append(cut.fileNames, filepath.Base(data.GetDataFileName(db.options.DirPath, uint32(fid))))
+	}
+
+	// 上一次安装的 merge 留下的 hint 文件和 merge 完成标识
+	mergeFinishedPath := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := db.options.FS.Stat(mergeFinishedPath); err == nil {
+		nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+		if err != nil {
+			return nil, err
+		}
+		cut.mergeFileId = nonMergeFileId
+		cut.fileNames = append(cut.fileNames, data.MergeFinishedFileName)
+		if _, err := db.options.FS.Stat(filepath.Join(db.options.DirPath, data.HintFileName)); err == nil {
+			cut.fileNames = append(cut.fileNames, data.HintFileName)
+		}
+	}
+
+	if bptree, ok := db.index.(*index.BPlusTree); ok {
+		snapshot, err := bptree.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		cut.snapshot = snapshot
+	}
+	return cut, nil
+}
+
+// writeBackupFile 创建一个新文件，写入数据之后持久化
+func writeBackupFile(fs fio.FileSystem, filePath string, write func(w io.Writer) error) error {
+	file, err := fs.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fio.DateFilePerm)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
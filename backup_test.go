@@ -0,0 +1,423 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio/memfs"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAll 读取数据库中所有的 key 和 value
+func readAll(t *testing.T, db *DB) map[string]string {
+	values := make(map[string]string)
+	err := db.Fold(func(key []byte, value []byte) bool {
+		values[string(key)] = string(value)
+		return true
+	})
+	assert.Nil(t, err)
+	return values
+}
+
+func TestDB_Backup_Online(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-backup-online")
+			backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-online-dest")
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			defer destoryDB(db)
+			assert.Nil(t, err)
+
+			for i := 0; i < 1000; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			for i := 0; i < 100; i++ {
+				err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put([]byte("batch-key"), []byte("batch-value")))
+			assert.Nil(t, wb.Commit())
+			expected := readAll(t, db)
+
+			manifest, err := db.Backup(backupDir)
+			assert.Nil(t, err)
+			assert.Equal(t, db.activeFile.FileId, manifest.ActiveFid)
+			assert.Equal(t, db.seqNo, manifest.SeqNo)
+			assert.Equal(t, len(db.olderFiles), len(manifest.Files))
+			for i, file := range manifest.Files {
+				assert.Equal(t, filepath.Base(data.GetDataFileName(dir, uint32(i))), file.Name)
+			}
+
+			// 不会再修改的数据文件通过硬链接备份
+			srcInfo, err := os.Stat(data.GetDataFileName(dir, 0))
+			assert.Nil(t, err)
+			destInfo, err := os.Stat(data.GetDataFileName(backupDir, 0))
+			assert.Nil(t, err)
+			assert.True(t, os.SameFile(srcInfo, destInfo))
+
+			// 备份清单
+			content, err := os.ReadFile(filepath.Join(backupDir, BackupManifestFileName))
+			assert.Nil(t, err)
+			var saved Manifest
+			assert.Nil(t, json.Unmarshal(content, &saved))
+			assert.Equal(t, manifest.Files, saved.Files)
+			assert.Equal(t, manifest.ActiveFid, saved.ActiveFid)
+
+			// 备份之后的写入不会出现在备份中
+			for i := 0; i < 200; i++ {
+				err := db.Put(utils.GetTestKey(i), []byte("after-backup"))
+				assert.Nil(t, err)
+			}
+			lastFile := data.GetDataFileName(dir, manifest.ActiveFid-1)
+			lastInfo, err := os.Stat(lastFile)
+			assert.Nil(t, err)
+
+			backupOpts := opts
+			backupOpts.DirPath = backupDir
+			backupDB, err := Open(backupOpts)
+			defer destoryDB(backupDB)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, readAll(t, backupDB))
+
+			// 打开备份之后的写入进入空的活跃文件，不会修改和原数据库共享的文件
+			for i := 0; i < 200; i++ {
+				err := backupDB.Put(utils.GetTestKey(i), []byte("in-backup"))
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, backupDB.Sync())
+			lastInfo2, err := os.Stat(lastFile)
+			assert.Nil(t, err)
+			assert.Equal(t, lastInfo.Size(), lastInfo2.Size())
+			value, err := db.Get(utils.GetTestKey(150))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("after-backup"), value)
+		})
+	}
+}
+
+// 备份期间的并发写入，备份要么包含一次写入，要么不包含，单个协程顺序写入的数据是一个连续的前缀
+func TestDB_Backup_ConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-concurrent")
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-concurrent-dest")
+	defer os.RemoveAll(backupDir)
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	const writes = 3000
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			err := db.Put([]byte(fmt.Sprintf("seq-%06d", i)), []byte("value"))
+			assert.Nil(t, err)
+		}
+	}()
+	_, err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	wg.Wait()
+
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	defer destoryDB(backupDB)
+	assert.Nil(t, err)
+	var count int
+	for i := 0; i < writes; i++ {
+		if _, err := backupDB.Get([]byte(fmt.Sprintf("seq-%06d", i))); err == ErrKeyNotFound {
+			break
+		}
+		count++
+	}
+	keys := listKeys(t, backupDB)
+	assert.Equal(t, 2000+count, len(keys))
+}
+
+func TestDB_Backup_Merge(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-backup-merge")
+			backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-merge-dest")
+			backupDir2, _ := os.MkdirTemp("", "bitcask-go-backup-merge-dest2")
+			defer os.RemoveAll(backupDir)
+			defer os.RemoveAll(backupDir2)
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			assert.Nil(t, err)
+
+			for i := 0; i < 1000; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			for i := 0; i < 500; i++ {
+				err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+
+			// merge 完成但是还没有安装，merge 目录不会备份
+			err = db.Merge()
+			assert.Nil(t, err)
+			manifest, err := db.Backup(backupDir)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(0), manifest.MergeFileId)
+			_, err = os.Stat(mergePathOf(backupDir))
+			assert.True(t, os.IsNotExist(err))
+			expected := readAll(t, db)
+			assert.Nil(t, db.Close())
+
+			// 重启安装 merge 之后，hint 文件和 merge 完成标识也需要备份
+			db, err = Open(opts)
+			defer destoryDB(db)
+			assert.Nil(t, err)
+			manifest2, err := db.Backup(backupDir2)
+			assert.Nil(t, err)
+			nonMergeFileId, err := db.getNonMergeFileId(dir)
+			assert.Nil(t, err)
+			assert.Equal(t, nonMergeFileId, manifest2.MergeFileId)
+			var names []string
+			for _, file := range manifest2.Files {
+				names = append(names, file.Name)
+			}
+			assert.Contains(t, names, data.HintFileName)
+			assert.Contains(t, names, data.MergeFinishedFileName)
+			assert.NotContains(t, names, index.BPTreeIndexFileName)
+
+			for _, backup := range []string{backupDir, backupDir2} {
+				backupOpts := opts
+				backupOpts.DirPath = backup
+				backupDB, err := Open(backupOpts)
+				assert.Nil(t, err)
+				assert.Equal(t, expected, readAll(t, backupDB))
+				assert.Nil(t, backupDB.Close())
+			}
+		})
+	}
+}
+
+func TestDB_Backup_InvalidDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-invalid")
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-invalid-dest")
+	defer os.RemoveAll(backupDir)
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetRandomValue(10))
+	assert.Nil(t, err)
+
+	// 备份目录中已经有数据
+	err = os.WriteFile(filepath.Join(backupDir, "other"), []byte("other"), 0644)
+	assert.Nil(t, err)
+	_, err = db.Backup(backupDir)
+	assert.Equal(t, ErrBackupDirNotEmpty, err)
+	assert.Nil(t, os.Remove(filepath.Join(backupDir, "other")))
+
+	// 残留的 merge 目录会在打开备份时被安装
+	err = os.MkdirAll(mergePathOf(backupDir), os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(mergePathOf(backupDir))
+	_, err = db.Backup(backupDir)
+	assert.Equal(t, ErrBackupDirNotEmpty, err)
+	assert.Nil(t, os.RemoveAll(mergePathOf(backupDir)))
+
+	_, err = db.Backup(backupDir)
+	assert.Nil(t, err)
+}
+
+func TestDB_BackupIncremental_Restore(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-backup-incremental")
+			root, _ := os.MkdirTemp("", "bitcask-go-backup-incremental-dest")
+			defer os.RemoveAll(root)
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			assert.Nil(t, err)
+
+			var chain []string
+			var expected []map[string]string
+			var manifests []*Manifest
+			backup := func(db *DB) {
+				dirPath := filepath.Join(root, fmt.Sprintf("backup-%d", len(chain)))
+				var manifest *Manifest
+				var err error
+				if len(manifests) == 0 {
+					manifest, err = db.Backup(dirPath)
+				} else {
+					manifest, err = db.BackupIncremental(dirPath, *manifests[len(manifests)-1])
+				}
+				assert.Nil(t, err)
+				chain = append(chain, dirPath)
+				manifests = append(manifests, manifest)
+				expected = append(expected, readAll(t, db))
+			}
+			included := func(manifest *Manifest) map[string]bool {
+				files := make(map[string]bool)
+				for _, file := range manifest.Files {
+					if file.Included {
+						files[file.Name] = true
+					}
+				}
+				return files
+			}
+
+			for i := 0; i < 1000; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			backup(db)
+
+			// 增量备份只包含新的数据文件
+			for i := 1000; i < 1500; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			for i := 0; i < 800; i++ {
+				err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+			backup(db)
+			assert.NotEmpty(t, included(manifests[1]))
+			for name := range included(manifests[1]) {
+				fid, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+				assert.Nil(t, err)
+				assert.GreaterOrEqual(t, uint32(fid), manifests[0].ActiveFid)
+			}
+
+			// merge 替换了旧的文件 id，同名的文件也需要重新备份
+			err = db.Merge()
+			assert.Nil(t, err)
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			defer destoryDB(db)
+			assert.Nil(t, err)
+			err = db.Put([]byte("after-merge"), []byte("value"))
+			assert.Nil(t, err)
+			backup(db)
+			assert.NotEqual(t, uint32(0), manifests[2].MergeFileId)
+			files := included(manifests[2])
+			assert.True(t, files[filepath.Base(data.GetDataFileName(dir, 0))])
+			assert.True(t, files[data.HintFileName])
+			assert.True(t, files[data.MergeFinishedFileName])
+
+			// merge 边界没有变化时，merge 生成的文件不再备份
+			err = db.Put([]byte("after-merge-2"), []byte("value"))
+			assert.Nil(t, err)
+			backup(db)
+			files = included(manifests[3])
+			assert.False(t, files[filepath.Base(data.GetDataFileName(dir, 0))])
+			assert.False(t, files[data.HintFileName])
+
+			// 从每个时间点的备份链恢复
+			for i := range chain {
+				targetDir := filepath.Join(root, fmt.Sprintf("restore-%d", i))
+				err := Restore(nil, chain[:i+1], targetDir)
+				assert.Nil(t, err)
+				restoreOpts := opts
+				restoreOpts.DirPath = targetDir
+				restored, err := Open(restoreOpts)
+				assert.Nil(t, err)
+				assert.Equal(t, expected[i], readAll(t, restored))
+
+				// 恢复出来的数据库可以写入，不会修改备份中的文件
+				err = restored.Put([]byte("after-restore"), []byte("value"))
+				assert.Nil(t, err)
+				assert.Nil(t, restored.Close())
+			}
+			targetDir := filepath.Join(root, "restore-again")
+			err = Restore(nil, chain, targetDir)
+			assert.Nil(t, err)
+			restoreOpts := opts
+			restoreOpts.DirPath = targetDir
+			restored, err := Open(restoreOpts)
+			assert.Nil(t, err)
+			assert.Equal(t, expected[len(expected)-1], readAll(t, restored))
+			assert.Nil(t, restored.Close())
+
+			// 不完整的备份链和非空的目录
+			err = Restore(nil, chain[1:], filepath.Join(root, "invalid-1"))
+			assert.Equal(t, ErrInvalidBackupChain, err)
+			err = Restore(nil, []string{chain[0], chain[2]}, filepath.Join(root, "invalid-2"))
+			assert.Equal(t, ErrInvalidBackupChain, err)
+			err = Restore(nil, nil, filepath.Join(root, "invalid-3"))
+			assert.Equal(t, ErrInvalidBackupChain, err)
+			err = Restore(nil, chain, targetDir)
+			assert.Equal(t, ErrRestoreDirNotEmpty, err)
+		})
+	}
+}
+
+// 备份和恢复都在 Options.FS 指定的文件系统中进行
+func TestDB_Backup_Restore_MemFS(t *testing.T) {
+	fs := memfs.New()
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-backup-memfs"
+	opts.DataFileSize = 8 * 1024
+	opts.FS = fs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	full, err := db.Backup("/backup-0")
+	assert.Nil(t, err)
+	for i := 250; i < 750; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	incremental, err := db.BackupIncremental("/backup-1", *full)
+	assert.Nil(t, err)
+	expected := readAll(t, db)
+	assert.Nil(t, db.Close())
+
+	manifest, err := ReadManifest(fs, "/backup-1")
+	assert.Nil(t, err)
+	assert.Equal(t, incremental.ID, manifest.ID)
+	_, err = os.Stat("/backup-1")
+	assert.True(t, os.IsNotExist(err))
+
+	err = Restore(fs, []string{"/backup-0", "/backup-1"}, "/restored")
+	assert.Nil(t, err)
+	opts.DirPath = "/restored"
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, readAll(t, db))
+	assert.Nil(t, db.Close())
+}
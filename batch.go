@@ -2,6 +2,7 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/index"
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
@@ -21,9 +22,6 @@ type WriteBatch struct {
 
 // NewWriteBatch 初始化 WriteBatch
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seqNo file not exists")
-	}
 	return &WriteBatch{
 		options:       opts,
 		lock:          new(sync.Mutex),
@@ -59,7 +57,10 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.lock.Unlock()
 
 	// 数据不存在，直接返回
-	logRecordPos := wb.db.index.Get(key)
+	logRecordPos, err := wb.db.index.Get(key)
+	if err != nil {
+		return err
+	}
 	if logRecordPos == nil {
 		// 如果在 pendingWrites 中，删除
 		if wb.pendingWrites[string(key)] != nil {
@@ -91,6 +92,8 @@ func (wb *WriteBatch) Commit() error {
 	}
 
 	// 加数据库的锁，保证事务提交串行化
+	wb.db.indexUpdateLock.Lock()
+	defer wb.db.indexUpdateLock.Unlock()
 	wb.db.lock.Lock()
 	defer wb.db.lock.Unlock()
 
@@ -119,15 +122,46 @@ func (wb *WriteBatch) Commit() error {
 		Key:  encodeKeyWithSeqNo(txnFinKey, seqNo),
 	}
 	// println("finishedRecord: ", string(finishedRecord.Key))
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := wb.db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
 
 	// 根据配置决定是否持久化
 	if wb.options.SyncWrites && wb.db.activeFile != nil {
 		if err := wb.db.activeFile.Sync(); err != nil {
+			// 持久化失败时回滚事务完成的标识，事务中已经写入的数据在重启之后不会生效
+			if truncErr := wb.db.activeFile.Truncate(finishedPos.Offset); truncErr != nil {
+				return truncErr
+			}
+			return err
+		}
+	}
+
+	// B+ 树索引在一个 bolt 事务中更新，并持久化序列号：B+ 树索引不会从数据文件中恢复序列号，
+	// 崩溃时没有更新索引的事务不可见，它的序列号重新使用也不会有影响
+	if bptree, ok := wb.db.index.(*index.BPlusTree); ok {
+		keys := make([][]byte, 0, len(wb.pendingWrites))
+		positions := make([]*data.LogRecordPos, 0, len(wb.pendingWrites))
+		for _, record := range wb.pendingWrites {
+			keys = append(keys, record.Key)
+			if record.Type == data.LogRecordDeleted {
+				positions = append(positions, nil)
+			} else {
+				positions = append(positions, pendingPos[string(record.Key)])
+			}
+		}
+		oldPositions, err := bptree.CommitBatch(seqNo, keys, positions)
+		if err != nil {
 			return err
 		}
+		for _, oldPos := range oldPositions {
+			if oldPos != nil {
+				wb.db.reclaimSize += int64(oldPos.Size)
+			}
+		}
+		wb.pendingWrites = make(map[string]*data.LogRecord)
+		return nil
 	}
 
 	// 更新内存索引
@@ -135,9 +169,12 @@ func (wb *WriteBatch) Commit() error {
 		pos := pendingPos[string(record.Key)]
 		var oldPos *data.LogRecordPos
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _, err = wb.db.index.Delete(record.Key)
 		} else if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos, err = wb.db.index.Put(record.Key, pos)
+		}
+		if err != nil {
+			return err
 		}
 		if oldPos != nil {
 			wb.db.reclaimSize += int64(oldPos.Size)
@@ -1,9 +1,12 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
 	"bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -74,7 +77,7 @@ func TestWriteBatch2(t *testing.T) {
 	// 2. 提交数据
 	err = wb.Commit()
 	assert.Nil(t, err)
-	keys := db.ListKeys()
+	keys := listKeys(t, db)
 	assert.Equal(t, 2, len(keys))
 	resValue2, err := db.Get(key2)
 	assert.Nil(t, err)
@@ -159,6 +162,49 @@ func TestWriteBatch4(t *testing.T) {
 	}
 	err = wb.Commit()
 	assert.Nil(t, err)
-	assert.Equal(t, 500000, len(db.ListKeys()))
+	assert.Equal(t, 500000, len(listKeys(t, db)))
 
 }
+
+// B+ 树索引的事务序列号在提交时持久化，没有正常关闭也可以继续使用事务
+func TestWriteBatch_BPlusTree_Crash(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-writeBatch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetRandomValue(10)))
+		assert.Nil(t, wb.Commit())
+	}
+	assert.Equal(t, uint64(3), db.seqNo)
+	simulateCrash(db)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), db2.seqNo)
+	wb := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), utils.GetRandomValue(10)))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, uint64(4), db2.seqNo)
+	assert.Equal(t, 4, len(listKeys(t, db2)))
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 之前的版本关闭时写入的 seqNo 文件
+	seqNoFile, err := data.OpenSeqNoFile(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("seq.no"), Value: []byte("10")})
+	assert.Nil(t, seqNoFile.Write(record))
+	assert.Nil(t, seqNoFile.Close())
+
+	db3, err := Open(opts)
+	defer destoryDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), db3.seqNo)
+	_, err = os.Stat(filepath.Join(dir, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+}
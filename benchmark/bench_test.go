@@ -5,8 +5,10 @@ import (
 	"bitcask-go/utils"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -52,6 +54,28 @@ func Benchmark_Get(b *testing.B) {
 	}
 }
 
+func Benchmark_GetInto(b *testing.B) {
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(b, err)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	dst := make([]byte, 0, 1024)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		value, err := db.GetInto(utils.GetTestKey(rand.Intn(10000)), dst)
+		if err != nil && err != bitcask.ErrKeyNotFound {
+			b.Fatal(err)
+		}
+		if err == nil {
+			dst = value
+		}
+	}
+}
+
 func Benchmark_Delete(b *testing.B) {
 	for i := 0; i < 10000; i++ {
 		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
@@ -69,3 +93,185 @@ func Benchmark_Delete(b *testing.B) {
 		}
 	}
 }
+
+// openBPTreeDB 打开一个使用 B+ 树索引的数据库，测试结束后删除
+func openBPTreeDB(b *testing.B, syncWrites bool) *bitcask.DB {
+	opts := bitcask.DefaultOptions
+	dir, err := os.MkdirTemp("", "bitcask-go-bench-bptree")
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts.DirPath = dir
+	opts.IndexType = bitcask.BPlusTree
+	opts.SyncWrites = syncWrites
+	bptreeDB, err := bitcask.Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = bptreeDB.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return bptreeDB
+}
+
+// B+ 树索引的写入吞吐量，sync 时每次写入都要持久化数据文件和索引
+func Benchmark_Put_BPlusTree(b *testing.B) {
+	for _, syncWrites := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sync=%v", syncWrites), func(b *testing.B) {
+			bptreeDB := openBPTreeDB(b, syncWrites)
+			value := utils.GetRandomValue(1024)
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bptreeDB.Put(utils.GetTestKey(i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// 并发写入时，索引的更新合并到同一个 bolt 事务中
+func Benchmark_Put_BPlusTree_Parallel(b *testing.B) {
+	for _, syncWrites := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sync=%v", syncWrites), func(b *testing.B) {
+			bptreeDB := openBPTreeDB(b, syncWrites)
+			value := utils.GetRandomValue(1024)
+			var counter int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&counter, 1)
+					if err := bptreeDB.Put(utils.GetTestKey(int(i)), value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// 并发读写时，分片索引在数据库锁外更新和查找索引
+func Benchmark_Put_Get_Sharded_Parallel(b *testing.B) {
+	for _, shardNum := range []int{0, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shardNum), func(b *testing.B) {
+			opts := bitcask.DefaultOptions
+			dir, err := os.MkdirTemp("", "bitcask-go-bench-sharded")
+			if err != nil {
+				b.Fatal(err)
+			}
+			opts.DirPath = dir
+			opts.IndexShardNum = shardNum
+			shardedDB, err := bitcask.Open(opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				_ = shardedDB.Close()
+				_ = os.RemoveAll(dir)
+			})
+
+			value := utils.GetRandomValue(128)
+			for i := 0; i < 10000; i++ {
+				if err := shardedDB.Put(utils.GetTestKey(i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var counter int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// 每 4 次操作中有一次写入
+					i := atomic.AddInt64(&counter, 1)
+					key := utils.GetTestKey(int(i % 10000))
+					var err error
+					if i%4 == 0 {
+						err = shardedDB.Put(key, value)
+					} else {
+						_, err = shardedDB.Get(key)
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// 一个 WriteBatch 的索引在同一个 bolt 事务中更新
+func Benchmark_WriteBatch_BPlusTree(b *testing.B) {
+	const batchSize = 100
+	for _, syncWrites := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sync=%v", syncWrites), func(b *testing.B) {
+			bptreeDB := openBPTreeDB(b, syncWrites)
+			value := utils.GetRandomValue(1024)
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				wb := bptreeDB.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+				for j := 0; j < batchSize; j++ {
+					if err := wb.Put(utils.GetTestKey(i*batchSize+j), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := wb.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "keys/s")
+		})
+	}
+}
+
+// 各种格式导出的速度
+func Benchmark_Export(b *testing.B) {
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(b, err)
+	}
+
+	formats := map[string]bitcask.ExportFormat{"ndjson": bitcask.NDJSON, "csv": bitcask.CSV, "binary": bitcask.BinaryDump}
+	for name, format := range formats {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Export(io.Discard, format, bitcask.DefaultExportOptions); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark_BulkLoad 每次迭代写入一个 key，和 Benchmark_Put 对比
+func Benchmark_BulkLoad(b *testing.B) {
+	for _, sorted := range []bool{true, false} {
+		b.Run(fmt.Sprintf("sorted-%v", sorted), func(b *testing.B) {
+			opts := bitcask.DefaultBulkLoaderOptions
+			opts.DirPath, _ = os.MkdirTemp("", "bitcask-go-bench-bulk-load")
+			opts.Sorted = sorted
+			defer os.RemoveAll(opts.DirPath)
+			loader, err := bitcask.NewBulkLoader(opts)
+			assert.Nil(b, err)
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := loader.Add(utils.GetTestKey(i), utils.GetRandomValue(1024)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := loader.Finish(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
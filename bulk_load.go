@@ -0,0 +1,526 @@
+package bitcask_go
+
+// 批量导入
+// BulkLoader 不经过数据库的写入流程，直接把数据写入新目录下的数据文件，同时生成对应的 hint 文件。
+// 生成的目录和 merge 之后的数据目录格式相同：merge-finished 中记录数据文件的边界，边界之后是一个空的活跃文件，
+// 可以直接通过 Open 打开，启动时从 hint 文件中加载索引，不需要回放数据文件；
+// 也可以通过 DB.Ingest 导入到已经打开的数据库中。
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const ingestInstallingKey = "ingest.installing"
+
+// BulkLoader 批量生成数据文件和 hint 文件，不能并发使用
+type BulkLoader struct {
+	options    BulkLoaderOptions
+	dataFile   *data.DataFile // 正在写入的数据文件
+	hintFile   *data.DataFile
+	hintWriter *data.HintWriter
+	// 排序的输入中还没有写入的最后一条数据，遇到更大的 key 时才写入，重复的 key 只保留最后一个 value
+	pendingKey   []byte
+	pendingValue []byte
+	// 没有排序的输入中每个 key 最新的位置，Finish 时再写入 hint 文件
+	positions map[string]*data.LogRecordPos
+	finished  bool
+}
+
+// NewBulkLoader 在 options.DirPath 下创建批量导入的目录，目录不存在时创建，已经存在时必须为空
+func NewBulkLoader(options BulkLoaderOptions) (*BulkLoader, error) {
+	if options.FS == nil {
+		options.FS = fio.OSFileSystem
+	}
+	if options.DirPath == "" {
+		return nil, errors.New("bulk load dir path is empty")
+	}
+	if options.DataFileSize <= 0 {
+		return nil, errors.New("bulk load data file size must be greater than 0")
+	}
+
+	fs := options.FS
+	if err := fs.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, ErrBulkLoadDirNotEmpty
+	}
+
+	hintFile, err := data.OpenHintFile(fs, options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := hintFile.SetWriteBuffer(options.WriteBufferSize); err != nil {
+		_ = hintFile.Close()
+		return nil, err
+	}
+	loader := &BulkLoader{
+		options:    options,
+		hintFile:   hintFile,
+		hintWriter: data.NewHintWriter(hintFile),
+	}
+	if !options.Sorted {
+		loader.positions = make(map[string]*data.LogRecordPos)
+	}
+	return loader, nil
+}
+
+// Add 添加一条数据，相同的 key 以最后添加的 value 为准
+// Sorted 为 true 时 key 必须按照字节序递增（允许相同），否则返回 ErrBulkLoadUnsorted
+func (bl *BulkLoader) Add(key, value []byte) error {
+	if bl.finished {
+		return ErrBulkLoadFinished
+	}
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	if !bl.options.Sorted {
+		pos, err := bl.writeRecord(key, value)
+		if err != nil {
+			return err
+		}
+		bl.positions[string(key)] = pos
+		return nil
+	}
+
+	if bl.pendingKey != nil {
+		switch bytes.Compare(key, bl.pendingKey) {
+		case -1:
+			return ErrBulkLoadUnsorted
+		case 0:
+			bl.pendingValue = append(bl.pendingValue[:0], value...)
+			return nil
+		}
+		if err := bl.flushPending(); err != nil {
+			return err
+		}
+	}
+	// 调用方可能复用 key 和 value 的内存，需要拷贝
+	bl.pendingKey = append(bl.pendingKey[:0], key...)
+	bl.pendingValue = append(bl.pendingValue[:0], value...)
+	return nil
+}
+
+// Finish 写入剩余的数据、hint 文件和 merge-finished 文件，之后目录可以通过 Open 打开或者通过 DB.Ingest 导入
+func (bl *BulkLoader) Finish() error {
+	if bl.finished {
+		return ErrBulkLoadFinished
+	}
+	bl.finished = true
+
+	if bl.options.Sorted && bl.pendingKey != nil {
+		if err := bl.flushPending(); err != nil {
+			return err
+		}
+	}
+	for key, pos := range bl.positions {
+		if err := bl.hintWriter.WriteHintRecord([]byte(key), pos); err != nil {
+			return err
+		}
+	}
+
+	// 数据文件都持久化之后再写入 hint 文件的结尾记录
+	var nonMergeFileId uint32 = 0
+	if bl.dataFile != nil {
+		nonMergeFileId = bl.dataFile.FileId + 1
+		if err := bl.closeDataFile(); err != nil {
+			return err
+		}
+	}
+	if err := bl.hintWriter.Finish(); err != nil {
+		return err
+	}
+	if err := bl.hintFile.Close(); err != nil {
+		return err
+	}
+	bl.hintFile = nil
+
+	// 空的活跃文件，打开之后的写入追加到新的文件中，不会改动 hint 文件对应的数据文件
+	fs, dirPath := bl.options.FS, bl.options.DirPath
+	activeFile, err := data.OpenDateFile(fs, dirPath, nonMergeFileId, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+	if err := activeFile.Close(); err != nil {
+		return err
+	}
+
+	// 最后写入 merge-finished，没有这个文件的目录是不完整的
+	mergeFinishedFile, err := data.OpenMergeFinishFile(fs, dirPath)
+	if err != nil {
+		return err
+	}
+	defer mergeFinishedFile.Close()
+	return writeFileIdRecord(mergeFinishedFile, mergeFinishedKey, nonMergeFileId)
+}
+
+// Abort 放弃批量导入，关闭并删除已经写入的文件
+func (bl *BulkLoader) Abort() error {
+	bl.finished = true
+	if bl.dataFile != nil {
+		_ = bl.dataFile.Close()
+		bl.dataFile = nil
+	}
+	if bl.hintFile != nil {
+		_ = bl.hintFile.Close()
+		bl.hintFile = nil
+	}
+	return bl.options.FS.RemoveAll(bl.options.DirPath)
+}
+
+// flushPending 写入排序的输入中暂存的最后一条数据
+func (bl *BulkLoader) flushPending() error {
+	pos, err := bl.writeRecord(bl.pendingKey, bl.pendingValue)
+	if err != nil {
+		return err
+	}
+	return bl.hintWriter.WriteHintRecord(bl.pendingKey, pos)
+}
+
+// writeRecord 追加写入一条数据，当前数据文件写满时切换到下一个数据文件
+func (bl *BulkLoader) writeRecord(key, value []byte) (*data.LogRecordPos, error) {
+	// 数据写入之后就不再需要，使用缓冲池中的内存
+	bufPtr := data.GetBuffer(0)
+	defer data.PutBuffer(bufPtr)
+	encRecord, size := data.EncodeLogRecordTo(*bufPtr, &data.LogRecord{
+		Key:   encodeKeyWithSeqNo(key, nonTransactionSeqNo),
+		Value: value,
+		Type:  data.LogRecordNormal,
+	})
+	*bufPtr = encRecord
+
+	if bl.dataFile == nil || (bl.dataFile.WriteOffset > 0 && bl.dataFile.WriteOffset+size > bl.options.DataFileSize) {
+		var fileId uint32 = 0
+		if bl.dataFile != nil {
+			fileId = bl.dataFile.FileId + 1
+			if err := bl.closeDataFile(); err != nil {
+				return nil, err
+			}
+		}
+		dataFile, err := data.OpenDateFile(bl.options.FS, bl.options.DirPath, fileId, fio.StandardIO)
+		if err != nil {
+			return nil, err
+		}
+		if err := dataFile.SetWriteBuffer(bl.options.WriteBufferSize); err != nil {
+			_ = dataFile.Close()
+			return nil, err
+		}
+		bl.dataFile = dataFile
+	}
+
+	offset := bl.dataFile.WriteOffset
+	if err := bl.dataFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	return &data.LogRecordPos{Fid: bl.dataFile.FileId, Offset: offset, Size: uint32(size)}, nil
+}
+
+// closeDataFile 持久化并关闭当前的数据文件
+func (bl *BulkLoader) closeDataFile() error {
+	if err := bl.dataFile.Sync(); err != nil {
+		return err
+	}
+	err := bl.dataFile.Close()
+	bl.dataFile = nil
+	return err
+}
+
+// Ingest 将 BulkLoader 生成的目录中的数据导入到数据库中，导入的数据覆盖数据库中相同的 key
+// 导入的目录需要和数据库在同一个文件系统中，导入过程中不会修改，导入之后可以直接删除
+// 数据文件先在锁外链接（不支持硬链接时拷贝）到数据目录中，然后在锁内写入安装标识、重命名为新的数据文件并更新索引，
+// 安装过程中崩溃时下次启动会完成安装，导入的数据要么全部可见，要么全部不可见。
+// B+ 树索引启动时不回放数据文件，hint 文件也一起链接过来，下次启动时用它补上没有写入的索引
+func (db *DB) Ingest(dirPath string) error {
+	db.ingestLock.Lock()
+	defer db.ingestLock.Unlock()
+
+	fileNum, keys, positions, err := db.readBulkLoadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	// 还没有安装的文件使用单独的后缀，不会被当做数据文件加载
+	fs := db.options.FS
+	installing := false
+	defer func() {
+		if !installing {
+			_ = db.removeIngestFiles()
+		}
+	}()
+	for fileId := uint32(0); fileId < fileNum; fileId++ {
+		src := data.GetDataFileName(dirPath, fileId)
+		if err := utils.LinkOrCopyFile(fs, src, ingestFileName(db.options.DirPath, fileId)); err != nil {
+			return err
+		}
+	}
+	if db.options.IndexType == BPlusTree {
+		src := path.Join(dirPath, data.HintFileName)
+		if err := utils.LinkOrCopyFile(fs, src, path.Join(db.options.DirPath, data.IngestHintFileName)); err != nil {
+			return err
+		}
+	}
+
+	db.indexUpdateLock.Lock()
+	defer db.indexUpdateLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// 导入的文件排在当前活跃文件之后，再创建新的活跃文件，之后的写入会覆盖导入的数据
+	var baseFileId uint32 = 0
+	oldActiveFile := db.activeFile
+	if oldActiveFile != nil {
+		baseFileId = oldActiveFile.FileId + 1
+		if err := oldActiveFile.Sync(); err != nil {
+			return err
+		}
+		if err := oldActiveFile.SetWriteBuffer(0); err != nil {
+			return err
+		}
+	}
+	if err := db.openActiveDataFile(baseFileId + fileNum); err != nil {
+		return err
+	}
+	if oldActiveFile != nil {
+		db.olderFiles[oldActiveFile.FileId] = oldActiveFile
+	}
+
+	// 安装标识写入之后导入就不能撤销了，之后出错时由下次启动完成安装
+	installingFile, err := data.OpenIngestInstallingFile(fs, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	err = writeFileIdRecord(installingFile, ingestInstallingKey, baseFileId)
+	_ = installingFile.Close()
+	if err != nil {
+		_ = fs.Remove(path.Join(db.options.DirPath, data.IngestInstallingFileName))
+		return err
+	}
+	installing = true
+	if err := db.installIngestFiles(baseFileId); err != nil {
+		return err
+	}
+
+	for fileId := baseFileId; fileId < baseFileId+fileNum; fileId++ {
+		dataFile, err := data.OpenDateFile(fs, db.options.DirPath, fileId, fio.FileIOType(db.options.IOType))
+		if err != nil {
+			return err
+		}
+		db.olderFiles[fileId] = dataFile
+	}
+	for _, pos := range positions {
+		pos.Fid += baseFileId
+	}
+	if err := db.ingestIndex(keys, positions); err != nil {
+		return err
+	}
+	// 先删除安装标识，没有安装标识时剩下的 hint 文件在启动时直接删除
+	if err := fs.Remove(path.Join(db.options.DirPath, data.IngestInstallingFileName)); err != nil {
+		return err
+	}
+	return db.removeIngestHintFile()
+}
+
+// readBulkLoadDir 读取并校验批量导入的目录，返回数据文件的数量和 hint 文件中的索引
+func (db *DB) readBulkLoadDir(dirPath string) (uint32, [][]byte, []*data.LogRecordPos, error) {
+	fs := db.options.FS
+	for _, name := range []string{data.MergeFinishedFileName, data.HintFileName} {
+		if _, err := fs.Stat(path.Join(dirPath, name)); os.IsNotExist(err) {
+			return 0, nil, nil, ErrInvalidBulkLoadDir
+		}
+	}
+	fileNum, err := db.getNonMergeFileId(dirPath)
+	if err == io.EOF || err == data.ErrInvalidCRC {
+		return 0, nil, nil, ErrInvalidBulkLoadDir
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	hintFile, err := data.OpenHintFile(fs, dirPath)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer hintFile.Close()
+	keys, positions, footer, err := data.ReadHintFile(hintFile)
+	if err == data.ErrInvalidHintFile {
+		return 0, nil, nil, ErrInvalidBulkLoadDir
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if footer.Count > 0 && footer.MaxFid >= fileNum {
+		return 0, nil, nil, ErrInvalidBulkLoadDir
+	}
+	for fileId := uint32(0); fileId < fileNum; fileId++ {
+		if _, err := fs.Stat(data.GetDataFileName(dirPath, fileId)); os.IsNotExist(err) {
+			return 0, nil, nil, ErrInvalidBulkLoadDir
+		}
+	}
+	return fileNum, keys, positions, nil
+}
+
+// ingestIndex 将导入的数据更新到索引中，需要持有数据库的锁
+func (db *DB) ingestIndex(keys [][]byte, positions []*data.LogRecordPos) error {
+	if bptree, ok := db.index.(*index.BPlusTree); ok {
+		oldPositions, err := bptree.ApplyIngest(keys, positions)
+		if err != nil {
+			return err
+		}
+		for _, oldPos := range oldPositions {
+			if oldPos != nil {
+				db.reclaimSize += int64(oldPos.Size)
+			}
+		}
+		return nil
+	}
+
+	for i, key := range keys {
+		oldPos, err := db.index.Put(key, positions[i])
+		if err != nil {
+			return err
+		}
+		if oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	}
+	return nil
+}
+
+// loadIngestFiles 启动时处理上次没有完成的导入
+// 写入了安装标识的导入需要完成重命名，没有安装标识（或者标识不完整）的导入文件直接删除
+func (db *DB) loadIngestFiles() error {
+	fs := db.options.FS
+	installingPath := path.Join(db.options.DirPath, data.IngestInstallingFileName)
+	if _, err := fs.Stat(installingPath); os.IsNotExist(err) {
+		return db.removeIngestFiles()
+	}
+
+	installingFile, err := data.OpenIngestInstallingFile(fs, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	baseFileId, err := readFileIdRecord(installingFile)
+	_ = installingFile.Close()
+	switch err {
+	case nil:
+		if err := db.installIngestFiles(baseFileId); err != nil {
+			return err
+		}
+		if err := db.loadIngestHintFile(baseFileId); err != nil {
+			return err
+		}
+	case io.EOF, data.ErrInvalidCRC:
+		if err := db.removeIngestFiles(); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if err := fs.Remove(installingPath); err != nil {
+		return err
+	}
+	return db.removeIngestHintFile()
+}
+
+// loadIngestHintFile B+ 树索引从导入的 hint 文件中补上没有写入的索引，其他索引会回放导入的数据文件
+func (db *DB) loadIngestHintFile(baseFileId uint32) error {
+	if _, ok := db.index.(*index.BPlusTree); !ok {
+		return nil
+	}
+	hintFile, err := data.OpenIngestHintFile(db.options.FS, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	defer hintFile.Close()
+	keys, positions, _, err := data.ReadHintFile(hintFile)
+	if err == data.ErrInvalidHintFile {
+		return ErrDataDirectoryCorrupted
+	}
+	if err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		pos.Fid += baseFileId
+	}
+	return db.ingestIndex(keys, positions)
+}
+
+// removeIngestHintFile 删除导入时链接过来的 hint 文件
+func (db *DB) removeIngestHintFile() error {
+	err := db.options.FS.Remove(path.Join(db.options.DirPath, data.IngestHintFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// installIngestFiles 将数据目录中还没有安装的导入文件重命名为 id 从 baseFileId 开始的数据文件
+func (db *DB) installIngestFiles(baseFileId uint32) error {
+	fs := db.options.FS
+	fileIds, err := db.ingestFileIds()
+	if err != nil {
+		return err
+	}
+	for _, fileId := range fileIds {
+		src := ingestFileName(db.options.DirPath, fileId)
+		if err := fs.Rename(src, data.GetDataFileName(db.options.DirPath, baseFileId+fileId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIngestFiles 删除数据目录中还没有安装的导入文件
+func (db *DB) removeIngestFiles() error {
+	fileIds, err := db.ingestFileIds()
+	if err != nil {
+		return err
+	}
+	for _, fileId := range fileIds {
+		if err := db.options.FS.Remove(ingestFileName(db.options.DirPath, fileId)); err != nil {
+			return err
+		}
+	}
+	return db.removeIngestHintFile()
+}
+
+// ingestFileIds 数据目录中还没有安装的导入文件在导入目录中的 id
+func (db *DB) ingestFileIds() ([]uint32, error) {
+	dirEntries, err := db.options.FS.ReadDir(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.IngestFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(name, data.IngestFileNameSuffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	return fileIds, nil
+}
+
+// ingestFileName 导入目录中 id 为 fileId 的数据文件在安装之前的文件名
+func ingestFileName(dirPath string, fileId uint32) string {
+	return path.Join(dirPath, strconv.Itoa(int(fileId))+data.IngestFileNameSuffix)
+}
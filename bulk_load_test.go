@@ -0,0 +1,274 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/fio/faultfs"
+	"bitcask-go/fio/memfs"
+	"bitcask-go/utils"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBulkLoad 生成包含 keyNum 个 key 的批量导入目录，每个 key 都写入两次，以第二次的 value 为准
+func newTestBulkLoad(t *testing.T, opts BulkLoaderOptions, keyNum int) map[string]string {
+	loader, err := NewBulkLoader(opts)
+	assert.Nil(t, err)
+
+	expected := make(map[string]string)
+	order := make([]int, keyNum)
+	for i := range order {
+		order[i] = i
+	}
+	if !opts.Sorted {
+		rand.New(rand.NewSource(1)).Shuffle(keyNum, func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	for _, i := range order {
+		for n := 0; n < 2; n++ {
+			value := utils.GetRandomValue(64)
+			assert.Nil(t, loader.Add(utils.GetTestKey(i), value))
+			expected[string(utils.GetTestKey(i))] = string(value)
+		}
+	}
+	assert.Nil(t, loader.Finish())
+	return expected
+}
+
+func TestBulkLoader_Open(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		for _, sorted := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s-sorted-%v", name, sorted), func(t *testing.T) {
+				dir, _ := os.MkdirTemp("", "bitcask-go-bulk-load")
+				loaderOpts := DefaultBulkLoaderOptions
+				loaderOpts.DirPath = dir
+				loaderOpts.DataFileSize = 64 * 1024
+				loaderOpts.Sorted = sorted
+				expected := newTestBulkLoad(t, loaderOpts, 5000)
+
+				// 生成的 hint 文件覆盖所有的数据文件，启动时不需要回放数据文件
+				opts := DefaultOptions
+				opts.DirPath = dir
+				opts.IndexType = indexType
+				db, err := Open(opts)
+				defer destoryDB(db)
+				assert.Nil(t, err)
+				assert.Equal(t, expected, readAll(t, db))
+				stat := dbStat(t, db)
+				assert.Equal(t, uint(len(expected)), stat.KeyNum)
+				assert.True(t, stat.DataFileNum > 2)
+				if indexType != BPlusTree {
+					keys, positions, err := db.readHintFile(uint32(stat.DataFileNum - 1))
+					assert.Nil(t, err)
+					assert.Equal(t, len(expected), len(keys))
+					assert.Equal(t, len(keys), len(positions))
+				}
+
+				// 之后的写入追加到新的活跃文件中，重启之后仍然有效
+				err = db.Put(utils.GetTestKey(1), []byte("new-value"))
+				assert.Nil(t, err)
+				expected[string(utils.GetTestKey(1))] = "new-value"
+				assert.Nil(t, db.Close())
+				db, err = Open(opts)
+				assert.Nil(t, err)
+				assert.Equal(t, expected, readAll(t, db))
+			})
+		}
+	}
+}
+
+func TestBulkLoader_Invalid(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bulk-load-invalid")
+	defer os.RemoveAll(dir)
+	opts := DefaultBulkLoaderOptions
+	opts.DirPath = dir
+	opts.Sorted = true
+	loader, err := NewBulkLoader(opts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrKeyIsEmpty, loader.Add(nil, []byte("value")))
+	assert.Nil(t, loader.Add([]byte("b"), []byte("value-1")))
+	assert.Nil(t, loader.Add([]byte("b"), []byte("value-2")))
+	assert.Equal(t, ErrBulkLoadUnsorted, loader.Add([]byte("a"), []byte("value")))
+	assert.Nil(t, loader.Add([]byte("c"), []byte("value")))
+	assert.Nil(t, loader.Finish())
+	assert.Equal(t, ErrBulkLoadFinished, loader.Finish())
+	assert.Equal(t, ErrBulkLoadFinished, loader.Add([]byte("d"), []byte("value")))
+
+	// 目录中已经有数据
+	_, err = NewBulkLoader(opts)
+	assert.Equal(t, ErrBulkLoadDirNotEmpty, err)
+
+	// 放弃导入时删除已经写入的文件
+	abortDir, _ := os.MkdirTemp("", "bitcask-go-bulk-load-abort")
+	opts.DirPath = abortDir
+	loader, err = NewBulkLoader(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, loader.Add([]byte("a"), []byte("value")))
+	assert.Nil(t, loader.Abort())
+	_, err = os.Stat(abortDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_Ingest(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-ingest")
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			defer destoryDB(db)
+			assert.Nil(t, err)
+
+			// 已有的数据和导入的数据有一部分 key 相同
+			for i := 4000; i < 6000; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+				assert.Nil(t, err)
+			}
+			expected := readAll(t, db)
+
+			bulkDir, _ := os.MkdirTemp("", "bitcask-go-ingest-bulk")
+			defer os.RemoveAll(bulkDir)
+			loaderOpts := DefaultBulkLoaderOptions
+			loaderOpts.DirPath = bulkDir
+			loaderOpts.DataFileSize = 64 * 1024
+			for key, value := range newTestBulkLoad(t, loaderOpts, 5000) {
+				expected[key] = value
+			}
+			assert.Nil(t, db.Ingest(bulkDir))
+			assert.Equal(t, expected, readAll(t, db))
+			assert.True(t, dbStat(t, db).ReclaimableSize > 0)
+
+			// 导入之后的写入覆盖导入的数据，重启之后的数据和重启之前一致
+			err = db.Put(utils.GetTestKey(1), []byte("new-value"))
+			assert.Nil(t, err)
+			expected[string(utils.GetTestKey(1))] = "new-value"
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, readAll(t, db))
+
+			// 导入的目录没有被修改，可以再次导入
+			assert.Nil(t, db.Ingest(bulkDir))
+			expected = readAll(t, db)
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, readAll(t, db))
+		})
+	}
+}
+
+func TestDB_Ingest_InvalidDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ingest-invalid")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	bulkDir, _ := os.MkdirTemp("", "bitcask-go-ingest-invalid-bulk")
+	defer os.RemoveAll(bulkDir)
+	assert.Equal(t, ErrInvalidBulkLoadDir, db.Ingest(bulkDir))
+
+	// 没有完成的批量导入
+	loaderOpts := DefaultBulkLoaderOptions
+	loaderOpts.DirPath = bulkDir
+	loader, err := NewBulkLoader(loaderOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, loader.Add([]byte("a"), []byte("value")))
+	assert.Equal(t, ErrInvalidBulkLoadDir, db.Ingest(bulkDir))
+	assert.Nil(t, loader.Finish())
+
+	// 缺少数据文件
+	assert.Nil(t, os.Remove(data.GetDataFileName(bulkDir, 0)))
+	assert.Equal(t, ErrInvalidBulkLoadDir, db.Ingest(bulkDir))
+	assert.Equal(t, 0, len(listKeys(t, db)))
+}
+
+// 在导入过程中的每一个文件操作上掉电，重启之后导入的数据要么全部可见，要么全部不可见
+func TestDB_Ingest_Crash(t *testing.T) {
+	t.Run("btree", func(t *testing.T) {
+		testIngestCrash(t, faultfs.New(memfs.New()), "/", BTree)
+	})
+	// B+ 树索引的 bolt 文件不经过故障注入，它的每次提交都会持久化
+	t.Run("bptree", func(t *testing.T) {
+		testIngestCrash(t, faultfs.New(fio.OSFileSystem), t.TempDir(), BPlusTree)
+	})
+}
+
+func testIngestCrash(t *testing.T, fs *faultfs.FS, root string, indexType IndexerType) {
+	loaderOpts := DefaultBulkLoaderOptions
+	loaderOpts.DirPath = path.Join(root, "bitcask-go-ingest-crash-bulk")
+	loaderOpts.DataFileSize = 8 * 1024
+	loaderOpts.FS = fs
+	ingested := newTestBulkLoad(t, loaderOpts, 500)
+
+	for op := int64(1); ; op++ {
+		opts := DefaultOptions
+		opts.DirPath = path.Join(root, fmt.Sprintf("bitcask-go-ingest-crash-%d", op))
+		opts.DataFileSize = 8 * 1024
+		opts.IndexType = indexType
+		opts.FS = fs
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		for i := 400; i < 600; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("old-value")))
+		}
+		assert.Nil(t, wb.Commit())
+		before := readAll(t, db)
+		after := readAll(t, db)
+		for key, value := range ingested {
+			after[key] = value
+		}
+
+		fs.Inject(fs.Ops()+op, faultfs.PowerLoss)
+		err = db.Ingest(loaderOpts.DirPath)
+		if err == nil {
+			// 导入过程中所有的操作都已经测试过
+			assert.Nil(t, db.Close())
+			break
+		}
+		assert.Equal(t, faultfs.ErrPowerLoss, err)
+
+		// 进程退出时关闭 bolt 文件，释放它的文件锁
+		_ = db.index.Close()
+		assert.Nil(t, fs.Restart())
+		// 完整地写入了安装标识之后，重启时必须完成导入
+		installing := false
+		if _, err := fs.Stat(path.Join(opts.DirPath, data.IngestInstallingFileName)); err == nil {
+			installingFile, err := data.OpenIngestInstallingFile(fs, opts.DirPath)
+			assert.Nil(t, err)
+			_, err = readFileIdRecord(installingFile)
+			installing = err == nil
+			assert.Nil(t, installingFile.Close())
+		}
+		db, err = Open(opts)
+		if !assert.Nil(t, err, "op %d", op) {
+			return
+		}
+		values := readAll(t, db)
+		if len(values) == len(before) && !installing {
+			assert.Equal(t, before, values, "op %d", op)
+		} else {
+			assert.Equal(t, after, values, "op %d", op)
+		}
+		entries, err := fs.ReadDir(opts.DirPath)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			assert.NotEqual(t, data.IngestInstallingFileName, entry.Name())
+			assert.NotEqual(t, data.IngestHintFileName, entry.Name())
+			assert.NotEqual(t, data.IngestFileNameSuffix, path.Ext(entry.Name()))
+		}
+		assert.Nil(t, db.Close())
+	}
+}
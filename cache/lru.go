@@ -0,0 +1,126 @@
+package cache
+
+// LRU value 缓存
+// 以数据在磁盘上的位置作为 key 缓存读取到的 value，数据是追加写入的，同一个位置上的数据不会改变，
+// 所以 Put/Delete 之后索引指向新的位置，旧位置上的缓存不会再被命中，最终被淘汰，不需要主动失效。
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// entryOverhead 每个缓存项除 value 之外大约占用的内存，计入缓存的容量
+const entryOverhead = 64
+
+// Key 缓存的 key：数据所在的文件 id 和偏移量
+type Key struct {
+	Fid    uint32
+	Offset int64
+}
+
+type entry struct {
+	key   Key
+	value []byte
+}
+
+// LRU 按照字节数限制容量的 LRU 缓存，并发安全
+type LRU struct {
+	lock     *sync.Mutex
+	capacity int64 // 缓存容量，字节为单位
+	size     int64 // 当前已经使用的容量
+	ll       *list.List
+	items    map[Key]*list.Element
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+// NewLRU 创建容量为 capacity 字节的 LRU 缓存
+func NewLRU(capacity int64) *LRU {
+	return &LRU{
+		lock:     new(sync.Mutex),
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[Key]*list.Element),
+	}
+}
+
+// Get 获取缓存的 value，返回的数据不能修改
+func (c *LRU) Get(key Key) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*entry).value, true
+}
+
+// Put 缓存 value 的副本，超过容量时淘汰最久没有使用的数据
+func (c *LRU) Put(key Key, value []byte) {
+	cost := int64(len(value)) + entryOverhead
+	if cost > c.capacity {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	for c.size+cost > c.capacity {
+		c.removeOldest()
+	}
+	elem := c.ll.PushFront(&entry{key: key, value: append([]byte{}, value...)})
+	c.items[key] = elem
+	c.size += cost
+}
+
+// Remove 删除缓存的数据
+func (c *LRU) Remove(key Key) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *LRU) removeOldest() {
+	if elem := c.ll.Back(); elem != nil {
+		c.removeElement(elem)
+	}
+}
+
+func (c *LRU) removeElement(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.value)) + entryOverhead
+}
+
+// Len 缓存的数据条数
+func (c *LRU) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ll.Len()
+}
+
+// Size 缓存已经使用的容量
+func (c *LRU) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// Hits 缓存命中的次数
+func (c *LRU) Hits() uint64 {
+	return c.hits.Load()
+}
+
+// Misses 缓存没有命中的次数
+func (c *LRU) Misses() uint64 {
+	return c.misses.Load()
+}
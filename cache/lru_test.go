@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLRU_Get_Put(t *testing.T) {
+	c := NewLRU(1024)
+	_, ok := c.Get(Key{Fid: 1, Offset: 0})
+	assert.False(t, ok)
+
+	value := []byte("value-1")
+	c.Put(Key{Fid: 1, Offset: 0}, value)
+	value[0] = 'x' // 缓存的是副本
+	res, ok := c.Get(Key{Fid: 1, Offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-1"), res)
+
+	// 文件 id 或者偏移量不同都是不同的数据
+	_, ok = c.Get(Key{Fid: 2, Offset: 0})
+	assert.False(t, ok)
+	_, ok = c.Get(Key{Fid: 1, Offset: 7})
+	assert.False(t, ok)
+
+	assert.Equal(t, uint64(1), c.Hits())
+	assert.Equal(t, uint64(3), c.Misses())
+
+	c.Remove(Key{Fid: 1, Offset: 0})
+	_, ok = c.Get(Key{Fid: 1, Offset: 0})
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, int64(0), c.Size())
+}
+
+func TestLRU_Evict(t *testing.T) {
+	// 可以容纳 3 个 36 字节的 value
+	c := NewLRU(3 * (36 + entryOverhead))
+	value := make([]byte, 36)
+	for i := int64(0); i < 3; i++ {
+		c.Put(Key{Offset: i}, value)
+	}
+	assert.Equal(t, 3, c.Len())
+
+	// 访问之后 0 变为最近使用的数据，淘汰 1
+	_, ok := c.Get(Key{Offset: 0})
+	assert.True(t, ok)
+	c.Put(Key{Offset: 3}, value)
+	assert.Equal(t, 3, c.Len())
+	_, ok = c.Get(Key{Offset: 1})
+	assert.False(t, ok)
+	for _, offset := range []int64{0, 2, 3} {
+		_, ok = c.Get(Key{Offset: offset})
+		assert.True(t, ok)
+	}
+	assert.Equal(t, int64(3*(36+entryOverhead)), c.Size())
+
+	// 超过容量的 value 不缓存
+	c.Put(Key{Offset: 4}, make([]byte, 1024))
+	_, ok = c.Get(Key{Offset: 4})
+	assert.False(t, ok)
+	assert.Equal(t, 3, c.Len())
+}
@@ -0,0 +1,298 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 索引检查点
+// 检查点文件保存某一时刻完整的内存索引，以及这个索引覆盖到的数据文件位置 (fid, offset)。
+// 启动时先加载检查点，再从这个位置开始回放之后的数据文件，不需要从头回放所有的数据。
+//
+// 文件格式：每个索引项是一条普通的 LogRecord，key 为用户的 key，value 为编码后的位置索引；
+// 最后是一条 LogRecordTxnFinished 类型的结尾记录，保存覆盖的位置、事务序列号、无效数据量和索引项的数量。
+// 没有结尾记录或者数量不一致的检查点视为不完整，启动时会被忽略。
+
+const (
+	checkpointFooterKey = "checkpoint.footer"
+	checkpointTmpSuffix = ".tmp"
+)
+
+var errInvalidCheckpoint = errors.New("invalid index checkpoint")
+
+// checkpointFooter 检查点的结尾记录
+type checkpointFooter struct {
+	fid         uint32 // 检查点覆盖到的数据文件
+	offset      int64  // 检查点覆盖到的文件位置，之前的数据都已经包含在检查点中
+	seqNo       uint64 // 当时的事务序列号
+	reclaimSize int64  // 当时的无效数据量
+	count       int64  // 索引项的数量
+}
+
+func (f *checkpointFooter) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*4)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(f.fid))
+	index += binary.PutVarint(buf[index:], f.offset)
+	index += binary.PutUvarint(buf[index:], f.seqNo)
+	index += binary.PutVarint(buf[index:], f.reclaimSize)
+	index += binary.PutVarint(buf[index:], f.count)
+	return buf[:index]
+}
+
+func decodeCheckpointFooter(buf []byte) (*checkpointFooter, error) {
+	var index = 0
+	varint := func() int64 {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			index = -1
+			return 0
+		}
+		index += n
+		return v
+	}
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			index = -1
+			return 0
+		}
+		index += n
+		return v
+	}
+
+	f := &checkpointFooter{}
+	if f.fid = uint32(uvarint()); index < 0 {
+		return nil, errInvalidCheckpoint
+	}
+	if f.offset = varint(); index < 0 {
+		return nil, errInvalidCheckpoint
+	}
+	if f.seqNo = uvarint(); index < 0 {
+		return nil, errInvalidCheckpoint
+	}
+	if f.reclaimSize = varint(); index < 0 {
+		return nil, errInvalidCheckpoint
+	}
+	if f.count = varint(); index < 0 {
+		return nil, errInvalidCheckpoint
+	}
+	return f, nil
+}
+
+// Checkpoint 将当前的内存索引写入检查点文件，下次启动时只需要回放检查点之后的数据
+// 检查点先写入临时文件，持久化之后再重命名，写入过程中崩溃不会破坏已有的检查点
+func (db *DB) Checkpoint() error {
+	if db.options.IndexType == BPlusTree {
+		return nil // B+ 树索引本身就是持久化的
+	}
+
+	// 分片索引在锁外更新，要等正在更新的索引完成，快照才包含活跃文件当前位置之前的所有数据
+	db.indexUpdateLock.Lock()
+	db.lock.Lock()
+	snapshot, err := db.checkpointSnapshot()
+	db.lock.Unlock()
+	db.indexUpdateLock.Unlock()
+	if err != nil || snapshot == nil {
+		return err
+	}
+	if err := db.writeCheckpoint(snapshot); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	db.lastCheckpoint = data.LogRecordPos{Fid: snapshot.footer.fid, Offset: snapshot.footer.offset}
+	db.lock.Unlock()
+	return nil
+}
+
+// indexSnapshot 写入检查点时的索引快照
+type indexSnapshot struct {
+	footer *checkpointFooter
+	iter   index.Iterator // 索引迭代器在创建时获取快照，之后的写入不影响它
+}
+
+// checkpointSnapshot 获取索引的一致性快照，需要持有 indexUpdateLock 的写锁和数据库的锁
+// 此时没有正在进行的写入和索引更新，所以快照正好包含活跃文件当前位置之前的所有数据。
+// 锁内只持久化活跃文件、记录位置并创建迭代器，逐个复制 key 在释放锁之后由 writeCheckpoint 完成。
+// 返回 nil 表示自上次检查点之后没有新的数据，不需要再写入
+func (db *DB) checkpointSnapshot() (*indexSnapshot, error) {
+	if db.activeFile == nil {
+		return nil, nil
+	}
+	if db.lastCheckpoint.Fid == db.activeFile.FileId && db.lastCheckpoint.Offset == db.activeFile.WriteOffset {
+		return nil, nil
+	}
+
+	// 检查点覆盖的数据必须已经持久化，否则崩溃之后检查点会指向丢失的数据
+	if err := db.activeFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	iter, err := db.index.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
+	return &indexSnapshot{
+		footer: &checkpointFooter{
+			fid:         db.activeFile.FileId,
+			offset:      db.activeFile.WriteOffset,
+			seqNo:       db.seqNo,
+			reclaimSize: db.reclaimSize,
+		},
+		iter: iter,
+	}, nil
+}
+
+// writeCheckpoint 将快照写入检查点文件并关闭快照的迭代器，不需要持有数据库的锁
+func (db *DB) writeCheckpoint(snapshot *indexSnapshot) error {
+	defer snapshot.iter.Close()
+	db.checkpointLock.Lock()
+	defer db.checkpointLock.Unlock()
+
+	tmpPath := filepath.Join(db.options.DirPath, data.CheckpointFileName+checkpointTmpSuffix)
+	if err := db.options.FS.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmpFile, err := data.NewDateFile(db.options.FS, tmpPath, 0, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+	if err := tmpFile.SetWriteBuffer(syncedFileWriteBufferSize); err != nil {
+		return err
+	}
+
+	iter := snapshot.iter
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if err := tmpFile.WriteHintRecord(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+		snapshot.footer.count++
+	}
+	footer := &data.LogRecord{
+		Key:   []byte(checkpointFooterKey),
+		Value: snapshot.footer.encode(),
+		Type:  data.LogRecordTxnFinished,
+	}
+	encFooter, _ := data.EncodeLogRecord(footer)
+	if err := tmpFile.Write(encFooter); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return db.options.FS.Rename(tmpPath, filepath.Join(db.options.DirPath, data.CheckpointFileName))
+}
+
+// loadIndexFromCheckpoint 从检查点文件中加载索引，返回检查点覆盖到的位置
+// 检查点不存在、不完整或者和数据文件对不上时返回 nil，需要从头加载索引
+func (db *DB) loadIndexFromCheckpoint() (*checkpointFooter, error) {
+	checkpointPath := filepath.Join(db.options.DirPath, data.CheckpointFileName)
+	if _, err := db.options.FS.Stat(checkpointPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	checkpointFile, err := data.NewDateFile(db.options.FS, checkpointPath, 0, fio.StandardIO)
+	if err != nil {
+		return nil, err
+	}
+	defer checkpointFile.Close()
+
+	var keys [][]byte
+	var positions []*data.LogRecordPos
+	var footer *checkpointFooter
+	var offset int64 = 0
+	for footer == nil {
+		record, size, err := checkpointFile.ReadLogRecord(offset)
+		if err == io.EOF || err == data.ErrInvalidCRC {
+			return nil, nil // 检查点不完整
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += size
+
+		if record.Type == data.LogRecordTxnFinished {
+			if footer, err = decodeCheckpointFooter(record.Value); err != nil {
+				return nil, nil
+			}
+			continue
+		}
+		keys = append(keys, record.Key)
+		positions = append(positions, data.DecodeLogRecordPos(record.Value))
+	}
+	if footer.count != int64(len(keys)) || !db.checkpointCovered(footer) {
+		return nil, nil
+	}
+
+	for i, key := range keys {
+		if _, err := db.index.Put(key, positions[i]); err != nil {
+			return nil, err
+		}
+	}
+	db.seqNo = footer.seqNo
+	db.reclaimSize = footer.reclaimSize
+	db.lastCheckpoint = data.LogRecordPos{Fid: footer.fid, Offset: footer.offset}
+	return footer, nil
+}
+
+// checkpointCovered 检查点覆盖的数据是否都还在数据文件中
+func (db *DB) checkpointCovered(footer *checkpointFooter) bool {
+	dataFile := db.getDataFile(footer.fid)
+	if dataFile == nil {
+		return false
+	}
+	size, err := dataFile.IOManager.Size()
+	return err == nil && footer.offset <= size
+}
+
+// removeCheckpoint 删除检查点，merge 文件替换旧的数据文件之后，检查点中的位置不再有效
+func (db *DB) removeCheckpoint() error {
+	err := db.options.FS.Remove(filepath.Join(db.options.DirPath, data.CheckpointFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// startCheckpointLoop 在后台定期写入检查点
+func (db *DB) startCheckpointLoop() {
+	db.checkpointStop = make(chan struct{})
+	db.checkpointDone = make(chan struct{})
+	go func() {
+		defer close(db.checkpointDone)
+		ticker := time.NewTicker(db.options.IndexCheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// 写入失败时等待下一次重试，关闭数据库时还会再写一次
+				_ = db.Checkpoint()
+			case <-db.checkpointStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCheckpointLoop 停止后台写入检查点，等待正在进行的写入完成
+func (db *DB) stopCheckpointLoop() {
+	if db.checkpointStop == nil {
+		return
+	}
+	close(db.checkpointStop)
+	<-db.checkpointDone
+	db.checkpointStop = nil
+}
@@ -0,0 +1,249 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	checkpoint := db.lastCheckpoint
+	assert.Equal(t, db.activeFile.FileId, checkpoint.Fid)
+
+	// 没有新的数据时不需要再写入检查点
+	info, err := os.Stat(filepath.Join(dir, data.CheckpointFileName))
+	assert.Nil(t, err)
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	info2, err := os.Stat(filepath.Join(dir, data.CheckpointFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, info.ModTime(), info2.ModTime())
+
+	// 检查点之后的数据，包括事务，需要从数据文件中回放
+	for i := 2000; i < 2500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3000), utils.GetRandomValue(64)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(600)))
+	assert.Nil(t, wb.Commit())
+	stat := dbStat(t, db)
+	seqNo := db.seqNo
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, checkpoint, db2.lastCheckpoint)
+	assert.Equal(t, seqNo, db2.seqNo)
+	assert.Equal(t, stat.KeyNum, dbStat(t, db2).KeyNum)
+	for i := 0; i < 2500; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		if i < 500 || i == 600 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, 64, len(val))
+		}
+	}
+	_, err = db2.Get(utils.GetTestKey(3000))
+	assert.Nil(t, err)
+
+	// 新的事务序列号不能和检查点之前的重复
+	wb = db2.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3001), utils.GetRandomValue(64)))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, seqNo+1, db2.seqNo)
+	reclaimSize := dbStat(t, db2).ReclaimableSize
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 和回放所有数据得到的结果一致
+	err = os.Remove(filepath.Join(dir, data.CheckpointFileName))
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	defer destoryDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, reclaimSize, dbStat(t, db3).ReclaimableSize)
+	assert.Equal(t, seqNo+1, db3.seqNo)
+}
+
+// 检查点只在锁内获取快照，释放锁之后的写入不会进入检查点，重启时从数据文件中回放
+func TestDB_Checkpoint_WritesAfterSnapshot(t *testing.T) {
+	for _, shardNum := range []int{0, 8} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-snapshot")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.IndexShardNum = shardNum
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("old"))
+			assert.Nil(t, err)
+		}
+
+		db.indexUpdateLock.Lock()
+		db.lock.Lock()
+		snapshot, err := db.checkpointSnapshot()
+		db.lock.Unlock()
+		db.indexUpdateLock.Unlock()
+		assert.Nil(t, err)
+		for i := 0; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+		}
+		for i := 300; i < 600; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(1000), []byte("new")))
+		assert.Nil(t, db.writeCheckpoint(snapshot))
+		assert.Equal(t, int64(1000), snapshot.footer.count)
+		expected := readAll(t, db)
+		assert.Equal(t, 701, len(expected))
+		assert.Nil(t, db.Close())
+
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, data.LogRecordPos{Fid: snapshot.footer.fid, Offset: snapshot.footer.offset}, db2.lastCheckpoint)
+		assert.Equal(t, expected, readAll(t, db2))
+		destoryDB(db2)
+	}
+}
+
+func TestDB_Checkpoint_OnClose(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-close")
+	opts.DirPath = dir
+	opts.IndexCheckpointInterval = time.Hour
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 关闭时写入的检查点覆盖了所有的数据，不需要回放
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, db2.activeFile.FileId, db2.lastCheckpoint.Fid)
+	assert.Equal(t, db2.activeFile.WriteOffset, db2.lastCheckpoint.Offset)
+	assert.Equal(t, 1000, len(listKeys(t, db2)))
+}
+
+func TestDB_Checkpoint_Background(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-background")
+	opts.DirPath = dir
+	opts.IndexCheckpointInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, data.CheckpointFileName))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDB_Checkpoint_Invalid(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-invalid")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 截断之后的检查点没有结尾记录，需要回放所有的数据
+	checkpointPath := filepath.Join(dir, data.CheckpointFileName)
+	info, err := os.Stat(checkpointPath)
+	assert.Nil(t, err)
+	err = os.Truncate(checkpointPath, info.Size()-10)
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, data.LogRecordPos{}, db2.lastCheckpoint)
+	assert.Equal(t, 1000, len(listKeys(t, db2)))
+}
+
+func TestDB_Checkpoint_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// merge 文件替换了旧的数据文件，检查点中的位置已经失效
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, data.CheckpointFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 1000, len(listKeys(t, db2)))
+	for i := 1000; i < 2000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
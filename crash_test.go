@@ -0,0 +1,240 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio/faultfs"
+	"bitcask-go/fio/memfs"
+	"bitcask-go/utils"
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// crashModel 记录随机负载执行之后数据库应该处于的状态
+// 失败的操作可能已经持久化，也可能没有，重启之后两种结果都是允许的
+type crashModel struct {
+	values    map[string][]byte   // 写入成功的数据，nil 表示已经删除
+	uncertain map[string][][]byte // 上次写入成功之后，失败的操作可能写入的数据
+	batches   []map[string]*batchChange
+}
+
+// batchChange 提交失败的事务对一个 key 的修改，重启之后事务中的修改要么全部生效，要么全部不生效
+type batchChange struct {
+	old, new []byte
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{
+		values:    make(map[string][]byte),
+		uncertain: make(map[string][][]byte),
+	}
+}
+
+// 写入成功，之前失败的操作都被覆盖
+func (m *crashModel) ack(key string, value []byte) {
+	m.values[key] = value
+	delete(m.uncertain, key)
+	m.forgetBatches(key)
+}
+
+// 写入失败
+func (m *crashModel) fail(key string, value []byte) {
+	m.uncertain[key] = append(m.uncertain[key], value)
+	m.forgetBatches(key)
+}
+
+// 之后对 key 的修改会掩盖事务的结果，不再检查这个 key 的原子性
+func (m *crashModel) forgetBatches(key string) {
+	for _, changes := range m.batches {
+		delete(changes, key)
+	}
+}
+
+func (m *crashModel) failBatch(changes map[string][]byte) {
+	batch := make(map[string]*batchChange)
+	for key, value := range changes {
+		m.fail(key, value)
+		batch[key] = &batchChange{old: m.values[key], new: value}
+	}
+	m.batches = append(m.batches, batch)
+}
+
+// verify 检查重启之后的数据库，并以数据库中的数据作为新的状态
+func (m *crashModel) verify(t *testing.T, db *DB, round string) {
+	actual := make(map[string][]byte)
+	for _, key := range listKeys(t, db) {
+		_, ok := m.values[string(key)]
+		_, maybe := m.uncertain[string(key)]
+		assert.True(t, ok || maybe, "%s: unexpected key %s", round, key)
+	}
+	keys := make(map[string]struct{})
+	for key := range m.values {
+		keys[key] = struct{}{}
+	}
+	for key := range m.uncertain {
+		keys[key] = struct{}{}
+	}
+
+	for key := range keys {
+		value, err := db.Get([]byte(key))
+		if err == ErrKeyNotFound {
+			value, err = nil, nil
+		}
+		assert.Nil(t, err)
+		actual[key] = value
+
+		allowed := append([][]byte{m.values[key]}, m.uncertain[key]...)
+		found := false
+		for _, v := range allowed {
+			if bytes.Equal(v, value) {
+				found = true
+				break
+			}
+		}
+		assert.True(t, found, "%s: key %s has unexpected value", round, key)
+	}
+
+	for _, changes := range m.batches {
+		var applied, notApplied int
+		for key, change := range changes {
+			if bytes.Equal(change.old, change.new) {
+				continue
+			}
+			if bytes.Equal(actual[key], change.new) {
+				applied++
+			} else {
+				notApplied++
+			}
+		}
+		assert.False(t, applied > 0 && notApplied > 0, "%s: write batch partially applied", round)
+	}
+
+	m.values = actual
+	m.uncertain = make(map[string][][]byte)
+	m.batches = nil
+}
+
+// runCrashWorkload 执行随机的 Put/Delete/WriteBatch/Merge 负载，直到掉电或者执行完所有的操作
+func runCrashWorkload(db *DB, fs *faultfs.FS, rnd *rand.Rand, model *crashModel, opsNum int) {
+	randomKey := func() string {
+		return string(utils.GetTestKey(rnd.Intn(64)))
+	}
+	randomValue := func() []byte {
+		return []byte(fmt.Sprintf("value-%d-%s", rnd.Int(), bytes.Repeat([]byte("v"), rnd.Intn(256))))
+	}
+
+	for i := 0; i < opsNum && !fs.Down(); i++ {
+		switch n := rnd.Intn(100); {
+		case n < 50:
+			key, value := randomKey(), randomValue()
+			if err := db.Put([]byte(key), value); err != nil {
+				model.fail(key, value)
+			} else {
+				model.ack(key, value)
+			}
+		case n < 70:
+			key := randomKey()
+			if err := db.Delete([]byte(key)); err != nil {
+				model.fail(key, nil)
+			} else {
+				model.ack(key, nil)
+			}
+		case n < 90:
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			changes := make(map[string][]byte)
+			for j := rnd.Intn(8) + 1; j > 0; j-- {
+				key := randomKey()
+				if rnd.Intn(4) == 0 {
+					_ = wb.Delete([]byte(key))
+					changes[key] = nil
+				} else {
+					value := randomValue()
+					_ = wb.Put([]byte(key), value)
+					changes[key] = value
+				}
+			}
+			if err := wb.Commit(); err != nil {
+				model.failBatch(changes)
+			} else {
+				for key, value := range changes {
+					model.ack(key, value)
+				}
+			}
+		case n < 95:
+			// 没有提交的事务，重启之后不能生效
+			_ = writeUncommittedBatch(db, [][]byte{[]byte(randomKey())}, [][]byte{[]byte(randomKey())})
+		default:
+			_ = db.Merge()
+		}
+	}
+}
+
+// 在随机的位置注入错误、部分写入和掉电，崩溃重启之后，所有写入成功的数据都要存在，没有提交成功的事务不能部分生效
+func TestDB_Crash_Consistency(t *testing.T) {
+	faults := []faultfs.Fault{faultfs.Error, faultfs.ShortWrite, faultfs.PowerLoss}
+	for seed := int64(1); seed <= 16; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(seed))
+			fs := faultfs.New(memfs.New())
+			opts := DefaultOptions
+			opts.DirPath = "/bitcask-go-crash"
+			opts.DataFileSize = 8 * 1024
+			opts.SyncWrites = true
+			opts.DataFileMergeRatio = 0
+			opts.FS = fs
+
+			model := newCrashModel()
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			for round := 0; round < 50; round++ {
+				fs.Inject(fs.Ops()+rnd.Int63n(400)+1, faults[rnd.Intn(len(faults))])
+				runCrashWorkload(db, fs, rnd, model, 100)
+
+				// 崩溃并重启
+				err = fs.Restart()
+				assert.Nil(t, err)
+				db, err = Open(opts)
+				if !assert.Nil(t, err, "round %d", round) {
+					return
+				}
+				model.verify(t, db, fmt.Sprintf("round %d", round))
+			}
+			assert.Nil(t, db.Close())
+		})
+	}
+}
+
+// 持久化失败的写入要回滚，否则之后的删除会因为内存索引中没有这个 key 而被跳过，重启之后数据又重新出现
+func TestDB_Crash_SyncFailure(t *testing.T) {
+	fs := faultfs.New(memfs.New())
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-crash-sync"
+	opts.SyncWrites = true
+	opts.FS = fs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetRandomValue(10))
+	assert.Nil(t, err)
+
+	// Put 先写入数据，再持久化
+	fs.Inject(fs.Ops()+2, faultfs.Error)
+	err = db.Put(utils.GetTestKey(2), utils.GetRandomValue(10))
+	assert.Equal(t, faultfs.ErrInjected, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	// 事务提交时持久化失败
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), utils.GetRandomValue(10)))
+	assert.Nil(t, wb.Put(utils.GetTestKey(4), utils.GetRandomValue(10)))
+	fs.Inject(fs.Ops()+6, faultfs.Error)
+	err = wb.Commit()
+	assert.Equal(t, faultfs.ErrInjected, err)
+
+	assert.Nil(t, fs.Restart())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{utils.GetTestKey(1)}, listKeys(t, db2))
+	assert.Nil(t, db2.Close())
+}
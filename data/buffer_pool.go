@@ -0,0 +1,31 @@
+package data
+
+import "sync"
+
+// 超过这个大小的缓冲区用完之后不放回池中，避免池中长期持有大块内存
+const maxPooledBufferSize = 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// GetBuffer 从缓冲池中获取一个长度为 size 的字节数组，用完之后需要调用 PutBuffer 放回
+func GetBuffer(size int) *[]byte {
+	bufPtr := bufferPool.Get().(*[]byte)
+	if cap(*bufPtr) < size {
+		*bufPtr = make([]byte, size)
+	}
+	*bufPtr = (*bufPtr)[:size]
+	return bufPtr
+}
+
+// PutBuffer 将字节数组放回缓冲池，之后不能再使用其中的数据
+func PutBuffer(bufPtr *[]byte) {
+	if cap(*bufPtr) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(bufPtr)
+}
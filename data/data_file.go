@@ -18,18 +18,32 @@ const (
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	// MergeInstallingFileName 标识旧的数据文件已经删除，merge 文件正在移动到数据目录中
+	MergeInstallingFileName = "merge-installing"
+	// MergeKeptFilesFileName 记录 merge 时没有参与合并、安装时需要保留的旧数据文件
+	MergeKeptFilesFileName = "merge-kept-files"
+	// CheckpointFileName 索引检查点文件
+	CheckpointFileName = "index-checkpoint"
+	// IngestFileNameSuffix 导入过程中还没有安装的数据文件的后缀
+	IngestFileNameSuffix = ".ingest"
+	// IngestInstallingFileName 标识导入的数据文件正在安装，其中记录了安装之后第一个文件的 id
+	IngestInstallingFileName = "ingest-installing"
+	// IngestHintFileName 导入时一起链接过来的 hint 文件，B+ 树索引启动时不回放数据文件，需要用它完成没有装完的导入
+	IngestHintFileName = "ingest-hint"
 )
 
 // DataFile 数据文件
 type DataFile struct {
 	FileId      uint32        // 文件id
-	WriteOffset int64         // 文件写到了哪个位置
+	WriteOffset int64         // 文件写到了哪个位置，包含写缓冲区中的数据
 	IOManager   fio.IOManager // IO读写管理器
+	writeBuf    []byte        // 写缓冲区，保存还没有写入 IOManager 的数据
+	bufSize     int           // 写缓冲区的容量，为 0 时直接写入 IOManager
 }
 
-func NewDateFile(filePath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func NewDateFile(fs fio.FileSystem, filePath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	// 初始化 IOManager 管理器接口
-	ioManager, err := fio.NewIOManager(filePath, ioType)
+	ioManager, err := fio.NewIOManager(fs, filePath, ioType)
 	if err != nil {
 		return nil, err
 	}
@@ -48,45 +62,143 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 }
 
 // OpenDateFile 打开数据文件
-func OpenDateFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func OpenDateFile(fs fio.FileSystem, dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	filePath := GetDataFileName(dirPath, fileId)
-	return NewDateFile(filePath, fileId, ioType)
+	return NewDateFile(fs, filePath, fileId, ioType)
 }
 
 // 打开 Hint 索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	filePath := filepath.Join(dirPath, HintFileName)
-	return NewDateFile(filePath, 0, fio.StandardIO)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
 }
 
 // OpenMergeFinishFile 打开 标识merge完成的文件
-func OpenMergeFinishFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	filePath := filepath.Join(dirPath, MergeFinishedFileName)
-	return NewDateFile(filePath, 0, fio.StandardIO)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
+}
+
+// OpenMergeKeptFilesFile 打开记录 merge 时保留的旧数据文件的文件
+func OpenMergeKeptFilesFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	filePath := filepath.Join(dirPath, MergeKeptFilesFileName)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
+}
+
+// OpenIngestInstallingFile 打开标识导入文件正在安装的文件
+func OpenIngestInstallingFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	filePath := filepath.Join(dirPath, IngestInstallingFileName)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
+}
+
+// OpenIngestHintFile 打开导入时链接过来的 hint 文件
+func OpenIngestHintFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	filePath := filepath.Join(dirPath, IngestHintFileName)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
 }
 
 // OpenSeqNoFile 打开存储 seqNo 事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	filePath := filepath.Join(dirPath, SeqNoFileName)
-	return NewDateFile(filePath, 0, fio.StandardIO)
+	return NewDateFile(fs, filePath, 0, fio.StandardIO)
 }
 
 // Sync 持久化数据文件
 func (df *DataFile) Sync() error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
 	return df.IOManager.Sync()
 }
 func (df *DataFile) Close() error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
 	return df.IOManager.Close()
 }
 
 // Write 写数据
+// 开启写缓冲时数据先追加到缓冲区，缓冲区写满之后再整体写入 IOManager
 func (df *DataFile) Write(buf []byte) error {
+	if df.bufSize > 0 {
+		if len(df.writeBuf)+len(buf) > df.bufSize {
+			if err := df.Flush(); err != nil {
+				return err
+			}
+		}
+		if len(buf) < df.bufSize {
+			df.writeBuf = append(df.writeBuf, buf...)
+			df.WriteOffset += int64(len(buf))
+			return nil
+		}
+	}
+	if err := df.write(buf); err != nil {
+		return err
+	}
+	df.WriteOffset += int64(len(buf))
+	return nil
+}
+
+// write 直接写入 IOManager
+// 写入失败时截断已经写入的部分数据，避免之后追加的数据和写入位置错开
+func (df *DataFile) write(buf []byte) error {
+	flushedSize := df.WriteOffset - int64(len(df.writeBuf))
 	n, err := df.IOManager.Write(buf)
 	if err != nil {
+		if n > 0 {
+			if truncErr := df.IOManager.Truncate(flushedSize); truncErr != nil {
+				return truncErr
+			}
+		}
 		return err
 	}
+	return nil
+}
+
+// Flush 将写缓冲区中的数据写入 IOManager，写入失败时缓冲区中的数据保持不变
+func (df *DataFile) Flush() error {
+	if len(df.writeBuf) == 0 {
+		return nil
+	}
+	if err := df.write(df.writeBuf); err != nil {
+		return err
+	}
+	df.writeBuf = df.writeBuf[:0]
+	return nil
+}
+
+// SetWriteBuffer 设置写缓冲区的大小，为 0 时关闭写缓冲
+func (df *DataFile) SetWriteBuffer(size int) error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
+	df.bufSize = size
+	if size > 0 {
+		df.writeBuf = make([]byte, 0, size)
+	} else {
+		df.writeBuf = nil
+	}
+	return nil
+}
 
-	df.WriteOffset += int64(n)
+// BufferedSize 获取写缓冲区中还没有写入 IOManager 的数据大小
+func (df *DataFile) BufferedSize() int64 {
+	return int64(len(df.writeBuf))
+}
+
+// Truncate 将数据文件截断到 size 大小，之后从这个位置继续写入
+func (df *DataFile) Truncate(size int64) error {
+	flushedSize := df.WriteOffset - int64(len(df.writeBuf))
+	if size > flushedSize && size <= df.WriteOffset {
+		// 只需要丢弃缓冲区中的数据
+		df.writeBuf = df.writeBuf[:size-flushedSize]
+	} else {
+		if err := df.IOManager.Truncate(size); err != nil {
+			return err
+		}
+		df.writeBuf = df.writeBuf[:0]
+	}
+	df.WriteOffset = size
 	return nil
 }
 
@@ -103,11 +215,12 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 // ReadLogRecord 根据 offset 从数据文件中读取 LogRecord
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 
-	// 获取文件大小
+	// 获取文件大小，写缓冲区中的数据也可以读取
 	fileSize, err := df.IOManager.Size()
 	if err != nil {
 		return nil, 0, err
 	}
+	fileSize += int64(len(df.writeBuf))
 
 	// 如果读取的最大 header 已经超过了文件的长度，则只需读取到文件的末尾即可
 	// 因为 header 是变长的，而每次读取默认读取 最大长度的 header
@@ -116,9 +229,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		headerBufSize = fileSize - offset
 	}
 
-	// 读取 header 数据
-	headerBuf, err := df.readNBytes(headerBufSize, offset)
-	if err != nil {
+	// 读取 header 数据，header 只在解码和计算 crc 时使用，使用缓冲池中的内存
+	headerBufPtr := GetBuffer(int(headerBufSize))
+	defer PutBuffer(headerBufPtr)
+	headerBuf := *headerBufPtr
+	if err := df.readAt(headerBuf, offset); err != nil {
 		return nil, 0, err
 	}
 
@@ -159,18 +274,93 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	return record, recordSize, nil
 }
 
+// ScanEnd 从头读取数据文件，找到最后一条完整记录的结束位置
+// 文件末尾预分配的空间是全零的数据，读到全零的 header 时即认为到了数据的末尾
+func (df *DataFile) ScanEnd() (int64, error) {
+	var offset int64
+	for {
+		_, size, err := df.ReadLogRecord(offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+}
+
+// ReadValueInto 已知记录的大小时，一次读取 offset 处的整条记录，在内存中解码并校验 crc
+// value 追加到 dst[:0] 中返回，dst 的容量足够时不会分配内存
+func (df *DataFile) ReadValueInto(offset int64, size uint32, dst []byte) ([]byte, LogRecordType, error) {
+	bufPtr := GetBuffer(int(size))
+	defer PutBuffer(bufPtr)
+	buf := *bufPtr
+	if err := df.readAt(buf, offset); err != nil {
+		return nil, 0, err
+	}
+
+	header, headerSize := DecodeLogRecordHeader(buf)
+	if header == nil {
+		return nil, 0, io.EOF
+	}
+	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return nil, 0, io.EOF
+	}
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	if headerSize+keySize+valueSize != int64(size) {
+		return nil, 0, ErrInvalidCRC
+	}
+	if header.crc != crc32.ChecksumIEEE(buf[crc32.Size:]) {
+		return nil, 0, ErrInvalidCRC
+	}
+
+	if dst == nil {
+		dst = []byte{}
+	}
+	return append(dst[:0], buf[headerSize+keySize:]...), header.recordType, nil
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	b := make([]byte, n)
-	_, err := df.IOManager.Read(b, offset)
+	err := df.readAt(b, offset)
 	return b, err
 }
 
+// readAt 从 offset 处读取 len(b) 字节的数据，写缓冲区中的数据也可以读取
+func (df *DataFile) readAt(b []byte, offset int64) error {
+	n := int64(len(b))
+	flushedSize := df.WriteOffset - int64(len(df.writeBuf))
+	if len(df.writeBuf) == 0 || offset+n <= flushedSize {
+		_, err := df.IOManager.Read(b, offset)
+		return err
+	}
+
+	// 读取的数据有一部分在写缓冲区中
+	var diskN int64
+	if offset < flushedSize {
+		diskN = flushedSize - offset
+		if _, err := df.IOManager.Read(b[:diskN], offset); err != nil {
+			return err
+		}
+	}
+	bufStart := offset + diskN - flushedSize
+	copied := copy(b[diskN:], df.writeBuf[bufStart:])
+	if diskN+int64(copied) < n {
+		return io.EOF
+	}
+	return nil
+}
+
 // SetIOManager 设置 IO 类型
-func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
+func (df *DataFile) SetIOManager(fs fio.FileSystem, dirPath string, ioType fio.FileIOType) error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
 	if err := df.IOManager.Close(); err != nil {
 		return err
 	}
-	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	ioManager, err := fio.NewIOManager(fs, GetDataFileName(dirPath, df.FileId), ioType)
 	if err != nil {
 		return err
 	}
@@ -2,7 +2,10 @@ package data
 
 import (
 	"bitcask-go/fio"
+	"bitcask-go/fio/memfs"
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
@@ -10,21 +13,21 @@ const Database_Path = "../Database/datafileTest"
 
 func TestOpenDateFile(t *testing.T) {
 
-	file, err := OpenDateFile(Database_Path, 2, fio.StandardIO)
+	file, err := OpenDateFile(fio.OSFileSystem, Database_Path, 2, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file)
-	file2, err := OpenDateFile(Database_Path, 22, fio.StandardIO)
+	file2, err := OpenDateFile(fio.OSFileSystem, Database_Path, 22, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file2)
 
 	// 重复打开同一个文件
-	file3, err := OpenDateFile(Database_Path, 22, fio.StandardIO)
+	file3, err := OpenDateFile(fio.OSFileSystem, Database_Path, 22, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file3)
 }
 
 func TestDataFile_Write(t *testing.T) {
-	file, err := OpenDateFile(Database_Path, 9, fio.StandardIO)
+	file, err := OpenDateFile(fio.OSFileSystem, Database_Path, 9, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file)
 
@@ -38,7 +41,7 @@ func TestDataFile_Write(t *testing.T) {
 }
 
 func TestDataFile_Close(t *testing.T) {
-	file, err := OpenDateFile(Database_Path, 113, fio.StandardIO)
+	file, err := OpenDateFile(fio.OSFileSystem, Database_Path, 113, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file)
 
@@ -50,7 +53,7 @@ func TestDataFile_Close(t *testing.T) {
 }
 
 func TestDataFile_Sync(t *testing.T) {
-	file, err := OpenDateFile(Database_Path, 123, fio.StandardIO)
+	file, err := OpenDateFile(fio.OSFileSystem, Database_Path, 123, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, file)
 
@@ -62,7 +65,7 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
-	dateFile, err := OpenDateFile(Database_Path, 1, fio.StandardIO)
+	dateFile, err := OpenDateFile(fio.OSFileSystem, Database_Path, 1, fio.StandardIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dateFile)
 
@@ -113,3 +116,143 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, record3, resRecord3)
 
 }
+
+func TestDataFile_WriteBuffer(t *testing.T) {
+	fs := memfs.New()
+	dataFile, err := OpenDateFile(fs, "/", 1, fio.StandardIO)
+	assert.Nil(t, err)
+	err = dataFile.SetWriteBuffer(64)
+	assert.Nil(t, err)
+
+	record1 := &LogRecord{Key: []byte("key-1"), Value: []byte("value-1"), Type: LogRecordNormal}
+	recordBytes1, recordSize1 := EncodeLogRecord(record1)
+	err = dataFile.Write(recordBytes1)
+	assert.Nil(t, err)
+
+	// 数据还在缓冲区中，没有写入文件，但是可以读取
+	assert.Equal(t, recordSize1, dataFile.BufferedSize())
+	info, err := fs.Stat(GetDataFileName("/", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	resRecord, resSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, recordSize1, resSize)
+	assert.Equal(t, record1, resRecord)
+
+	// 缓冲区写满之后，先写入文件
+	record2 := &LogRecord{Key: []byte("key-2"), Value: bytes.Repeat([]byte("v"), 40), Type: LogRecordNormal}
+	recordBytes2, recordSize2 := EncodeLogRecord(record2)
+	err = dataFile.Write(recordBytes2)
+	assert.Nil(t, err)
+	assert.Equal(t, recordSize2, dataFile.BufferedSize())
+	info, err = fs.Stat(GetDataFileName("/", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, recordSize1, info.Size())
+	resRecord, _, err = dataFile.ReadLogRecord(recordSize1)
+	assert.Nil(t, err)
+	assert.Equal(t, record2, resRecord)
+
+	// 超过缓冲区大小的数据直接写入文件
+	record3 := &LogRecord{Key: []byte("key-3"), Value: bytes.Repeat([]byte("v"), 100), Type: LogRecordNormal}
+	recordBytes3, recordSize3 := EncodeLogRecord(record3)
+	err = dataFile.Write(recordBytes3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dataFile.BufferedSize())
+	assert.Equal(t, recordSize1+recordSize2+recordSize3, dataFile.WriteOffset)
+
+	// 截断缓冲区中的数据
+	err = dataFile.Write(recordBytes1)
+	assert.Nil(t, err)
+	err = dataFile.Truncate(recordSize1 + recordSize2 + recordSize3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dataFile.BufferedSize())
+	_, _, err = dataFile.ReadLogRecord(dataFile.WriteOffset)
+	assert.Equal(t, io.EOF, err)
+
+	err = dataFile.Write(recordBytes1)
+	assert.Nil(t, err)
+	err = dataFile.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dataFile.BufferedSize())
+	info, err = fs.Stat(GetDataFileName("/", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, dataFile.WriteOffset, info.Size())
+	assert.Nil(t, dataFile.Close())
+}
+
+func TestDataFile_ReadValueInto(t *testing.T) {
+	fs := memfs.New()
+	dataFile, err := OpenDateFile(fs, "/", 1, fio.StandardIO)
+	assert.Nil(t, err)
+
+	record1 := &LogRecord{Key: []byte("key-1"), Value: []byte("value-1"), Type: LogRecordNormal}
+	recordBytes1, recordSize1 := EncodeLogRecord(record1)
+	err = dataFile.Write(recordBytes1)
+	assert.Nil(t, err)
+
+	// 写缓冲区中的数据也可以一次读取
+	err = dataFile.SetWriteBuffer(64)
+	assert.Nil(t, err)
+	record2 := &LogRecord{Key: []byte("key-2"), Type: LogRecordDeleted}
+	recordBytes2, recordSize2 := EncodeLogRecord(record2)
+	err = dataFile.Write(recordBytes2)
+	assert.Nil(t, err)
+
+	dst := make([]byte, 0, 16)
+	value, recordType, err := dataFile.ReadValueInto(0, uint32(recordSize1), dst)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordNormal, recordType)
+	assert.Equal(t, record1.Value, value)
+	// dst 的容量足够，直接使用 dst 的内存
+	assert.Equal(t, &dst[:1][0], &value[0])
+
+	value, recordType, err = dataFile.ReadValueInto(recordSize1, uint32(recordSize2), dst)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordDeleted, recordType)
+	assert.Equal(t, 0, len(value))
+
+	// 记录大小和 header 中的不一致
+	_, _, err = dataFile.ReadValueInto(0, uint32(recordSize1-1), dst)
+	assert.Equal(t, ErrInvalidCRC, err)
+	_, _, err = dataFile.ReadValueInto(0, uint32(recordSize1+recordSize2), dst)
+	assert.Equal(t, ErrInvalidCRC, err)
+
+	// 数据损坏
+	err = dataFile.Write(recordBytes1[:recordSize1-1])
+	assert.Nil(t, err)
+	err = dataFile.Write([]byte{'x'})
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadValueInto(recordSize1+recordSize2, uint32(recordSize1), dst)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
+
+func benchmarkDataFile(b *testing.B, valueSize int) (*DataFile, int64) {
+	dataFile, err := OpenDateFile(memfs.New(), "/", 1, fio.StandardIO)
+	assert.Nil(b, err)
+	record := &LogRecord{Key: []byte("bench-key"), Value: bytes.Repeat([]byte("v"), valueSize)}
+	recordBytes, size := EncodeLogRecord(record)
+	assert.Nil(b, dataFile.Write(recordBytes))
+	return dataFile, size
+}
+
+func BenchmarkDataFile_ReadLogRecord(b *testing.B) {
+	dataFile, _ := benchmarkDataFile(b, 1024)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _, err := dataFile.ReadLogRecord(0)
+		assert.Nil(b, err)
+	}
+}
+
+func BenchmarkDataFile_ReadValueInto(b *testing.B) {
+	dataFile, size := benchmarkDataFile(b, 1024)
+	dst := make([]byte, 0, 1024)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		dst, _, err = dataFile.ReadValueInto(0, uint32(size), dst)
+		assert.Nil(b, err)
+	}
+}
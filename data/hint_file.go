@@ -0,0 +1,134 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// hint 文件格式
+// 每个索引项是一条普通的 LogRecord，key 为用户的 key，value 为编码后的位置索引；
+// 最后是一条 LogRecordTxnFinished 类型的结尾记录，保存索引项的数量、索引项指向的数据文件范围，以及之前所有数据的校验值。
+// 没有结尾记录、数量或者校验值不一致的 hint 文件都不能使用。
+
+const hintFooterKey = "hint.footer"
+
+var ErrInvalidHintFile = errors.New("invalid hint file")
+
+// HintFooter hint 文件的结尾记录
+type HintFooter struct {
+	Count    uint64 // 索引项的数量
+	MinFid   uint32 // 索引项指向的最小的数据文件 id
+	MaxFid   uint32 // 索引项指向的最大的数据文件 id，没有索引项时 MinFid 和 MaxFid 都为 0
+	Checksum uint32 // 结尾记录之前所有数据的 crc 校验值
+}
+
+func (f *HintFooter) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64+binary.MaxVarintLen32*3)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], f.Count)
+	index += binary.PutUvarint(buf[index:], uint64(f.MinFid))
+	index += binary.PutUvarint(buf[index:], uint64(f.MaxFid))
+	index += binary.PutUvarint(buf[index:], uint64(f.Checksum))
+	return buf[:index]
+}
+
+func decodeHintFooter(buf []byte) (*HintFooter, error) {
+	var values [4]uint64
+	var index = 0
+	for i := range values {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidHintFile
+		}
+		values[i] = v
+		index += n
+	}
+	return &HintFooter{
+		Count:    values[0],
+		MinFid:   uint32(values[1]),
+		MaxFid:   uint32(values[2]),
+		Checksum: uint32(values[3]),
+	}, nil
+}
+
+// HintWriter 写入 hint 文件，同时统计结尾记录中需要的信息
+type HintWriter struct {
+	file   *DataFile
+	footer HintFooter
+}
+
+func NewHintWriter(file *DataFile) *HintWriter {
+	return &HintWriter{file: file}
+}
+
+// WriteHintRecord 写入一条索引信息
+func (w *HintWriter) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+	record, _ := EncodeLogRecord(&LogRecord{
+		Key:   key,
+		Value: EncodeLogRecordPos(pos),
+	})
+	if err := w.file.Write(record); err != nil {
+		return err
+	}
+
+	if w.footer.Count == 0 || pos.Fid < w.footer.MinFid {
+		w.footer.MinFid = pos.Fid
+	}
+	if w.footer.Count == 0 || pos.Fid > w.footer.MaxFid {
+		w.footer.MaxFid = pos.Fid
+	}
+	w.footer.Count++
+	w.footer.Checksum = crc32.Update(w.footer.Checksum, crc32.IEEETable, record)
+	return nil
+}
+
+// Finish 写入结尾记录并持久化，之后不能再写入索引信息
+func (w *HintWriter) Finish() error {
+	footer, _ := EncodeLogRecord(&LogRecord{
+		Key:   []byte(hintFooterKey),
+		Value: w.footer.encode(),
+		Type:  LogRecordTxnFinished,
+	})
+	if err := w.file.Write(footer); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// ReadHintFile 读取 hint 文件中所有的索引信息，并校验结尾记录
+// 文件不完整或者校验失败时返回 ErrInvalidHintFile
+func ReadHintFile(file *DataFile) ([][]byte, []*LogRecordPos, *HintFooter, error) {
+	var keys [][]byte
+	var positions []*LogRecordPos
+	var checksum uint32
+	var offset int64 = 0
+	for {
+		record, size, err := file.ReadLogRecord(offset)
+		if err == io.EOF || err == ErrInvalidCRC {
+			return nil, nil, nil, ErrInvalidHintFile
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		offset += size
+
+		if record.Type == LogRecordTxnFinished {
+			footer, err := decodeHintFooter(record.Value)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if footer.Count != uint64(len(keys)) || footer.Checksum != checksum {
+				return nil, nil, nil, ErrInvalidHintFile
+			}
+			return keys, positions, footer, nil
+		}
+
+		// 重新编码计算校验值，和写入时的数据完全一致
+		encRecord, _ := EncodeLogRecord(record)
+		checksum = crc32.Update(checksum, crc32.IEEETable, encRecord)
+		keys = append(keys, record.Key)
+		positions = append(positions, DecodeLogRecordPos(record.Value))
+	}
+}
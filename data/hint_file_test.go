@@ -0,0 +1,91 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"bitcask-go/fio/memfs"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHintFile(t *testing.T) {
+	fs := memfs.New()
+	hintFile, err := OpenHintFile(fs, "/")
+	assert.Nil(t, err)
+	writer := NewHintWriter(hintFile)
+	for i := 0; i < 100; i++ {
+		pos := &LogRecordPos{Fid: uint32(3 + i%5), Offset: int64(i * 10), Size: 10}
+		err := writer.WriteHintRecord([]byte(fmt.Sprintf("key-%d", i)), pos)
+		assert.Nil(t, err)
+	}
+	err = writer.Finish()
+	assert.Nil(t, err)
+
+	keys, positions, footer, err := ReadHintFile(hintFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, 100, len(positions))
+	assert.Equal(t, uint64(100), footer.Count)
+	assert.Equal(t, uint32(3), footer.MinFid)
+	assert.Equal(t, uint32(7), footer.MaxFid)
+	assert.Equal(t, []byte("key-42"), keys[42])
+	assert.Equal(t, &LogRecordPos{Fid: 5, Offset: 420, Size: 10}, positions[42])
+
+	// 没有索引项的 hint 文件
+	emptyFile, err := NewDateFile(fs, "/empty-hint", 0, fio.StandardIO)
+	assert.Nil(t, err)
+	err = NewHintWriter(emptyFile).Finish()
+	assert.Nil(t, err)
+	keys, _, footer, err = ReadHintFile(emptyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+	assert.Equal(t, uint64(0), footer.Count)
+}
+
+func TestHintFile_Invalid(t *testing.T) {
+	fs := memfs.New()
+	record := func(key string) []byte {
+		buf, _ := EncodeLogRecord(&LogRecord{
+			Key:   []byte(key),
+			Value: EncodeLogRecordPos(&LogRecordPos{Fid: 1, Offset: 0, Size: 10}),
+		})
+		return buf
+	}
+
+	// 正常的 hint 文件，只有一个索引项
+	hintFile, err := NewDateFile(fs, "/hint", 0, fio.StandardIO)
+	assert.Nil(t, err)
+	writer := NewHintWriter(hintFile)
+	err = writer.WriteHintRecord([]byte("key-a"), &LogRecordPos{Fid: 1, Offset: 0, Size: 10})
+	assert.Nil(t, err)
+	err = writer.Finish()
+	assert.Nil(t, err)
+	size, err := hintFile.IOManager.Size()
+	assert.Nil(t, err)
+	content := make([]byte, size)
+	_, err = hintFile.IOManager.Read(content, 0)
+	assert.Nil(t, err)
+	footer := content[len(record("key-a")):]
+
+	tests := map[string][]byte{
+		// 没有结尾记录
+		"no-footer": record("key-a"),
+		// 结尾记录被截断
+		"truncated": content[:len(content)-3],
+		// 索引项的数量不一致
+		"count": append(append(record("key-a"), record("key-b")...), footer...),
+		// 索引项被替换，校验值不一致
+		"checksum": append(record("key-b"), footer...),
+	}
+	for name, buf := range tests {
+		t.Run(name, func(t *testing.T) {
+			dataFile, err := NewDateFile(fs, "/hint-"+name, 0, fio.StandardIO)
+			assert.Nil(t, err)
+			err = dataFile.Write(buf)
+			assert.Nil(t, err)
+
+			_, _, _, err = ReadHintFile(dataFile)
+			assert.Equal(t, ErrInvalidHintFile, err)
+		})
+	}
+}
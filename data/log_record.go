@@ -50,7 +50,13 @@ type TransactionRecord struct {
 //	+-------------+-------------+-------------+--------------+-------------+--------------+
 //	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
 func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
-	headerBuf := make([]byte, maxLogRecordHeaderSize)
+	return EncodeLogRecordTo(nil, record)
+}
+
+// EncodeLogRecordTo 将 record 编码到 buf 中，buf 的容量不够时重新分配，返回编码后的字节数组和长度
+// header 先编码到栈上的数组中，整个编码过程最多只分配一次内存
+func EncodeLogRecordTo(buf []byte, record *LogRecord) ([]byte, int64) {
+	var headerBuf [maxLogRecordHeaderSize]byte
 
 	// 填充到 headerBuf 中
 	var pos = 0
@@ -67,7 +73,12 @@ func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
 
 	// 重新封装 record 转化为 []byte
 	var recordSize = int64(pos) + keySize + valueSize
-	recordBytes := make([]byte, recordSize)
+	var recordBytes []byte
+	if int64(cap(buf)) >= recordSize {
+		recordBytes = buf[:recordSize]
+	} else {
+		recordBytes = make([]byte, recordSize)
+	}
 	copy(recordBytes[:pos], headerBuf[:pos])             // 将 header 填充到 recordBytes 中
 	copy(recordBytes[pos:], record.Key)                  // 将 key 填充到 recordBytes 中
 	copy(recordBytes[pos+int(keySize):], record.Value)   // 将 value 填充到 recordBytes 中
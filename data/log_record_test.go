@@ -41,6 +41,27 @@ func Test_EncodeLogRecord(t *testing.T) {
 	assert.Greater(t, n3, int64(5))
 }
 
+func Test_EncodeLogRecordTo(t *testing.T) {
+	record := &LogRecord{
+		Key:   []byte("key"),
+		Type:  LogRecordNormal,
+		Value: []byte("value"),
+	}
+	expected, size := EncodeLogRecord(record)
+
+	// buf 容量足够时，直接编码到 buf 中
+	buf := make([]byte, 0, 64)
+	recordBytes, n := EncodeLogRecordTo(buf, record)
+	assert.Equal(t, size, n)
+	assert.Equal(t, expected, recordBytes)
+	assert.Equal(t, &buf[:1][0], &recordBytes[0])
+
+	// buf 容量不够时重新分配
+	recordBytes, n = EncodeLogRecordTo(make([]byte, 0, 4), record)
+	assert.Equal(t, size, n)
+	assert.Equal(t, expected, recordBytes)
+}
+
 func Test_DecodeLogRecordHeader(t *testing.T) {
 	// 正常数据
 	// headerSize: 7, type: 0, keySize: 3, valueSize: 5, crc: 1354786746
@@ -123,3 +144,21 @@ func TestGetLogRecordCRC(t *testing.T) {
 	assert.NotNil(t, crc3)
 	assert.Equal(t, uint32(667747257), crc3)
 }
+
+func Benchmark_EncodeLogRecord(b *testing.B) {
+	record := &LogRecord{Key: []byte("bench-key"), Value: make([]byte, 1024)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeLogRecord(record)
+	}
+}
+
+func Benchmark_EncodeLogRecordTo(b *testing.B) {
+	record := &LogRecord{Key: []byte("bench-key"), Value: make([]byte, 1024)}
+	bufPtr := GetBuffer(0)
+	defer PutBuffer(bufPtr)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		*bufPtr, _ = EncodeLogRecordTo(*bufPtr, record)
+	}
+}
@@ -1,93 +1,126 @@
 package bitcask_go
 
 import (
+	"bitcask-go/cache"
 	"bitcask-go/data"
 	"bitcask-go/fio"
 	"bitcask-go/index"
 	"bitcask-go/utils"
+	"bytes"
 	"errors"
-	"fmt"
-	"github.com/gofrs/flock"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	Database_Path = "./Database"
-	seqNoKey      = "seq.no"
 	fileLockName  = "flock"
+	// hint 文件、索引检查点等写完之后才持久化一次的文件使用的写缓冲区大小，和 WriteBufferSize 无关
+	syncedFileWriteBufferSize = 64 * 1024
 )
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options         Options // 用户传过来的配置项，一般不可修改，所以没加指针
-	lock            *sync.RWMutex
-	fileIds         []int                     // 数据文件 id，用时需转化为 uint32 类型，作为 fileId。只能在加载索引时使用，不能在其他地方更新和使用
-	activeFile      *data.DataFile            // 当前活跃的数据文件,可以写入
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index           index.Indexer             // 数据内存索引
-	seqNo           uint64                    // 事务序列号，全局递增，和 key 一起写入索引中（文件中只有 key）
-	isMerging       bool                      // 是否正在合并数据文件
-	seqNoFileExists bool                      // seqNo 文件是否存在
-	isInitial       bool                      // 是否是第一次初始化此数据目录( 为了BPTree 第一次能够正常的拿到 事务序列号）
-	fileLock        *flock.Flock              // 文件锁保证多进程之间的互斥
-	bytesWrite      uint                      // 累计写了多少字节
-	reclaimSize     int64                     // 标识有多少数据是无效数据
+	options        Options // 用户传过来的配置项，一般不可修改，所以没加指针
+	lock           *sync.RWMutex
+	fileIds        []int                     // 数据文件 id，用时需转化为 uint32 类型，作为 fileId。只能在加载索引时使用，不能在其他地方更新和使用
+	activeFile     *data.DataFile            // 当前活跃的数据文件,可以写入
+	olderFiles     map[uint32]*data.DataFile // 旧的数据文件，只能用于读
+	index          index.Indexer             // 数据内存索引
+	seqNo          uint64                    // 事务序列号，全局递增，和 key 一起写入索引中（文件中只有 key）
+	isMerging      bool                      // 是否正在合并数据文件
+	fileLock       fio.FileLock              // 文件锁保证多进程之间的互斥
+	bytesWrite     uint                      // 累计写了多少字节
+	reclaimSize    int64                     // 标识有多少数据是无效数据
+	valueCache     *cache.LRU                // value 缓存，没有开启时为 nil
+	lastCheckpoint data.LogRecordPos         // 最近一次索引检查点覆盖到的位置
+	checkpointLock *sync.Mutex               // 保证同一时间只有一个检查点在写入
+	checkpointStop chan struct{}             // 通知后台的检查点协程退出
+	checkpointDone chan struct{}             // 后台的检查点协程已经退出
+	// B+ 树和分片索引的单个写入在释放 lock 之后才更新索引，期间持有读锁；
+	// 删除、事务提交、merge 等需要等这些写入更新完索引，要在获取 lock 之前获取写锁
+	indexUpdateLock *sync.RWMutex
+	ingestLock      *sync.Mutex        // 保证同一时间只有一个批量导入的目录在安装
+	mergeHook       func(stage string) // 在 merge 的各个阶段调用，仅在测试中设置
 }
 
 type Stat struct {
-	KeyNum          uint  // Key 的总数量
-	DataFileNum     uint  // 数据文件 的数量
-	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
-	DiskSize        int64 // 数据目录所占磁盘空间大小
+	KeyNum          uint   // Key 的总数量
+	DataFileNum     uint   // 数据文件 的数量
+	ReclaimableSize int64  // 可以进行 merge 回收的数据量，字节为单位
+	DiskSize        int64  // 数据目录所占磁盘空间大小
+	BufferedSize    int64  // 写缓冲区中还没有写入文件的数据量
+	IndexMemory     int64  // 内存索引大约占用的内存大小
+	CacheHits       uint64 // value 缓存命中的次数
+	CacheMisses     uint64 // value 缓存没有命中的次数
 }
 
 // Stat 返回数据库的相关统计信息
-func (db *DB) Stat() *Stat {
+func (db *DB) Stat() (*Stat, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
 	var dataFilesNum = uint(len(db.olderFiles))
+	var bufferedSize int64
 	if db.activeFile != nil {
 		dataFilesNum++
+		bufferedSize = db.activeFile.BufferedSize()
 	}
 
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := utils.DirSize(db.options.FS, db.options.DirPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to get dir size: %v", err))
+		return nil, err
 	}
-
-	return &Stat{
-		KeyNum:          uint(db.index.Size()),
+	keyNum, err := db.index.Size()
+	if err != nil {
+		return nil, err
+	}
+	stat := &Stat{
+		KeyNum:          uint(keyNum),
 		DataFileNum:     dataFilesNum,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
+		BufferedSize:    bufferedSize,
+		IndexMemory:     db.index.MemorySize(),
 	}
+	if db.valueCache != nil {
+		stat.CacheHits = db.valueCache.Hits()
+		stat.CacheMisses = db.valueCache.Misses()
+	}
+	return stat, nil
 }
 
 // Open 打开一个 bitcask 数据库
 func Open(options Options) (*DB, error) {
+	// 没有指定文件系统时使用操作系统的文件系统
+	if options.FS == nil {
+		options.FS = fio.OSFileSystem
+	}
+
 	// 对用户传入的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
 
-	var isInitial bool
 	// 判断数据目录是否存在，不存在则创建新的目录
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
-		isInitial = true
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+	if _, err := options.FS.Stat(options.DirPath); os.IsNotExist(err) {
+		if err := options.FS.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
 	// 判断当前数据目录是否正在使用
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
+	fileLock, err := options.FS.Lock(filepath.Join(options.DirPath, fileLockName))
+	if err != nil {
+		return nil, err
+	}
 	hold, err := fileLock.TryLock()
 	if err != nil {
 		return nil, err
@@ -96,27 +129,40 @@ func Open(options Options) (*DB, error) {
 		return nil, ErrDatabaseIsUsing
 	}
 
-	// 判断当前目录中是否有文件
-	entries, err := os.ReadDir(options.DirPath)
+	// B+ 树索引文件不存在时会新建一个空的索引，比如打开批量导入生成的目录
+	_, err = options.FS.Stat(filepath.Join(options.DirPath, index.BPTreeIndexFileName))
+	newBPTreeIndex := os.IsNotExist(err)
+
+	// 初始化索引，B+ 树索引的文件损坏时返回错误
+	indexer, err := newIndexer(options)
 	if err != nil {
+		_ = fileLock.Unlock()
 		return nil, err
 	}
-	if len(entries) == 0 {
-		isInitial = true
-	}
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		lock:       new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(index.IndexType(options.IndexType), options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		options:        options,
+		lock:           new(sync.RWMutex),
+		olderFiles:     make(map[uint32]*data.DataFile),
+		index:          indexer,
+		fileLock:       fileLock,
+		checkpointLock: new(sync.Mutex),
+
+		indexUpdateLock: new(sync.RWMutex),
+		ingestLock:      new(sync.Mutex),
+	}
+	if options.ValueCacheSize > 0 {
+		db.valueCache = cache.NewLRU(options.ValueCacheSize)
 	}
 
 	// 从 merge DB 中加载数据文件
-	if err := db.loadMergeFiles(); err != nil {
+	if err := db.openPhase(OpenPhaseMergeFiles, db.loadMergeFiles); err != nil {
+		return nil, err
+	}
+
+	// 完成上次没有安装完的批量导入，或者清理没有开始安装的导入文件
+	if err := db.loadIngestFiles(); err != nil {
 		return nil, err
 	}
 
@@ -127,46 +173,76 @@ func Open(options Options) (*DB, error) {
 
 	// B+ 树索引不需要从数据文件中加载索引
 	if options.IndexType != BPlusTree {
-		// 从 hintFile 索引文件中加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
+		var replayFrom data.LogRecordPos
+		err := db.openPhase(OpenPhaseHint, func() error {
+			// 优先从索引检查点中加载索引，之后只需要回放检查点之后的数据
+			checkpoint, err := db.loadIndexFromCheckpoint()
+			if err != nil {
+				return err
+			}
+			if checkpoint != nil {
+				replayFrom = data.LogRecordPos{Fid: checkpoint.fid, Offset: checkpoint.offset}
+				return nil
+			}
+			// 从 hintFile 索引文件中加载 merge 文件的索引
+			replayFrom, err = db.loadIndexFromHintFile()
+			return err
+		})
+		if err != nil {
 			return nil, err
 		}
 
 		// 加载数据文件中的索引: 从 fileIds 中拿到文件
-		if err := db.loadIndexFromDataFile(); err != nil {
+		err = db.openPhase(OpenPhaseDataReplay, func() error {
+			return db.loadIndexFromDataFile(replayFrom)
+		})
+		if err != nil {
 			return nil, err
 		}
-
-		// 重置 IO 类型为标准文件 IO
-		if db.options.MMapAtStartup {
-			if err := db.resetIoType(); err != nil {
-				return nil, err
-			}
-		}
 	}
 
 	// 取出当前序列号
 	if options.IndexType == BPlusTree {
+		// 将 B+ 树索引中的位置同步为 merge 之后的位置
+		err := db.openPhase(OpenPhaseHint, func() error {
+			return db.rewriteBPTreeIndex(newBPTreeIndex)
+		})
+		if err != nil {
+			return nil, err
+		}
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
 		if db.activeFile != nil {
-			size, err := db.activeFile.IOManager.Size()
+			offset, err := db.activeFile.ScanEnd()
 			if err != nil {
 				return nil, err
 			}
-			db.activeFile.WriteOffset = size
+			if err := db.truncateActiveFile(offset); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return db, nil
-}
+	// 重置 IO 类型为用户配置的 IO 类型，B+ 树索引同样在启动时使用 MMap 读取数据文件
+	if db.options.MMapAtStartup && db.options.IOType != MemoryMap {
+		if err := db.resetIoType(); err != nil {
+			return nil, err
+		}
+	}
 
-// Backup 备份数据库，将数据文件拷贝到新的目录中
-func (db *DB) Backup(dirPath string) error {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-	return utils.CopyDir(db.options.DirPath, dirPath, []string{fileLockName})
+	// 加载完成之后再开启活跃文件的写缓冲
+	if db.activeFile != nil {
+		if err := db.activeFile.SetWriteBuffer(db.options.WriteBufferSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.IndexCheckpointInterval > 0 {
+		db.startCheckpointLoop()
+	}
+
+	return db, nil
 }
 
 // Put 写入数据
@@ -183,47 +259,118 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Value: value,
 	}
 
+	// B+ 树和分片索引在释放数据库的锁之后再更新索引
+	switch idx := db.index.(type) {
+	case *index.BPlusTree:
+		return db.putOutsideLock(key, record, idx.PutBatched)
+	case *index.ShardedIndex:
+		return db.putOutsideLock(key, record, idx.PutIfNewer)
+	}
+
+	// 写数据和更新索引在同一把锁内完成，merge 和检查点在锁内获取的索引快照才能和数据文件保持一致
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	// 追加写入到当前活跃数据文件中
-	pos, err := db.appendLogRecordWithLock(record)
+	pos, err := db.appendLogRecord(record)
 	if err != nil {
 		return err
 	}
 
 	// 更新索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
+	oldPos, err := db.index.Put(key, pos)
+	if err != nil {
+		return err
+	}
+	if oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 	}
 	return nil
 }
 
-// Get 读取数据
-func (db *DB) Get(key []byte) ([]byte, error) {
+// putOutsideLock 写入数据之后释放锁，再通过 put 更新索引：B+ 树索引通过 bolt 的 Batch 和其他协程的写入一起提交，
+// 避免每次写入都单独提交一个 bolt 事务；分片索引只锁住 key 所在的分片，不同分片的索引更新可以并行。
+// put 只保留更新的位置，并返回失效的位置
+func (db *DB) putOutsideLock(key []byte, record *data.LogRecord, put func(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error)) error {
+	db.indexUpdateLock.RLock()
+	defer db.indexUpdateLock.RUnlock()
+
 	db.lock.Lock()
-	defer db.lock.Unlock()
+	pos, err := db.appendLogRecord(record)
+	db.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	stalePos, err := put(key, pos)
+	if err != nil {
+		return err
+	}
+	if stalePos != nil {
+		db.lock.Lock()
+		db.reclaimSize += int64(stalePos.Size)
+		db.lock.Unlock()
+	}
+	return nil
+}
 
+// Get 读取数据
+func (db *DB) Get(key []byte) ([]byte, error) {
 	// 判断 key 是否为空
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
 
-	// 从内存中拿到 key 的索引信息
-	logRecordPos := db.index.Get(key)
+	// 从内存中拿到 key 的索引信息，索引自身是并发安全的，不需要持有数据库的锁
+	logRecordPos, err := db.index.Get(key)
+	if err != nil {
+		return nil, err
+	}
 	if logRecordPos == nil {
 		return nil, ErrKeyNotFound
 	}
 
 	// 从索引地址 取得对应的 value
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	return db.GetValueByRecordPos(logRecordPos)
 }
 
+// GetInto 读取数据，value 追加到 dst[:0] 中返回
+// dst 的容量足够时整个读取过程不会为 value 分配内存，返回的数据和 dst 共用同一块内存
+func (db *DB) GetInto(key, dst []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	logRecordPos, err := db.index.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.readValue(logRecordPos, dst)
+}
+
 // Delete 删除数据
 func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
 
+	db.indexUpdateLock.Lock()
+	defer db.indexUpdateLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	// 检查数据库中是否存在 key
-	if pos := db.index.Get(key); pos == nil {
+	if pos, err := db.index.Get(key); err != nil {
+		return err
+	} else if pos == nil {
 		// 不存在的话，删除一个不存在的键并不会改变数据库的状态。
 		// 相当于直接删除了，直接忽略这次操作即可
 		return nil
@@ -237,13 +384,16 @@ func (db *DB) Delete(key []byte) error {
 		Type: data.LogRecordDeleted,
 	}
 
-	pos, err := db.appendLogRecordWithLock(record)
+	pos, err := db.appendLogRecord(record)
 	if err != nil {
 		return err
 	}
 	db.reclaimSize += int64(pos.Size) // 将这条数据加入到无效数据中
 
-	oldPos, ok := db.index.Delete(key)
+	oldPos, ok, err := db.index.Delete(key)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
@@ -253,18 +403,18 @@ func (db *DB) Delete(key []byte) error {
 	return nil
 }
 
-// ListKeys 列出所有的 key
-func (db *DB) ListKeys() [][]byte {
-	iter := db.index.Iterator(false)
+// ListKeys 列出所有的 key，返回的 key 都是复制出来的数据
+func (db *DB) ListKeys() ([][]byte, error) {
+	iter, err := db.index.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
 	defer iter.Close()
-	keyListSize := db.index.Size()
-	keys := make([][]byte, keyListSize)
-	var idx int
+	var keys [][]byte
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		keys[idx] = iter.Key()
-		idx++
+		keys = append(keys, bytes.Clone(iter.Key()))
 	}
-	return keys
+	return keys, nil
 }
 
 // Fold ：遍历所有的数据的循环内，执行用户自定义函数，函数返回 false 时终止遍历
@@ -272,10 +422,13 @@ func (db *DB) Fold(foldFunc func(key []byte, value []byte) bool) error {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	iter := db.index.Iterator(false)
+	iter, err := db.index.Iterator(false)
+	if err != nil {
+		return err
+	}
 	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		key := iter.Key()
+		key := bytes.Clone(iter.Key())
 		value, err := db.GetValueByRecordPos(iter.Value())
 		if err != nil {
 			return err
@@ -303,41 +456,40 @@ func (db *DB) Sync() error {
 }
 
 // Close 关闭数据库
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
 
-	// 释放文件锁
+	// 释放文件锁，关闭索引，出错时返回第一个错误
 	defer func() {
-		if err := db.fileLock.Unlock(); err != nil {
-			panic(fmt.Sprintf("failed to unock the database direcory,%v", err))
+		if unlockErr := db.fileLock.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
 		}
-		// 关闭索引
-		if err := db.index.Close(); err != nil {
-			panic(fmt.Sprintf("failed to close index,%v", err))
+		if closeErr := db.index.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}()
+	// 先停止后台的检查点，它需要获取数据库的锁
+	db.stopCheckpointLoop()
 	if db.activeFile == nil {
 		return nil
 	}
 
 	// 写锁
+	db.indexUpdateLock.Lock()
+	defer db.indexUpdateLock.Unlock()
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	// 保存当前事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
-	if err != nil {
-		return err
-	}
-	record := &data.LogRecord{
-		Key:   []byte(seqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	if err := seqNoFile.Write(encRecord); err != nil {
-		return err
-	}
-	if err := seqNoFile.Sync(); err != nil {
-		return err
+	// 写入索引检查点，下次启动时不需要回放所有的数据
+	if db.options.IndexCheckpointInterval > 0 && db.options.IndexType != BPlusTree {
+		snapshot, err := db.checkpointSnapshot()
+		if err != nil {
+			return err
+		}
+		if snapshot != nil {
+			if err := db.writeCheckpoint(snapshot); err != nil {
+				return err
+			}
+		}
 	}
 
 	// 关闭当前活跃文件
@@ -355,12 +507,6 @@ func (db *DB) Close() error {
 	return nil
 }
 
-func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPos, error) {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-	return db.appendLogRecord(record)
-}
-
 // appendLogRecord 追加写入到当前活跃数据文件中
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
 
@@ -371,21 +517,15 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 		}
 	}
 
-	// 写入数据编码
-	encRecord, size := data.EncodeLogRecord(record)
+	// 写入数据编码，数据写入之后就不再需要，使用缓冲池中的内存
+	bufPtr := data.GetBuffer(0)
+	defer data.PutBuffer(bufPtr)
+	encRecord, size := data.EncodeLogRecordTo(*bufPtr, record)
+	*bufPtr = encRecord
 
 	// 判断当前活跃文件的写入位置是否超过阈值，超过则创建一个新文件
 	if db.activeFile.WriteOffset+size > db.options.DataFileSize {
-		// 持久化数据文件, 把当前活跃丢到 map 中去
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-
-		// 将当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		// 创建新的活跃文件
-		if err := db.setActiveDateFile(); err != nil {
+		if err := db.rotateActiveFile(); err != nil {
 			return nil, err
 		}
 	}
@@ -407,6 +547,10 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	}
 	if needSync {
 		if err := db.activeFile.Sync(); err != nil {
+			// 持久化失败时回滚这条记录，否则重启之后会出现一条没有写入成功的数据
+			if truncErr := db.activeFile.Truncate(writeOffset); truncErr != nil {
+				return nil, truncErr
+			}
 			return nil, err
 		}
 		if db.bytesWrite > 0 {
@@ -416,23 +560,52 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	return &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOffset, Size: uint32(size)}, nil
 }
 
+// rotateActiveFile 持久化当前活跃文件并转换为旧的数据文件，然后创建新的活跃文件
+func (db *DB) rotateActiveFile() error {
+	// 持久化数据文件, 把当前活跃丢到 map 中去
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+
+	// 将当前活跃文件转换为旧的数据文件，旧的数据文件不会再写入，不需要写缓冲
+	if err := db.activeFile.SetWriteBuffer(0); err != nil {
+		return err
+	}
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+
+	// 创建新的活跃文件
+	return db.setActiveDateFile()
+}
+
 func (db *DB) setActiveDateFile() error {
 	var initialField uint32 = 0
 	if db.activeFile != nil {
 		initialField = db.activeFile.FileId + 1
 	}
+	return db.openActiveDataFile(initialField)
+}
 
-	dataFile, err := data.OpenDateFile(db.options.DirPath, initialField, fio.StandardIO)
+// openActiveDataFile 创建 id 为 fileId 的数据文件作为新的活跃文件
+func (db *DB) openActiveDataFile(fileId uint32) error {
+	dataFile, err := data.OpenDateFile(db.options.FS, db.options.DirPath, fileId, fio.FileIOType(db.options.IOType))
 	if err != nil {
 		return err
 	}
+	if db.options.PreallocateDataFiles {
+		if err := dataFile.IOManager.Allocate(db.options.DataFileSize); err != nil {
+			return err
+		}
+	}
+	if err := dataFile.SetWriteBuffer(db.options.WriteBufferSize); err != nil {
+		return err
+	}
 
 	db.activeFile = dataFile
 	return nil
 }
 
 func (db *DB) loadDataFiles() error {
-	dirEntries, err := os.ReadDir(db.options.DirPath)
+	dirEntries, err := db.options.FS.ReadDir(db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -456,11 +629,11 @@ func (db *DB) loadDataFiles() error {
 	// 遍历每个文件，打开对应的数据文件
 	for i, fid := range fileIds {
 		var fileId = uint32(fid) // 类型转换
-		ioType := fio.StandardIO
+		ioType := fio.FileIOType(db.options.IOType)
 		if db.options.MMapAtStartup {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDateFile(db.options.DirPath, fileId, ioType)
+		dataFile, err := data.OpenDateFile(db.options.FS, db.options.DirPath, fileId, ioType)
 		if err != nil {
 			return err
 		}
@@ -475,106 +648,123 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
-// loadIndexFromDataFile 遍历所有的数据文件，并更新到内存索引中
-func (db *DB) loadIndexFromDataFile() error {
+// loadIndexFromDataFile 遍历数据文件，并更新到内存索引中
+// replayFrom 之前的数据已经从检查点或者 hint 文件中加载过了，只需要回放之后的数据
+func (db *DB) loadIndexFromDataFile(replayFrom data.LogRecordPos) error {
 	if len(db.fileIds) == 0 {
 		return nil
 	}
 
-	// 查看是否发生过 merge
-	hasMerge, nonMergeFIleId := false, uint32(0)
-	mergeFinishedFilePath := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinishedFilePath); err == nil {
-		fid, err := db.getNonMergeFileId(db.options.DirPath)
-		if err != nil {
-			return err
-		}
-		hasMerge, nonMergeFIleId = true, fid
-	}
-
-	updateIndex := func(key []byte, recordType data.LogRecordType, recordPos *data.LogRecordPos) {
+	updateIndex := func(key []byte, recordType data.LogRecordType, recordPos *data.LogRecordPos) error {
 		var oldPos *data.LogRecordPos
+		var err error
 		if recordType == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
+			oldPos, _, err = db.index.Delete(key)
 			db.reclaimSize += int64(recordPos.Size) // 把当前的加入
 		} else {
 			// normal and txn
-			oldPos = db.index.Put(key, recordPos)
+			oldPos, err = db.index.Put(key, recordPos)
+		}
+		if err != nil {
+			return err
 		}
 
 		if oldPos != nil {
 			db.reclaimSize += int64(oldPos.Size)
 		}
+		return nil
 	}
 
-	// 存储事务中的记录，是一个列表 []*data.TransactionRecord
-	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
-
-	// 遍历所有的文件，处理文件中的记录
-	for i, fid := range db.fileIds {
+	// 需要回放的数据文件，按照文件 id 的顺序排列
+	var replays []*fileReplay
+	for _, fid := range db.fileIds {
 		var fileId = uint32(fid) // 类型转换
-		var dataFile *data.DataFile
-
-		// 如果 fileId 比 nonMergeFIleId 小，则说明已经从 hintFIle 中加载索引了
-		if hasMerge && fileId < nonMergeFIleId {
+		if fileId < replayFrom.Fid {
 			continue
 		}
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fileId]
+		replay := &fileReplay{
+			dataFile: db.getDataFile(fileId),
+			batches:  make(chan []replayRecord, replayBatchBuffer),
 		}
+		if fileId == replayFrom.Fid {
+			replay.offset = replayFrom.Offset
+		}
+		replays = append(replays, replay)
+	}
+	if len(replays) == 0 {
+		return nil
+	}
 
-		var offset int64 = 0
-		for {
-			record, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-
-			// 构造内存索引并保存
-			recordPos := &data.LogRecordPos{
-				Fid:    fileId,
-				Offset: offset,
-				Size:   uint32(size),
+	// 多个协程并行解析数据文件，解码和校验 crc 不需要按顺序进行
+	jobs := make(chan *fileReplay, len(replays))
+	for _, replay := range replays {
+		jobs <- replay
+	}
+	close(jobs)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	workers := min(db.options.IndexLoadConcurrency, len(replays))
+	if workers <= 0 {
+		workers = min(runtime.NumCPU(), len(replays))
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for replay := range jobs {
+				replay.run(quit)
 			}
+		}()
+	}
+	defer func() {
+		// 出错时通知还在解析的协程退出，并等待它们都结束
+		close(quit)
+		wg.Wait()
+	}()
 
-			// 解析 key，拿到事务序列号
-			realKey, seqNo := DecodeKeyWithSeqNo(record.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务操作，直接更新内存索引
-				updateIndex(realKey, record.Type, recordPos)
-			} else {
-				// 事务操作，对应的 seqNo 的数据更新到 内存索引 中
-				if record.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+	// 存储事务中的记录，是一个列表 []*data.TransactionRecord
+	transactionRecords := make(map[uint64][]*data.TransactionRecord)
+	var currentSeqNo = db.seqNo
+
+	// 按照文件的顺序更新内存索引，同一个事务中的记录在读到事务完成的标识之后一起更新
+	for _, replay := range replays {
+		for records := range replay.batches {
+			for _, record := range records {
+				if record.seqNo == nonTransactionSeqNo {
+					// 非事务操作，直接更新内存索引
+					if err := updateIndex(record.key, record.recordType, record.pos); err != nil {
+						return err
 					}
-					delete(transactionRecords, seqNo)
 				} else {
-					record.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Pos:    recordPos,
-						Record: record,
-					})
+					// 事务操作，对应的 seqNo 的数据更新到 内存索引 中
+					if record.recordType == data.LogRecordTxnFinished {
+						for _, txnRecord := range transactionRecords[record.seqNo] {
+							if err := updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos); err != nil {
+								return err
+							}
+						}
+						delete(transactionRecords, record.seqNo)
+					} else {
+						transactionRecords[record.seqNo] = append(transactionRecords[record.seqNo], &data.TransactionRecord{
+							Pos:    record.pos,
+							Record: &data.LogRecord{Key: record.key, Type: record.recordType},
+						})
+					}
+				}
+				if record.seqNo > currentSeqNo {
+					currentSeqNo = record.seqNo
 				}
 			}
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
-
-			// 递增 offset，下一次从新的位置开始读
-			offset += size
-
 		}
+		if replay.err != nil {
+			return replay.err
+		}
+	}
 
-		// 如果当前是活跃文件，更新这个文件的 WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOffset = offset
+	// 更新活跃文件的 WriteOff，截断末尾不完整的数据
+	if last := replays[len(replays)-1]; last.dataFile == db.activeFile {
+		if err := db.truncateActiveFile(last.offset); err != nil {
+			return err
 		}
 	}
 
@@ -583,6 +773,78 @@ func (db *DB) loadIndexFromDataFile() error {
 	return nil
 }
 
+const (
+	replayBatchSize   = 1024 // 解析协程每次发送给索引更新的记录数量
+	replayBatchBuffer = 4    // 每个数据文件最多缓存多少批解析好的记录，限制启动时的内存占用
+)
+
+// replayRecord 从数据文件中解析出来的一条记录，key 中已经去掉了事务序列号
+type replayRecord struct {
+	key        []byte
+	recordType data.LogRecordType
+	seqNo      uint64
+	pos        *data.LogRecordPos
+}
+
+// fileReplay 一个数据文件的回放任务
+type fileReplay struct {
+	dataFile *data.DataFile
+	offset   int64               // 开始解析的位置，解析完成之后是最后一条完整记录的结束位置
+	batches  chan []replayRecord // 按顺序保存解析好的记录，解析完成或者出错之后关闭
+	err      error               // 解析中遇到的错误，batches 关闭之后才能读取
+}
+
+// run 解析数据文件中的记录，quit 关闭时提前退出
+func (r *fileReplay) run(quit <-chan struct{}) {
+	defer close(r.batches)
+
+	send := func(records []replayRecord) bool {
+		select {
+		case r.batches <- records:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+
+	records := make([]replayRecord, 0, replayBatchSize)
+	for {
+		record, size, err := r.dataFile.ReadLogRecord(r.offset)
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			break
+		}
+
+		// 解析 key，拿到事务序列号
+		realKey, seqNo := DecodeKeyWithSeqNo(record.Key)
+		records = append(records, replayRecord{
+			key:        realKey,
+			recordType: record.Type,
+			seqNo:      seqNo,
+			pos: &data.LogRecordPos{
+				Fid:    r.dataFile.FileId,
+				Offset: r.offset,
+				Size:   uint32(size),
+			},
+		})
+
+		// 递增 offset，下一次从新的位置开始读
+		r.offset += size
+
+		if len(records) == replayBatchSize {
+			if !send(records) {
+				return
+			}
+			records = make([]replayRecord, 0, replayBatchSize)
+		}
+	}
+	if len(records) > 0 {
+		send(records)
+	}
+}
+
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
@@ -596,68 +858,195 @@ func checkOptions(options Options) error {
 		return errors.New("database data file merge ratio must be between 0 and 1")
 	}
 
+	if options.IOType > DirectIO {
+		return errors.New("database io type is unsupported")
+	}
+
+	if options.IndexShardNum < 0 {
+		return errors.New("database index shard num must not be negative")
+	}
+
+	// B+ 树索引的数据都保存在同一个 bbolt 文件中，不能分片
+	if options.IndexType == BPlusTree && options.IndexShardNum > 1 {
+		return errors.New("database b+ tree index can not be sharded")
+	}
+
+	if options.IndexCheckpointInterval < 0 {
+		return errors.New("database index checkpoint interval must not be negative")
+	}
+
+	if options.IndexLoadConcurrency < 0 {
+		return errors.New("database index load concurrency must not be negative")
+	}
+
+	if options.ValueCacheSize < 0 {
+		return errors.New("database value cache size must not be negative")
+	}
+
+	// B+ 树索引由 bbolt 直接读写磁盘文件，数据目录必须在操作系统的文件系统上
+	if options.IndexType == BPlusTree && !fio.IsOSFileSystem(options.FS) {
+		return errors.New("database b+ tree index only supports the os file system")
+	}
+
 	return nil
 }
 
+// openPhase 执行启动过程中的一个阶段，并通过 OnOpenPhase 回调报告这个阶段的耗时
+func (db *DB) openPhase(phase OpenPhase, fn func() error) error {
+	start := time.Now()
+	if err := fn(); err != nil {
+		return err
+	}
+	if db.options.OnOpenPhase != nil {
+		db.options.OnOpenPhase(phase, time.Since(start))
+	}
+	return nil
+}
+
+// newIndexer 根据配置项创建内存索引
+func newIndexer(options Options) (index.Indexer, error) {
+	newIndex := func() (index.Indexer, error) {
+		return index.NewIndexer(index.IndexType(options.IndexType), options.DirPath)
+	}
+	if options.IndexShardNum > 1 {
+		return index.NewShardedIndex(options.IndexShardNum, newIndex)
+	}
+	return newIndex()
+}
+
 // GetValueByRecordPos 根据索引信息，从数据文件中读取数据
 func (db *DB) GetValueByRecordPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+	return db.readValue(logRecordPos, nil)
+}
+
+// readValue 根据索引信息读取 value，value 追加到 dst[:0] 中返回，dst 为 nil 时重新分配内存
+// 索引中记录了数据的大小时，一次读取整条记录，不需要获取文件大小和分两次读取 header 和 key/value
+func (db *DB) readValue(logRecordPos *data.LogRecordPos, dst []byte) ([]byte, error) {
+	// 先从 value 缓存中查找，缓存中的数据不能直接返回给用户修改
+	var cacheKey cache.Key
+	if db.valueCache != nil {
+		cacheKey = cache.Key{Fid: logRecordPos.Fid, Offset: logRecordPos.Offset}
+		if value, ok := db.valueCache.Get(cacheKey); ok {
+			if dst == nil {
+				dst = make([]byte, 0, len(value))
+			}
+			return append(dst[:0], value...), nil
+		}
 	}
+
+	dataFile := db.getDataFile(logRecordPos.Fid)
 	// 数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
 
-	// 根据偏移量读取数据文件
-	record, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
-	if err != nil {
-		return nil, err
+	var value []byte
+	var recordType data.LogRecordType
+	if logRecordPos.Size > 0 {
+		var err error
+		value, recordType, err = dataFile.ReadValueInto(logRecordPos.Offset, logRecordPos.Size, dst)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// 记录大小未知，根据偏移量读取数据文件
+		record, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+		if err != nil {
+			return nil, err
+		}
+		recordType, value = record.Type, record.Value
+		if dst != nil {
+			value = append(dst[:0], value...)
+		}
 	}
 
-	if record.Type == data.LogRecordDeleted {
+	if recordType == data.LogRecordDeleted {
 		return nil, ErrKeyNotFound
 	}
 
-	return record.Value, nil
+	if db.valueCache != nil {
+		db.valueCache.Put(cacheKey, value)
+	}
+	return value, nil
 }
 
-func (db *DB) loadSeqNo() error {
-	filePath := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return nil
+// getDataFile 根据文件 id 获取数据文件，文件不存在时返回 nil
+func (db *DB) getDataFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
 	}
+	return db.olderFiles[fid]
+}
 
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+// truncateActiveFile 将活跃文件的写入位置设置为 offset，并截断之后的数据
+// 崩溃时预分配或者 MMap 扩展的空间没有被截断，文件末尾是全零的数据，需要截断后才能继续追加写入
+func (db *DB) truncateActiveFile(offset int64) error {
+	db.activeFile.WriteOffset = offset
+	size, err := db.activeFile.IOManager.Size()
 	if err != nil {
 		return err
 	}
+	if size > offset {
+		return db.activeFile.IOManager.Truncate(offset)
+	}
+	return nil
+}
 
-	record, _, err := seqNoFile.ReadLogRecord(0)
-	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
+func (db *DB) loadSeqNo() error {
+	bptree, ok := db.index.(*index.BPlusTree)
+	if !ok {
+		return nil
+	}
+	seqNo, err := bptree.SeqNo()
 	if err != nil {
 		return err
 	}
+
+	// 之前的版本只在关闭时把序列号保存在 seqNo 文件中，升级之后迁移到 B+ 树索引中
+	filePath := filepath.Join(db.options.DirPath, data.SeqNoFileName)
+	if _, err := db.options.FS.Stat(filePath); err == nil {
+		seqNoFile, err := data.OpenSeqNoFile(db.options.FS, db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		record, _, err := seqNoFile.ReadLogRecord(0)
+		_ = seqNoFile.Close()
+		if err == nil {
+			fileSeqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
+			if err != nil {
+				return err
+			}
+			if fileSeqNo > seqNo {
+				seqNo = fileSeqNo
+				if err := bptree.SetSeqNo(seqNo); err != nil {
+					return err
+				}
+			}
+		} else if err != io.EOF && err != data.ErrInvalidCRC {
+			return err
+		}
+		if err := db.options.FS.Remove(filePath); err != nil {
+			return err
+		}
+	}
+
 	db.seqNo = seqNo
-	db.seqNoFileExists = true
-	return os.Remove(filePath)
+	return nil
 }
 
-// 将数据文件的 IO 类型设置为标准文件 IO
+// 将数据文件的 IO 类型设置为用户配置的 IO 类型
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
 
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardIO); err != nil {
+	ioType := fio.FileIOType(db.options.IOType)
+	if err := db.activeFile.SetIOManager(db.options.FS, db.options.DirPath, ioType); err != nil {
 		return err
 	}
 
 	for _, dataFile := range db.olderFiles {
-		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardIO); err != nil {
+		if err := dataFile.SetIOManager(db.options.FS, db.options.DirPath, ioType); err != nil {
 			return err
 		}
 	}
@@ -1,11 +1,20 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/fio/memfs"
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func destoryDB(db *DB) {
@@ -20,6 +29,20 @@ func destoryDB(db *DB) {
 	}
 }
 
+// listKeys 列出数据库中所有的 key
+func listKeys(t *testing.T, db *DB) [][]byte {
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	return keys
+}
+
+// dbStat 获取数据库的统计信息
+func dbStat(t *testing.T, db *DB) *Stat {
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	return stat
+}
+
 func TestOpen(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-open")
@@ -165,6 +188,109 @@ func TestDB_Get(t *testing.T) {
 	assert.Equal(t, ErrKeyNotFound, err)
 }
 
+func TestDB_GetInto(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-get-into")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetRandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Greater(t, len(db.olderFiles), 0)
+
+	// 旧的数据文件和活跃文件中的数据都可以读取
+	dst := make([]byte, 0, 1024)
+	for i := 1; i < 1000; i++ {
+		value, err := db.GetInto(utils.GetTestKey(i), dst)
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+
+	_, err = db.GetInto(utils.GetTestKey(0), dst)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.GetInto([]byte("unExistedKey"), dst)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.GetInto(nil, dst)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	// 记录大小未知时也可以读取
+	pos, err := db.index.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.index.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset})
+	assert.Nil(t, err)
+	value, err := db.GetInto(utils.GetTestKey(1), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], value)
+
+	// 复用 dst 时，比 Get 的内存分配次数少
+	key := utils.GetTestKey(999)
+	getAllocs := testing.AllocsPerRun(100, func() {
+		_, _ = db.Get(key)
+	})
+	getIntoAllocs := testing.AllocsPerRun(100, func() {
+		dst, _ = db.GetInto(key, dst)
+	})
+	assert.Less(t, getIntoAllocs, getAllocs)
+}
+
+// sizeCountingIOManager 统计 Size 的调用次数
+type sizeCountingIOManager struct {
+	fio.IOManager
+	sizeCalls int
+}
+
+func (m *sizeCountingIOManager) Size() (int64, error) {
+	m.sizeCalls++
+	return m.IOManager.Size()
+}
+
+// 索引中记录了数据大小时，读取数据不需要获取文件大小
+func TestDB_Get_SingleRead(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-get-single-read")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 100; i++ {
+		values[i] = utils.GetRandomValue(64)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	err = db.activeFile.Sync()
+	assert.Nil(t, err)
+	ioManager := &sizeCountingIOManager{IOManager: db.activeFile.IOManager}
+	db.activeFile.IOManager = ioManager
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+	assert.Equal(t, 0, ioManager.sizeCalls)
+
+	// 记录大小未知时，仍然按照原来的方式读取
+	pos, err := db.index.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.index.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset})
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ioManager.sizeCalls)
+}
+
 func TestDB_Delete(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-delete")
@@ -257,14 +383,14 @@ func TestDB_ListKeys(t *testing.T) {
 	assert.NotNil(t, db)
 
 	// 1. 数据库为空时
-	keys := db.ListKeys()
+	keys := listKeys(t, db)
 	assert.Equal(t, 0, len(keys))
 
 	// 2. 一条数据
 	key1 := utils.GetTestKey(1)
 	err = db.Put(key1, utils.GetRandomValue(1))
 	assert.Nil(t, err)
-	keys = db.ListKeys()
+	keys = listKeys(t, db)
 	assert.Equal(t, 1, len(keys))
 	assert.Equal(t, key1, keys[0])
 
@@ -274,11 +400,27 @@ func TestDB_ListKeys(t *testing.T) {
 	key3 := utils.GetTestKey(3)
 	err = db.Put(key3, utils.GetRandomValue(3))
 	assert.Nil(t, err)
-	keys = db.ListKeys()
+	keys = listKeys(t, db)
 	assert.Equal(t, 3, len(keys))
 	for _, key := range keys {
 		assert.NotNil(t, key)
 	}
+
+	// 4. 返回的 key 是复制出来的，修改之后不影响索引
+	for _, key := range keys {
+		copy(key, "modified")
+	}
+	assert.Equal(t, [][]byte{key1, key2, key3}, listKeys(t, db))
+	iter, err := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
+	copy(iter.Key(), "modified")
+	iter.Close()
+	err = db.Fold(func(key []byte, value []byte) bool {
+		copy(key, "modified")
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{key1, key2, key3}, listKeys(t, db))
 }
 
 func TestDB_Fold(t *testing.T) {
@@ -383,15 +525,16 @@ func TestDB_Stat(t *testing.T) {
 		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
 		assert.Nil(t, err)
 	}
-	stat := db.Stat()
+	stat := dbStat(t, db)
 	assert.Equal(t, uint(putSize1), stat.KeyNum)
 	assert.Equal(t, int64(0), stat.ReclaimableSize)
 	assert.Greater(t, stat.DataFileNum, uint(0))
+	assert.Greater(t, stat.IndexMemory, int64(putSize1*len(utils.GetTestKey(0))))
 	for i := 0; i < deleteSize1; i++ {
 		err := db.Delete(utils.GetTestKey(i))
 		assert.Nil(t, err)
 	}
-	stat = db.Stat()
+	stat = dbStat(t, db)
 	assert.Equal(t, uint(putSize1-deleteSize1), stat.KeyNum)
 
 	putSize2, deleteSize2 := 10, 20
@@ -399,18 +542,96 @@ func TestDB_Stat(t *testing.T) {
 		err := db.Delete(utils.GetTestKey(i))
 		assert.Nil(t, err)
 	}
-	stat = db.Stat()
+	stat = dbStat(t, db)
 	assert.Equal(t, uint(putSize1-deleteSize1-deleteSize2), stat.KeyNum)
 
 	for i := putSize1; i < putSize1+putSize2; i++ {
 		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
 		assert.Nil(t, err)
 	}
-	stat = db.Stat()
+	stat = dbStat(t, db)
 	assert.Equal(t, uint(putSize1-deleteSize1-deleteSize2+putSize2), stat.KeyNum)
 
 }
 
+func TestDB_ValueCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-value-cache")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.ValueCacheSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 100; i++ {
+		values[i] = utils.GetRandomValue(512)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+
+	// 第一次读取从磁盘读，之后从缓存中读
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], value)
+		}
+	}
+	stat := dbStat(t, db)
+	assert.Equal(t, uint64(100), stat.CacheHits)
+	assert.Equal(t, uint64(100), stat.CacheMisses)
+
+	// 修改返回的数据不影响缓存
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	value[0]++
+	value, err = db.GetInto(utils.GetTestKey(1), value)
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], value)
+
+	// 更新和删除之后索引指向新的位置，不会读到缓存中旧的数据
+	values[2] = utils.GetRandomValue(512)
+	err = db.Put(utils.GetTestKey(2), values[2])
+	assert.Nil(t, err)
+	value, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, values[2], value)
+	err = db.Delete(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge 之后重启，数据仍然正确
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		value, err := db2.Get(utils.GetTestKey(i))
+		if i == 3 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+	stat = dbStat(t, db2)
+	assert.Equal(t, uint64(0), stat.CacheHits)
+	assert.Equal(t, uint64(99), stat.CacheMisses)
+
+	// 缓存容量不能为负数
+	opts.ValueCacheSize = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
 func TestDB_Backup(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-backup")
@@ -426,7 +647,7 @@ func TestDB_Backup(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	err = db.Backup(destDir)
+	_, err = db.Backup(destDir)
 	assert.Nil(t, err)
 	err = db.Close()
 	assert.Nil(t, err)
@@ -436,10 +657,80 @@ func TestDB_Backup(t *testing.T) {
 	db2, err := Open(opts2)
 	defer destoryDB(db2)
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys := listKeys(t, db2)
 	assert.Equal(t, 10000, len(keys))
 }
 
+func TestDB_UnsupportedIOType(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-unsupported-io-type")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	opts.IOType = DirectIO + 1
+	db, err := Open(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, db)
+}
+
+func TestDB_MMapIOType(t *testing.T) {
+	testDBWithIOType(t, MemoryMap)
+}
+
+func TestDB_DirectIOType(t *testing.T) {
+	testDBWithIOType(t, DirectIO)
+}
+
+func testDBWithIOType(t *testing.T, ioType IOType) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-io-type")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	opts.IOType = ioType
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 写入数据，并发生数据文件的转换
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// 崩溃之后活跃文件末尾可能是预分配的空间或者对齐的填充
+	simulateCrash(db)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(listKeys(t, db2)))
+	for i := 0; i < 1000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, 1024, len(val))
+	}
+
+	// 重启后继续写入
+	for i := 1000; i < 1500; i++ {
+		err := db2.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(t, err)
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 使用标准 IO 重新打开
+	opts.IOType = StandardIO
+	db3, err := Open(opts)
+	defer destoryDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, len(listKeys(t, db3)))
+	for i := 0; i < 1500; i++ {
+		val, err := db3.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, 1024, len(val))
+	}
+}
+
 //func TestDB_OpenMMap(t *testing.T) {
 //	opts := DefaultOptions
 //	opts.DirPath = "/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database/bitcask-go-writeBach33476478020"
@@ -457,3 +748,558 @@ func TestDB_Backup(t *testing.T) {
 //	fmt.Println("mmap reader: ", time.Now().Sub(now))
 //	destoryDB(db2)
 //}
+
+func TestDB_MemFS(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-memfs"
+	opts.DataFileSize = 64 * 1024
+	opts.FS = memfs.New()
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 同一个文件系统中的数据目录不能被重复打开
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	_, err = db.Backup("/bitcask-go-memfs-backup")
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 数据都在内存文件系统中，磁盘上不会留下任何文件
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	for _, dirPath := range []string{opts.DirPath, "/bitcask-go-memfs-backup"} {
+		opts.DirPath = dirPath
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, len(listKeys(t, db2)))
+		for i := 0; i < 1000; i++ {
+			val, err := db2.Get(utils.GetTestKey(i))
+			if i < 500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, 128, len(val))
+			}
+		}
+		err = db2.Close()
+		assert.Nil(t, err)
+	}
+
+	// B+ 树索引只能使用操作系统的文件系统
+	opts.IndexType = BPlusTree
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_WriteBuffer(t *testing.T) {
+	// 默认不开启写缓冲，写入成功的数据都已经交给了文件系统
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-write-buffer-default"
+	opts.FS = memfs.New()
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetRandomValue(128))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dbStat(t, db).BufferedSize)
+	assert.Greater(t, dbStat(t, db).DiskSize, int64(0))
+	assert.Nil(t, db.Close())
+
+	opts.DirPath = "/bitcask-go-write-buffer"
+	opts.DataFileSize = 64 * 1024
+	opts.WriteBufferSize = 4 * 1024
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetRandomValue(128))
+	assert.Nil(t, err)
+	stat := dbStat(t, db)
+	assert.Greater(t, stat.BufferedSize, int64(0))
+	assert.Equal(t, int64(0), stat.DiskSize)
+
+	// 写入缓冲区中的数据可以直接读取
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 128, len(val))
+
+	for i := 2; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+		assert.Nil(t, err)
+	}
+	stat = dbStat(t, db)
+	assert.LessOrEqual(t, stat.BufferedSize, int64(opts.WriteBufferSize))
+	assert.Greater(t, stat.DiskSize, int64(0))
+
+	err = db.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dbStat(t, db).BufferedSize)
+
+	// BytesPerSync 触发持久化时也会写入缓冲区中的数据
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.BytesPerSync = 1024
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1; i <= 8; i++ {
+		err = db.Put(utils.GetTestKey(i), utils.GetRandomValue(200))
+		assert.Nil(t, err)
+	}
+	assert.Less(t, dbStat(t, db).BufferedSize, int64(1024))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(listKeys(t, db)))
+	for i := 1; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_HashIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-hash-index")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = Hash
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.GetRandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 迭代时 key 是有序的
+	iter, err := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
+	i := 100
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(i), iter.Key())
+		value, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+		i++
+	}
+	iter.Close()
+	assert.Equal(t, 500, i)
+
+	// 重启之后重新加载索引
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(400), dbStat(t, db2).KeyNum)
+	for i := 100; i < 500; i++ {
+		value, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+}
+
+// 并发读写数据库，需要使用 go test -race 运行才能检查出数据竞争
+func TestDB_Concurrent_ShardedIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexShardNum = 8
+	opts.ValueCacheSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	const workers = 8
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// 每个 worker 只修改自己的 key，读取所有的 key
+			for i := 0; i < 500; i++ {
+				key := utils.GetTestKey(i*workers + w)
+				value := []byte(fmt.Sprintf("value-%d", i))
+				assert.Nil(t, db.Put(key, value))
+				res, err := db.Get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, value, res)
+				if i%5 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+				_, err = db.Get(utils.GetTestKey(i*workers + (w+1)%workers))
+				assert.True(t, err == nil || err == ErrKeyNotFound)
+				if i%100 == 0 {
+					iter, err := db.NewIterator(DefaultIteratorOptions)
+					assert.Nil(t, err)
+					for iter.Rewind(); iter.Valid(); iter.Next() {
+						_, _ = iter.Value()
+					}
+					iter.Close()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint(workers*400), dbStat(t, db).KeyNum)
+	keys := listKeys(t, db)
+	assert.Equal(t, workers*400, len(keys))
+	for i := 1; i < len(keys); i++ {
+		assert.True(t, bytes.Compare(keys[i-1], keys[i]) < 0)
+	}
+
+	// B+ 树索引不能分片
+	opts.IndexType = BPlusTree
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_PreallocateDataFiles(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	ioTypes := map[string]IOType{"standard": StandardIO, "mmap": MemoryMap}
+	for indexName, indexType := range indexTypes {
+		for ioName, ioType := range ioTypes {
+			for _, preallocate := range []bool{true, false} {
+				t.Run(fmt.Sprintf("%s-%s-preallocate-%v", indexName, ioName, preallocate), func(t *testing.T) {
+					opts := DefaultOptions
+					dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-preallocate")
+					opts.DirPath = dir
+					opts.DataFileSize = 256 * 1024
+					opts.DataFileMergeRatio = 0
+					opts.IndexType = indexType
+					opts.IOType = ioType
+					opts.PreallocateDataFiles = preallocate
+					db, err := Open(opts)
+					assert.Nil(t, err)
+					for i := 0; i < 300; i++ {
+						err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+						assert.Nil(t, err)
+					}
+					err = db.Sync()
+					assert.Nil(t, err)
+
+					// MMap 扩展和预分配的空间都在文件中，崩溃之后文件末尾是全零的数据
+					stat, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+					assert.Nil(t, err)
+					switch {
+					case ioType == MemoryMap && preallocate:
+						assert.Equal(t, opts.DataFileSize, stat.Size())
+					case ioType == MemoryMap:
+						assert.Greater(t, stat.Size(), db.activeFile.WriteOffset)
+					default:
+						assert.Equal(t, db.activeFile.WriteOffset, stat.Size())
+					}
+					// 崩溃时数据文件没有关闭，扩展和预分配的空间不会被截断
+					_ = db.fileLock.Unlock()
+					_ = db.index.Close()
+
+					// 重启之后从数据真正的末尾继续写入
+					db2, err := Open(opts)
+					assert.Nil(t, err)
+					assert.Equal(t, 300, len(listKeys(t, db2)))
+					for i := 300; i < 600; i++ {
+						err := db2.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+						assert.Nil(t, err)
+					}
+					err = db2.Merge()
+					assert.Nil(t, err)
+					err = db2.Close()
+					assert.Nil(t, err)
+
+					db3, err := Open(opts)
+					defer destoryDB(db3)
+					assert.Nil(t, err)
+					assert.Equal(t, 600, len(listKeys(t, db3)))
+					for i := 0; i < 600; i++ {
+						val, err := db3.Get(utils.GetTestKey(i))
+						assert.Nil(t, err)
+						assert.Equal(t, 1024, len(val))
+					}
+				})
+			}
+		}
+	}
+}
+
+// 标准 IO 的活跃文件末尾有全零的数据时（例如其他方式预分配了可见的大小之后崩溃），启动时同样截断
+func TestDB_StandardIO_ZeroTail(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-zero-tail")
+			opts.DirPath = dir
+			opts.IndexType = indexType
+			opts.IOType = StandardIO
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			for i := 0; i < 100; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			writeOffset := db.activeFile.WriteOffset
+			activePath := data.GetDataFileName(dir, db.activeFile.FileId)
+			assert.Nil(t, db.Close())
+			assert.Nil(t, os.Truncate(activePath, writeOffset+64*1024))
+
+			db2, err := Open(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, writeOffset, db2.activeFile.WriteOffset)
+			assert.IsType(t, &fio.FileIO{}, db2.activeFile.IOManager)
+			stat, err := os.Stat(activePath)
+			assert.Nil(t, err)
+			assert.Equal(t, writeOffset, stat.Size())
+			for i := 100; i < 200; i++ {
+				err := db2.Put(utils.GetTestKey(i), utils.GetRandomValue(128))
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, db2.Close())
+
+			db3, err := Open(opts)
+			defer destoryDB(db3)
+			assert.Nil(t, err)
+			assert.Equal(t, 200, len(listKeys(t, db3)))
+		})
+	}
+}
+
+func TestDB_ParallelIndexLoad(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-parallel-load")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		err := db.Put(utils.GetTestKey(i%1000), utils.GetRandomValue(32))
+		assert.Nil(t, err)
+	}
+	// 事务中的记录跨越了多个数据文件
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+	}
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetRandomValue(32)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Greater(t, len(db.olderFiles), 10)
+	stat := dbStat(t, db)
+	seqNo := db.seqNo
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 并行加载的结果和单个协程加载的一致
+	var reclaimSize int64 = -1
+	for _, concurrency := range []int{1, 4, 0} {
+		opts.IndexLoadConcurrency = concurrency
+		var phases []OpenPhase
+		opts.OnOpenPhase = func(phase OpenPhase, elapsed time.Duration) {
+			phases = append(phases, phase)
+			assert.GreaterOrEqual(t, elapsed, time.Duration(0))
+		}
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, []OpenPhase{OpenPhaseMergeFiles, OpenPhaseHint, OpenPhaseDataReplay}, phases)
+		assert.Equal(t, seqNo, db2.seqNo)
+		assert.Equal(t, stat.KeyNum, dbStat(t, db2).KeyNum)
+		if reclaimSize < 0 {
+			reclaimSize = dbStat(t, db2).ReclaimableSize
+		}
+		assert.Equal(t, reclaimSize, dbStat(t, db2).ReclaimableSize)
+		for i := 0; i < 1500; i++ {
+			val, err := db2.Get(utils.GetTestKey(i))
+			if i < 500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, 32, len(val))
+			}
+		}
+		err = db2.Close()
+		assert.Nil(t, err)
+	}
+
+	// 旧的数据文件损坏时启动失败
+	opts.IndexLoadConcurrency = 4
+	opts.OnOpenPhase = nil
+	fileName := data.GetDataFileName(dir, 2)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	err = os.WriteFile(fileName, buf, 0644)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+}
+
+func TestDB_IndexErrors(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-errors")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+
+	// B+ 树索引文件损坏时打开失败，不会占用数据目录
+	err := os.WriteFile(filepath.Join(dir, index.BPTreeIndexFileName), []byte("not a bbolt file"), 0644)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+	err = os.Remove(filepath.Join(dir, index.BPTreeIndexFileName))
+	assert.Nil(t, err)
+
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetRandomValue(10))
+	assert.Nil(t, err)
+
+	// 索引出错时，错误返回给调用方
+	err = db.index.Close()
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.GetRandomValue(10))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = db.GetInto(utils.GetTestKey(1), nil)
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	err = db.Fold(func(key []byte, value []byte) bool { return true })
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Delete(utils.GetTestKey(1))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = db.ListKeys()
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = db.NewIterator(DefaultIteratorOptions)
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = db.Stat()
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	var buf bytes.Buffer
+	_, err = db.Export(&buf, NDJSON, DefaultExportOptions)
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+}
+
+// B+ 树索引的单个写入在锁外合并更新，并发写入同一个 key 之后，索引要和回放数据文件得到的结果一致
+func TestDB_BPlusTree_ConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = BPlusTree
+	opts.SyncWrites = true
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := writeConcurrently(t, db, true)
+	assert.Nil(t, db.Close())
+
+	// 删除 B+ 树索引，使用内存索引回放所有的数据文件
+	err = os.Remove(filepath.Join(dir, index.BPTreeIndexFileName))
+	assert.Nil(t, err)
+	opts.IndexType = BTree
+	db2, err := Open(opts)
+	defer destoryDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, values, readAll(t, db2))
+}
+
+// 分片索引的单个写入在锁外更新索引，并发写入同一个 key 之后，索引和后台写入的检查点都要和回放数据文件得到的结果一致
+func TestDB_ShardedIndex_ConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexShardNum = 8
+	opts.IndexCheckpointInterval = time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	values := writeConcurrently(t, db, false)
+
+	// 不在关闭时写入检查点，从写入过程中后台写入的检查点启动
+	db.stopCheckpointLoop()
+	simulateCrash(db)
+	_, err = os.Stat(filepath.Join(dir, data.CheckpointFileName))
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, values, readAll(t, db2))
+	db2.stopCheckpointLoop()
+	simulateCrash(db2)
+
+	// 删除检查点，回放所有的数据文件
+	err = os.Remove(filepath.Join(dir, data.CheckpointFileName))
+	assert.Nil(t, err)
+	opts.IndexShardNum = 0
+	opts.IndexCheckpointInterval = 0
+	db3, err := Open(opts)
+	defer destoryDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, values, readAll(t, db3))
+}
+
+// writeConcurrently 多个协程并发写入、删除和提交事务，同一个 key 会被不同的协程修改，merge 为 true 时期间执行一次 merge，
+// 返回写入之后数据库中的数据
+func writeConcurrently(t *testing.T, db *DB, merge bool) map[string]string {
+	const workers, keyNum = 8, 50
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := utils.GetTestKey((i*7 + w) % keyNum)
+				switch {
+				case i%10 == 0:
+					assert.Nil(t, db.Delete(key))
+				case i%25 == 0:
+					wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+					assert.Nil(t, wb.Put(key, []byte(fmt.Sprintf("batch-%d-%d", w, i))))
+					assert.Nil(t, wb.Delete(utils.GetTestKey((i+1)%keyNum)))
+					assert.Nil(t, wb.Commit())
+				default:
+					assert.Nil(t, db.Put(key, []byte(fmt.Sprintf("value-%d-%d", w, i))))
+				}
+				if merge && w == 0 && i == 100 {
+					err := db.Merge()
+					assert.True(t, err == nil || err == ErrMergeIsPrecessing)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	values := readAll(t, db)
+	assert.NotEmpty(t, values)
+	return values
+}
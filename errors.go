@@ -3,14 +3,25 @@ package bitcask_go
 import "errors"
 
 var (
-	ErrKeyIsEmpty             = errors.New("key is empty")
-	ErrIndexUpdateFailed      = errors.New("index update failed")
-	ErrKeyNotFound            = errors.New("key not found")
-	ErrDataFileNotFound       = errors.New("data file not found")
-	ErrDataDirectoryCorrupted = errors.New("data directory corrupted")
-	ErrBatchTooLarge          = errors.New("batch too large")
-	ErrMergeIsPrecessing      = errors.New("merge is precessing")
-	ErrDatabaseIsUsing        = errors.New("the database directory is using by another process")
-	ErrMergeRatioUnreached    = errors.New("merge ratio unreached")
-	ErrNoEnoughSpaceForMerge  = errors.New("no enough space for merge")
+	ErrKeyIsEmpty              = errors.New("key is empty")
+	ErrIndexUpdateFailed       = errors.New("index update failed")
+	ErrKeyNotFound             = errors.New("key not found")
+	ErrDataFileNotFound        = errors.New("data file not found")
+	ErrDataDirectoryCorrupted  = errors.New("data directory corrupted")
+	ErrBatchTooLarge           = errors.New("batch too large")
+	ErrMergeIsPrecessing       = errors.New("merge is precessing")
+	ErrDatabaseIsUsing         = errors.New("the database directory is using by another process")
+	ErrMergeRatioUnreached     = errors.New("merge ratio unreached")
+	ErrNoEnoughSpaceForMerge   = errors.New("no enough space for merge")
+	ErrNoFileIdForMerge        = errors.New("no enough file ids for merge files")
+	ErrBackupDirNotEmpty       = errors.New("backup directory is not empty")
+	ErrRestoreDirNotEmpty      = errors.New("restore directory is not empty")
+	ErrInvalidBackupChain      = errors.New("invalid backup chain")
+	ErrUnsupportedExportFormat = errors.New("unsupported export format")
+	ErrInvalidExportData       = errors.New("invalid export data")
+	ErrExportDataTooLarge      = errors.New("export key or value too large")
+	ErrBulkLoadDirNotEmpty     = errors.New("bulk load directory is not empty")
+	ErrBulkLoadUnsorted        = errors.New("bulk load keys are not sorted")
+	ErrBulkLoadFinished        = errors.New("bulk loader is finished")
+	ErrInvalidBulkLoadDir      = errors.New("invalid bulk load directory")
 )
@@ -0,0 +1,370 @@
+package bitcask_go
+
+// 导出和导入
+// NDJSON：每行一个 JSON 对象 {"key": "...", "value": "..."}，key 和 value 都是 base64 编码。
+// CSV：第一行是表头 key,value，之后每行一条数据，key 和 value 都是 base64 编码。
+// BinaryDump：文件头之后每条数据依次是 key 的长度、key、value 的长度、value，长度都是 varint 编码；
+// 最后是一个长度为 0 的 key 和数据的条数，用于发现被截断的文件。
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+)
+
+// ExportFormat 导出和导入的数据格式
+type ExportFormat = byte
+
+const (
+	// NDJSON 每行一个 JSON 对象，key 和 value 使用 base64 编码
+	NDJSON ExportFormat = iota + 1
+	// CSV 表头为 key,value 的 CSV，key 和 value 使用 base64 编码
+	CSV
+	// BinaryDump 长度前缀的二进制格式，最紧凑，读写最快
+	BinaryDump
+)
+
+var binaryDumpMagic = []byte("BCDUMP01")
+
+const (
+	// maxDumpBytesSize BinaryDump 中单个 key 或者 value 的最大长度，导出时超过的数据返回错误，导入时视为数据损坏
+	maxDumpBytesSize = 64 * 1024 * 1024
+	// dumpReadChunkSize 超过这个长度的 key 或者 value 分块读取，
+	// 内存随着真正读到的数据增长，被篡改的长度不会导致一次分配大量的内存
+	dumpReadChunkSize = 64 * 1024
+)
+
+// ExportOptions 导出配置项
+type ExportOptions struct {
+	// 只导出前缀为 Prefix 的 key，为空时不限制
+	Prefix []byte
+	// 只导出 [Start, End) 范围内的 key，为空时不限制
+	Start []byte
+	End   []byte
+}
+
+var DefaultExportOptions = ExportOptions{}
+
+// Export 按照 key 的顺序导出数据到 w，返回导出的数据条数
+func (db *DB) Export(w io.Writer, format ExportFormat, opts ExportOptions) (int, error) {
+	encoder, err := newExportEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	iter, err := db.NewIterator(IteratorOptions{Prefix: opts.Prefix})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	if len(opts.Start) > 0 {
+		iter.Seek(opts.Start)
+	}
+
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		if len(opts.End) > 0 && bytes.Compare(iter.Key(), opts.End) >= 0 {
+			break
+		}
+		value, err := iter.Value()
+		if err != nil {
+			return count, err
+		}
+		if err := encoder.encode(iter.Key(), value); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, encoder.finish(count)
+}
+
+// Import 从 r 中导入数据，返回导入的数据条数
+// 每 MaxBatchSize 条数据通过一个 WriteBatch 提交，出错时之前已经提交的数据不会回滚
+func (db *DB) Import(r io.Reader, format ExportFormat) (int, error) {
+	decoder, err := newExportDecoder(r, format)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := DefaultWriteBatchOptions
+	wb := db.NewWriteBatch(opts)
+	var count, pending int
+	for {
+		key, value, err := decoder.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := wb.Put(key, value); err != nil {
+			return count, err
+		}
+		pending++
+		if pending == opts.MaxBatchSize {
+			if err := wb.Commit(); err != nil {
+				return count, err
+			}
+			count += pending
+			pending = 0
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return count, err
+	}
+	return count + pending, nil
+}
+
+type exportEncoder interface {
+	encode(key, value []byte) error
+	// finish 写入结尾并刷新缓冲区，count 为写入的数据条数
+	finish(count int) error
+}
+
+type exportDecoder interface {
+	// decode 读取下一条数据，没有数据时返回 io.EOF
+	decode() (key, value []byte, err error)
+}
+
+func newExportEncoder(w io.Writer, format ExportFormat) (exportEncoder, error) {
+	switch format {
+	case NDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonEncoder{w: bw, encoder: json.NewEncoder(bw)}, nil
+	case CSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "value"}); err != nil {
+			return nil, err
+		}
+		return &csvEncoder{w: cw}, nil
+	case BinaryDump:
+		bw := bufio.NewWriter(w)
+		if _, err := bw.Write(binaryDumpMagic); err != nil {
+			return nil, err
+		}
+		return &binaryEncoder{w: bw}, nil
+	}
+	return nil, ErrUnsupportedExportFormat
+}
+
+func newExportDecoder(r io.Reader, format ExportFormat) (exportDecoder, error) {
+	switch format {
+	case NDJSON:
+		return &ndjsonDecoder{decoder: json.NewDecoder(r)}, nil
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, ErrInvalidExportData
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+		if header[0] != "key" || header[1] != "value" {
+			return nil, ErrInvalidExportData
+		}
+		return &csvDecoder{r: cr}, nil
+	case BinaryDump:
+		br := bufio.NewReader(r)
+		magic := make([]byte, len(binaryDumpMagic))
+		if _, err := io.ReadFull(br, magic); err != nil {
+			return nil, dumpError(err)
+		}
+		if !bytes.Equal(magic, binaryDumpMagic) {
+			return nil, ErrInvalidExportData
+		}
+		return &binaryDecoder{r: br}, nil
+	}
+	return nil, ErrUnsupportedExportFormat
+}
+
+// exportRecord NDJSON 中的一条数据，[]byte 在 JSON 中使用 base64 编码
+type exportRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type ndjsonEncoder struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(key, value []byte) error {
+	return e.encoder.Encode(exportRecord{Key: key, Value: value})
+}
+
+func (e *ndjsonEncoder) finish(int) error {
+	return e.w.Flush()
+}
+
+type ndjsonDecoder struct {
+	decoder *json.Decoder
+}
+
+func (d *ndjsonDecoder) decode() ([]byte, []byte, error) {
+	var record exportRecord
+	if err := d.decoder.Decode(&record); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrInvalidExportData
+		}
+		return nil, nil, err
+	}
+	return record.Key, record.Value, nil
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) encode(key, value []byte) error {
+	return e.w.Write([]string{
+		base64.StdEncoding.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(value),
+	})
+}
+
+func (e *csvEncoder) finish(int) error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type csvDecoder struct {
+	r *csv.Reader
+}
+
+func (d *csvDecoder) decode() ([]byte, []byte, error) {
+	fields, err := d.r.Read()
+	if err != nil {
+		return nil, nil, csvError(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, nil, ErrInvalidExportData
+	}
+	value, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, ErrInvalidExportData
+	}
+	return key, value, nil
+}
+
+// csvError CSV 格式错误转换为 ErrInvalidExportData
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return ErrInvalidExportData
+	}
+	return err
+}
+
+type binaryEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *binaryEncoder) encode(key, value []byte) error {
+	if err := e.writeBytes(key); err != nil {
+		return err
+	}
+	return e.writeBytes(value)
+}
+
+func (e *binaryEncoder) writeBytes(b []byte) error {
+	if len(b) > maxDumpBytesSize {
+		return ErrExportDataTooLarge
+	}
+	if err := e.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *binaryEncoder) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(e.buf[:], v)
+	_, err := e.w.Write(e.buf[:n])
+	return err
+}
+
+func (e *binaryEncoder) finish(count int) error {
+	// 长度为 0 的 key 标识结尾，key 不能为空，不会和数据混淆
+	if err := e.writeUvarint(0); err != nil {
+		return err
+	}
+	if err := e.writeUvarint(uint64(count)); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type binaryDecoder struct {
+	r     *bufio.Reader
+	count uint64
+	done  bool
+}
+
+func (d *binaryDecoder) decode() ([]byte, []byte, error) {
+	if d.done {
+		return nil, nil, io.EOF
+	}
+	key, err := d.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) == 0 {
+		count, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, nil, dumpError(err)
+		}
+		if count != d.count {
+			return nil, nil, ErrInvalidExportData
+		}
+		d.done = true
+		return nil, nil, io.EOF
+	}
+	value, err := d.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	d.count++
+	return key, value, nil
+}
+
+func (d *binaryDecoder) readBytes() ([]byte, error) {
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, dumpError(err)
+	}
+	if size > maxDumpBytesSize {
+		return nil, ErrInvalidExportData
+	}
+	// 较长的数据每次最多读取和已经读到的数据一样多的数据，分配的内存不超过真正读到的数据的两倍
+	b := make([]byte, 0, min(int(size), dumpReadChunkSize))
+	for remaining := int(size); remaining > 0; {
+		n := min(remaining, max(len(b), dumpReadChunkSize))
+		b = slices.Grow(b, n)
+		if _, err := io.ReadFull(d.r, b[len(b):len(b)+n]); err != nil {
+			return nil, dumpError(err)
+		}
+		b = b[:len(b)+n]
+		remaining -= n
+	}
+	return b, nil
+}
+
+// dumpError 没有结尾的二进制数据是被截断的
+func dumpError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidExportData
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Export_Import(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-export")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	// 超过一个 WriteBatch 的数据量，包含 CSV 和 JSON 中的特殊字符以及非 UTF-8 的数据
+	const keyNum = 12000
+	for i := 0; i < keyNum; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(16))
+		assert.Nil(t, err)
+	}
+	specials := map[string]string{
+		"a,b\n\"c\"":   "line1\nline2,\"quoted\"",
+		"\xff\x00\xfe": "\x00\x01\xff",
+		"empty-value":  "",
+	}
+	for key, value := range specials {
+		err := db.Put([]byte(key), []byte(value))
+		assert.Nil(t, err)
+	}
+	expected := readAll(t, db)
+
+	formats := map[string]ExportFormat{"ndjson": NDJSON, "csv": CSV, "binary": BinaryDump}
+	for name, format := range formats {
+		t.Run(name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			count, err := db.Export(buf, format, DefaultExportOptions)
+			assert.Nil(t, err)
+			assert.Equal(t, len(expected), count)
+
+			opts2 := opts
+			opts2.DirPath, _ = os.MkdirTemp("", "bitcask-go-import")
+			db2, err := Open(opts2)
+			defer destoryDB(db2)
+			assert.Nil(t, err)
+			count, err = db2.Import(buf, format)
+			assert.Nil(t, err)
+			assert.Equal(t, len(expected), count)
+			assert.Equal(t, expected, readAll(t, db2))
+		})
+	}
+
+	// NDJSON 可以用标准工具查看，key 和 value 使用 base64 编码
+	buf := new(bytes.Buffer)
+	_, err = db.Export(buf, NDJSON, ExportOptions{Prefix: []byte("empty")})
+	assert.Nil(t, err)
+	var record map[string]string
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, map[string]string{"key": "ZW1wdHktdmFsdWU=", "value": ""}, record)
+}
+
+func TestDB_Export_Filter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-export-filter")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			err := db.Put([]byte(fmt.Sprintf("%s-%d", prefix, i)), []byte("value"))
+			assert.Nil(t, err)
+		}
+	}
+	exportKeys := func(opts ExportOptions) []string {
+		buf := new(bytes.Buffer)
+		count, err := db.Export(buf, CSV, opts)
+		assert.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(t, count+1, len(lines))
+
+		db2Opts := DefaultOptions
+		db2Opts.DirPath, _ = os.MkdirTemp("", "bitcask-go-export-filter-import")
+		db2, err := Open(db2Opts)
+		defer destoryDB(db2)
+		assert.Nil(t, err)
+		_, err = db2.Import(buf, CSV)
+		assert.Nil(t, err)
+		var keys []string
+		for _, key := range listKeys(t, db2) {
+			keys = append(keys, string(key))
+		}
+		return keys
+	}
+
+	keys := exportKeys(ExportOptions{Prefix: []byte("b")})
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "b-0", keys[0])
+	assert.Equal(t, "b-9", keys[9])
+
+	keys = exportKeys(ExportOptions{Start: []byte("a-5"), End: []byte("b-3")})
+	assert.Equal(t, []string{"a-5", "a-6", "a-7", "a-8", "a-9", "b-0", "b-1", "b-2"}, keys)
+
+	keys = exportKeys(ExportOptions{Prefix: []byte("c"), Start: []byte("a"), End: []byte("c-2")})
+	assert.Equal(t, []string{"c-0", "c-1"}, keys)
+
+	keys = exportKeys(ExportOptions{Start: []byte("d")})
+	assert.Equal(t, 0, len(keys))
+}
+
+func TestDB_Import_Invalid(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-import-invalid")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(16))
+		assert.Nil(t, err)
+	}
+	buf := new(bytes.Buffer)
+	_, err = db.Export(buf, BinaryDump, DefaultExportOptions)
+	assert.Nil(t, err)
+	dump := buf.Bytes()
+
+	tests := []struct {
+		name   string
+		format ExportFormat
+		input  string
+		err    error
+	}{
+		{"ndjson-syntax", NDJSON, `{"key": "YQ==", "value"`, ErrInvalidExportData},
+		{"ndjson-base64", NDJSON, `{"key": "!!", "value": ""}`, ErrInvalidExportData},
+		{"ndjson-empty-key", NDJSON, `{"key": "", "value": "YQ=="}`, ErrKeyIsEmpty},
+		{"csv-header", CSV, "k,v\nYQ==,YQ==\n", ErrInvalidExportData},
+		{"csv-empty", CSV, "", ErrInvalidExportData},
+		{"csv-fields", CSV, "key,value\nYQ==\n", ErrInvalidExportData},
+		{"csv-base64", CSV, "key,value\nYQ==,!!\n", ErrInvalidExportData},
+		{"binary-magic", BinaryDump, "not a dump", ErrInvalidExportData},
+		{"binary-truncated", BinaryDump, string(dump[:len(dump)-1]), ErrInvalidExportData},
+		{"binary-no-end", BinaryDump, string(dump[:len(dump)-2]), ErrInvalidExportData},
+		{"binary-count", BinaryDump, string(append(dump[:len(dump)-1:len(dump)-1], 11)), ErrInvalidExportData},
+		{"binary-too-large", BinaryDump, string(dumpWithLength(maxDumpBytesSize + 1)), ErrInvalidExportData},
+		{"binary-length-beyond-input", BinaryDump, string(dumpWithLength(maxDumpBytesSize)), ErrInvalidExportData},
+		{"format", ExportFormat(100), "", ErrUnsupportedExportFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := db.Import(strings.NewReader(test.input), test.format)
+			assert.Equal(t, test.err, err)
+		})
+	}
+
+	_, err = db.Export(new(bytes.Buffer), ExportFormat(100), DefaultExportOptions)
+	assert.Equal(t, ErrUnsupportedExportFormat, err)
+}
+
+// dumpWithLength 只有文件头和一个长度为 size 的 key 的前几个字节的二进制数据
+func dumpWithLength(size uint64) []byte {
+	dump := append([]byte(nil), binaryDumpMagic...)
+	dump = binary.AppendUvarint(dump, size)
+	return append(dump, "key"...)
+}
+
+// 导入时按照真正读到的数据分配内存，超过一个分块的 value 也可以正常导入
+func TestDB_Import_BinaryDump_Length(t *testing.T) {
+	decoder, err := newExportDecoder(bytes.NewReader(dumpWithLength(maxDumpBytesSize)), BinaryDump)
+	assert.Nil(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err = decoder.decode()
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, ErrInvalidExportData, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1024*1024))
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-import-length")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	value := utils.GetRandomValue(dumpReadChunkSize*4 + 1)
+	assert.Nil(t, db.Put([]byte("big"), value))
+	buf := new(bytes.Buffer)
+	_, err = db.Export(buf, BinaryDump, DefaultExportOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete([]byte("big")))
+	n, err := db.Import(buf, BinaryDump)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	val, err := db.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+}
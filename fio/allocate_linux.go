@@ -0,0 +1,30 @@
+//go:build linux
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// allocate 为文件预分配空间，使文件大小至少为 size
+// 文件系统不支持 fallocate 时退化为 Truncate
+func allocate(fd *os.File, size int64) error {
+	if err := unix.Fallocate(int(fd.Fd()), 0, 0, size); err == nil {
+		return nil
+	}
+	return fd.Truncate(size)
+}
+
+// preallocate 为文件预分配 size 大小的磁盘空间，不改变文件的大小，之后的追加写入不需要再分配空间
+// 使用 FALLOC_FL_KEEP_SIZE 而不是直接扩大文件：文件大小始终等于已经写入的数据大小，
+// 追加写入不需要先 Truncate，关闭文件时不需要截断，备份清单、检查点等按文件大小判断数据范围的地方也不受影响。
+// 代价是每次追加写入仍然会改变文件大小，持久化时还要同步文件大小的元数据，只是不再需要分配新的磁盘块。
+// 文件系统不支持时忽略
+func preallocate(fd *os.File, size int64) error {
+	err := unix.Fallocate(int(fd.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fio
+
+import "os"
+
+// allocate 为文件预分配空间，使文件大小至少为 size
+func allocate(fd *os.File, size int64) error {
+	return fd.Truncate(size)
+}
+
+// preallocate 为文件预分配 size 大小的磁盘空间，不改变文件的大小
+// 其他平台上没有不改变文件大小的预分配方式，直接忽略
+func preallocate(fd *os.File, size int64) error {
+	return nil
+}
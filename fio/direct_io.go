@@ -0,0 +1,206 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const (
+	directIOBlockSize  = 4096       // 直接 IO 的对齐大小
+	directIOBufferSize = 256 * 1024 // 写缓冲区的大小，是块大小的整数倍
+)
+
+// 读取单个块时使用的对齐缓冲区
+var directIOBlockPool = sync.Pool{
+	New: func() any {
+		block := alignedBlock(directIOBlockSize)
+		return &block
+	},
+}
+
+// DirectFileIO 绕过操作系统页缓存的文件 IO
+// 写入的数据先缓存在对齐的缓冲区中，写满之后按块写入磁盘；读取时按块对齐之后再从磁盘读取
+type DirectFileIO struct {
+	fd        *os.File
+	size      int64  // 已经写入的数据大小
+	buf       []byte // 对齐的写缓冲区，保存 bufOffset 之后还没有写满的数据
+	bufOffset int64  // buf 在文件中的偏移，按块对齐
+}
+
+// NewDirectIOManager 初始化直接 IO
+func NewDirectIOManager(fileName string) (*DirectFileIO, error) {
+	fd, err := openDirectFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	dio := &DirectFileIO{fd: fd, buf: alignedBlock(directIOBufferSize)}
+	if err := dio.reset(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+func (dio *DirectFileIO) Read(bytes []byte, offset int64) (int, error) {
+	if offset >= dio.size {
+		return 0, io.EOF
+	}
+	end := min(offset+int64(len(bytes)), dio.size)
+
+	// 已经写入磁盘的部分
+	if offset < dio.bufOffset {
+		diskEnd := min(end, dio.bufOffset)
+		if err := dio.readAligned(bytes[:diskEnd-offset], offset); err != nil {
+			return 0, err
+		}
+	}
+
+	// 还在缓冲区中的部分
+	if end > dio.bufOffset {
+		start := max(offset, dio.bufOffset)
+		copy(bytes[start-offset:end-offset], dio.buf[start-dio.bufOffset:end-dio.bufOffset])
+	}
+
+	n := int(end - offset)
+	if n < len(bytes) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dio *DirectFileIO) Write(bytes []byte) (int, error) {
+	var written int
+	for written < len(bytes) {
+		n := copy(dio.buf[dio.size-dio.bufOffset:], bytes[written:])
+		written += n
+		dio.size += int64(n)
+
+		// 缓冲区写满，整体写入磁盘
+		if dio.size-dio.bufOffset == int64(len(dio.buf)) {
+			if _, err := dio.fd.WriteAt(dio.buf, dio.bufOffset); err != nil {
+				return written, err
+			}
+			dio.bufOffset = dio.size
+			clear(dio.buf)
+		}
+	}
+	return written, nil
+}
+
+func (dio *DirectFileIO) Sync() error {
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	return dio.fd.Sync()
+}
+
+// Close 写入缓冲区中的数据，并截断最后一个块中用于对齐的填充
+func (dio *DirectFileIO) Close() error {
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	if err := dio.fd.Truncate(dio.size); err != nil {
+		return err
+	}
+	return dio.fd.Close()
+}
+
+func (dio *DirectFileIO) Size() (int64, error) {
+	return dio.size, nil
+}
+
+func (dio *DirectFileIO) Truncate(size int64) error {
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	if err := dio.fd.Truncate(size); err != nil {
+		return err
+	}
+	return dio.reset(size)
+}
+
+func (dio *DirectFileIO) Allocate(size int64) error {
+	return preallocate(dio.fd, size)
+}
+
+// flush 将缓冲区中的数据补齐到块大小后写入磁盘，并只在缓冲区中保留最后一个没有写满的块
+func (dio *DirectFileIO) flush() error {
+	buffered := dio.size - dio.bufOffset
+	if buffered == 0 {
+		return nil
+	}
+	alignedSize := alignUp(buffered)
+	if _, err := dio.fd.WriteAt(dio.buf[:alignedSize], dio.bufOffset); err != nil {
+		return err
+	}
+
+	// 已经写满的块之后不会再改变，不需要再次写入
+	fullSize := alignDown(buffered)
+	if fullSize > 0 {
+		copy(dio.buf, dio.buf[fullSize:buffered])
+		clear(dio.buf[buffered-fullSize:])
+		dio.bufOffset += fullSize
+	}
+	return nil
+}
+
+// reset 从磁盘重新加载最后一个没有写满的块到缓冲区中
+func (dio *DirectFileIO) reset(size int64) error {
+	dio.size = size
+	dio.bufOffset = alignDown(size)
+	clear(dio.buf)
+	if size > dio.bufOffset {
+		if _, err := dio.fd.ReadAt(dio.buf[:directIOBlockSize], dio.bufOffset); err != nil && err != io.EOF {
+			return err
+		}
+		clear(dio.buf[size-dio.bufOffset:])
+	}
+	return nil
+}
+
+// readAligned 按块对齐读取磁盘上的数据
+func (dio *DirectFileIO) readAligned(bytes []byte, offset int64) error {
+	alignedOffset := alignDown(offset)
+	alignedSize := alignUp(offset + int64(len(bytes)) - alignedOffset)
+
+	var block []byte
+	if alignedSize == directIOBlockSize {
+		blockPtr := directIOBlockPool.Get().(*[]byte)
+		defer directIOBlockPool.Put(blockPtr)
+		block = *blockPtr
+	} else {
+		block = alignedBlock(int(alignedSize))
+	}
+
+	if _, err := dio.fd.ReadAt(block, alignedOffset); err != nil {
+		return err
+	}
+	copy(bytes, block[offset-alignedOffset:])
+	return nil
+}
+
+// alignedBlock 分配一个起始地址按块对齐的缓冲区
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directIOBlockSize)
+	var offset int
+	if remainder := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOBlockSize - 1)); remainder != 0 {
+		offset = directIOBlockSize - remainder
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOBlockSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOBlockSize - 1)
+}
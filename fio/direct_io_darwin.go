@@ -0,0 +1,21 @@
+//go:build darwin
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// openDirectFile macOS 不支持 O_DIRECT，通过 F_NOCACHE 关闭文件的页缓存
+func openDirectFile(fileName string) (*os.File, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DateFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(fd.Fd(), unix.F_NOCACHE, 1); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
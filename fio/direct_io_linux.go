@@ -0,0 +1,13 @@
+//go:build linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile 使用 O_DIRECT 打开文件，读写不经过页缓存
+func openDirectFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, DateFilePerm)
+}
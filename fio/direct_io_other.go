@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package fio
+
+import "os"
+
+// openDirectFile 当前平台不支持绕过页缓存，使用普通方式打开文件
+func openDirectFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DateFilePerm)
+}
@@ -0,0 +1,162 @@
+package fio
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDirectIOManager(t *testing.T) {
+	path := filepath.Join(DataBasePath, "direct-a.data")
+	dio, err := NewDirectIOManager(path)
+	defer destoryFile(path)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, dio)
+}
+
+func TestDirectIO_Write(t *testing.T) {
+	path := filepath.Join(DataBasePath, "direct-a.data")
+	dio, err := NewDirectIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, dio)
+
+	n, err := dio.Write([]byte(""))
+	assert.Equal(t, 0, n)
+	assert.Nil(t, err)
+
+	n, err = dio.Write([]byte("hello"))
+	assert.Equal(t, 5, n)
+	assert.Nil(t, err)
+
+	n, err = dio.Write([]byte("bitcask kv"))
+	assert.Equal(t, 10, n)
+	assert.Nil(t, err)
+
+	// 超过写缓冲区大小的数据
+	n, err = dio.Write(bytes.Repeat([]byte("v"), 2*directIOBufferSize+100))
+	assert.Equal(t, 2*directIOBufferSize+100, n)
+	assert.Nil(t, err)
+
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*directIOBufferSize+115), size)
+}
+
+func TestDirectIO_Read(t *testing.T) {
+	path := filepath.Join(DataBasePath, "direct-b.data")
+	dio, err := NewDirectIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, dio)
+
+	_, err = dio.Write([]byte("key_a"))
+	assert.Nil(t, err)
+
+	_, err = dio.Write([]byte("key_b"))
+	assert.Nil(t, err)
+
+	// 读取还在缓冲区中的数据
+	b := make([]byte, 5)
+	n, err := dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "key_a", string(b))
+
+	b2 := make([]byte, 5)
+	n, err = dio.Read(b2, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "key_b", string(b2))
+
+	// 读取没有对齐的、跨越磁盘和缓冲区的数据
+	value := make([]byte, directIOBufferSize+3*directIOBlockSize)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	_, err = dio.Write(value)
+	assert.Nil(t, err)
+	b3 := make([]byte, len(value))
+	n, err = dio.Read(b3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, len(value), n)
+	assert.Equal(t, value, b3)
+
+	b4 := make([]byte, 7)
+	_, err = dio.Read(b4, 10+directIOBlockSize-3)
+	assert.Nil(t, err)
+	assert.Equal(t, value[directIOBlockSize-3:directIOBlockSize+4], b4)
+
+	// 读取超过文件末尾
+	n, err = dio.Read(make([]byte, 10), int64(10+len(value)-4))
+	assert.Equal(t, 4, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDirectIO_Sync(t *testing.T) {
+	path := filepath.Join(DataBasePath, "direct-b.data")
+	dio, err := NewDirectIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, dio)
+
+	_, err = dio.Write([]byte("key_a"))
+	assert.Nil(t, err)
+	err = dio.Sync()
+	assert.Nil(t, err)
+
+	// 持久化之后继续写入同一个块
+	_, err = dio.Write([]byte("key_b"))
+	assert.Nil(t, err)
+	err = dio.Sync()
+	assert.Nil(t, err)
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_akey_b", string(b))
+}
+
+func TestDirectIO_Close(t *testing.T) {
+	path := filepath.Join(DataBasePath, "direct-b.data")
+	dio, err := NewDirectIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, dio)
+
+	_, err = dio.Write([]byte("key_a"))
+	assert.Nil(t, err)
+	err = dio.Close()
+	assert.Nil(t, err)
+
+	// 关闭时截断对齐的填充
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+
+	// 重新打开之后继续追加写入
+	dio, err = NewDirectIOManager(path)
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("key_b"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_akey_b", string(b))
+
+	err = dio.Truncate(5)
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("key_c"))
+	assert.Nil(t, err)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_akey_c", string(b))
+	err = dio.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,366 @@
+package faultfs
+
+// 故障注入文件系统
+// 包装另一个文件系统，对所有的文件操作计数，并在指定的操作上注入错误、部分写入或者掉电，
+// 用于测试数据库在各种故障下的崩溃一致性。
+// 非操作系统的文件系统上数据文件总是使用标准文件 IO，所以 IOManager 的读写也都会经过这里。
+//
+// 掉电时只会丢弃文件中没有 Sync 的数据，创建、重命名和删除这些目录操作视为立即持久化。
+
+import (
+	"bitcask-go/fio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInjected  = errors.New("faultfs: injected error")
+	ErrPowerLoss = errors.New("faultfs: power loss")
+)
+
+// Fault 注入的故障类型
+type Fault = byte
+
+const (
+	// Error 操作直接返回错误，不产生任何修改
+	Error Fault = iota + 1
+	// ShortWrite 写操作只写入一半的数据后返回错误，其他操作直接返回错误
+	ShortWrite
+	// PowerLoss 掉电，当前和之后的所有操作都返回错误，直到调用 Restart
+	PowerLoss
+)
+
+// FS 故障注入文件系统
+type FS struct {
+	base   fio.FileSystem
+	lock   *sync.Mutex
+	ops    int64            // 已经执行的操作数
+	faults map[int64]Fault  // 操作序号 -> 在该操作上注入的故障
+	synced map[string]int64 // 文件路径 -> 已经持久化的数据大小
+	locks  []fio.FileLock   // 获取过的文件锁，重启时释放
+	down   bool             // 是否已经掉电
+}
+
+// New 在 base 文件系统之上创建故障注入文件系统
+func New(base fio.FileSystem) *FS {
+	return &FS{
+		base:   base,
+		lock:   new(sync.Mutex),
+		faults: make(map[int64]Fault),
+		synced: make(map[string]int64),
+	}
+}
+
+// Inject 在第 op 次操作（从 1 开始计数）上注入故障
+func (fs *FS) Inject(op int64, fault Fault) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.faults[op] = fault
+}
+
+// Ops 获取已经执行的操作数
+func (fs *FS) Ops() int64 {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.ops
+}
+
+// Down 是否已经掉电
+func (fs *FS) Down() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.down
+}
+
+// Restart 模拟进程崩溃后重启：丢弃所有文件中没有持久化的数据，释放文件锁，并清除还没有触发的故障
+// 重启之前打开的文件和数据库实例都不能再继续使用
+func (fs *FS) Restart() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for name, size := range fs.synced {
+		info, err := fs.base.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				delete(fs.synced, name)
+				continue
+			}
+			return err
+		}
+		if info.Size() <= size {
+			continue
+		}
+		f, err := fs.base.OpenFile(name, os.O_RDWR, fio.DateFilePerm)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(size); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, fl := range fs.locks {
+		if err := fl.Unlock(); err != nil {
+			return err
+		}
+	}
+	fs.locks = nil
+	fs.faults = make(map[int64]Fault)
+	fs.down = false
+	return nil
+}
+
+// step 记录一次操作，返回这次操作需要注入的故障
+func (fs *FS) step() (Fault, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.down {
+		return 0, ErrPowerLoss
+	}
+	fs.ops++
+	fault := fs.faults[fs.ops]
+	delete(fs.faults, fs.ops)
+	switch fault {
+	case PowerLoss:
+		fs.down = true
+		return fault, ErrPowerLoss
+	case Error:
+		return fault, ErrInjected
+	}
+	return fault, nil
+}
+
+// checkFault 用于不区分部分写入的操作，所有的故障都直接返回错误
+func (fs *FS) checkFault() error {
+	fault, err := fs.step()
+	if err != nil {
+		return err
+	}
+	if fault == ShortWrite {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (fio.File, error) {
+	if err := fs.checkFault(); err != nil {
+		return nil, err
+	}
+	f, err := fs.base.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	name = filepath.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.synced[name]; !ok || flag&os.O_TRUNC != 0 {
+		// 第一次打开的文件，已有的数据都视为已经持久化
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		fs.synced[name] = info.Size()
+	}
+	return &file{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *FS) Rename(oldPath, newPath string) error {
+	if err := fs.checkFault(); err != nil {
+		return err
+	}
+	if err := fs.base.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for name, size := range fs.synced {
+		if name == oldPath {
+			delete(fs.synced, name)
+			fs.synced[newPath] = size
+		} else if strings.HasPrefix(name, oldPath+string(filepath.Separator)) {
+			delete(fs.synced, name)
+			fs.synced[newPath+strings.TrimPrefix(name, oldPath)] = size
+		}
+	}
+	return nil
+}
+
+// Link 新的路径和原文件共享数据，已经持久化的数据大小也相同
+func (fs *FS) Link(oldPath, newPath string) error {
+	if err := fs.checkFault(); err != nil {
+		return err
+	}
+	if err := fs.base.Link(oldPath, newPath); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if size, ok := fs.synced[filepath.Clean(oldPath)]; ok {
+		fs.synced[filepath.Clean(newPath)] = size
+	}
+	return nil
+}
+
+func (fs *FS) Remove(name string) error {
+	if err := fs.checkFault(); err != nil {
+		return err
+	}
+	if err := fs.base.Remove(name); err != nil {
+		return err
+	}
+	fs.forget(name)
+	return nil
+}
+
+func (fs *FS) RemoveAll(path string) error {
+	if err := fs.checkFault(); err != nil {
+		return err
+	}
+	if err := fs.base.RemoveAll(path); err != nil {
+		return err
+	}
+	fs.forget(path)
+	return nil
+}
+
+// forget 删除 path 以及其下所有文件的持久化记录，之后同名的新文件重新开始记录
+func (fs *FS) forget(path string) {
+	path = filepath.Clean(path)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for name := range fs.synced {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			delete(fs.synced, name)
+		}
+	}
+}
+
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.checkFault(); err != nil {
+		return err
+	}
+	return fs.base.MkdirAll(path, perm)
+}
+
+func (fs *FS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := fs.checkFault(); err != nil {
+		return nil, err
+	}
+	return fs.base.ReadDir(name)
+}
+
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.checkFault(); err != nil {
+		return nil, err
+	}
+	return fs.base.Stat(name)
+}
+
+func (fs *FS) Lock(name string) (fio.FileLock, error) {
+	if err := fs.checkFault(); err != nil {
+		return nil, err
+	}
+	fl, err := fs.base.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.locks = append(fs.locks, fl)
+	return fl, nil
+}
+
+// Base 被包装的文件系统
+func (fs *FS) Base() fio.FileSystem {
+	return fs.base
+}
+
+func (fs *FS) AvailableSize(path string) (uint64, error) {
+	if err := fs.checkFault(); err != nil {
+		return 0, err
+	}
+	return fs.base.AvailableSize(path)
+}
+
+// file 故障注入文件系统中打开的文件
+type file struct {
+	fio.File
+	fs   *FS
+	name string
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.fs.checkFault(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(b, off)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	fault, err := f.fs.step()
+	if err != nil {
+		return 0, err
+	}
+	if fault == ShortWrite {
+		n, err := f.File.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrInjected
+	}
+	return f.File.Write(b)
+}
+
+// Sync 持久化文件当前的全部数据
+func (f *file) Sync() error {
+	if err := f.fs.checkFault(); err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	f.fs.synced[f.name] = info.Size()
+	return nil
+}
+
+func (f *file) Truncate(size int64) error {
+	if err := f.fs.checkFault(); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if synced, ok := f.fs.synced[f.name]; ok && synced > size {
+		f.fs.synced[f.name] = size
+	}
+	return nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	if err := f.fs.checkFault(); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
@@ -0,0 +1,94 @@
+package faultfs
+
+import (
+	"bitcask-go/fio"
+	"bitcask-go/fio/memfs"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func openTestFile(t *testing.T, fs *FS) fio.File {
+	f, err := fs.OpenFile("/a.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, fio.DateFilePerm)
+	assert.Nil(t, err)
+	return f
+}
+
+func TestFS_Inject(t *testing.T) {
+	fs := New(memfs.New())
+	f := openTestFile(t, fs)
+	assert.Equal(t, int64(1), fs.Ops())
+
+	fs.Inject(2, Error)
+	fs.Inject(3, ShortWrite)
+	n, err := f.Write([]byte("hello"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrInjected, err)
+	n, err = f.Write([]byte("hello"))
+	assert.Equal(t, 2, n)
+	assert.Equal(t, ErrInjected, err)
+
+	// 故障只会触发一次
+	n, err = f.Write([]byte("kv"))
+	assert.Equal(t, 2, n)
+	assert.Nil(t, err)
+	info, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+}
+
+func TestFS_PowerLoss(t *testing.T) {
+	fs := New(memfs.New())
+	lock, err := fs.Lock("/flock")
+	assert.Nil(t, err)
+	hold, err := lock.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	f := openTestFile(t, fs)
+	_, err = f.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.Write([]byte("-unsynced"))
+	assert.Nil(t, err)
+
+	fs.Inject(fs.Ops()+1, PowerLoss)
+	_, err = f.Write([]byte("lost"))
+	assert.Equal(t, ErrPowerLoss, err)
+	assert.True(t, fs.Down())
+	assert.Equal(t, ErrPowerLoss, f.Sync())
+	_, err = fs.Stat("/a.data")
+	assert.Equal(t, ErrPowerLoss, err)
+
+	// 重启之后没有持久化的数据被丢弃，文件锁被释放
+	assert.Nil(t, fs.Restart())
+	assert.False(t, fs.Down())
+	f2 := openTestFile(t, fs)
+	b := make([]byte, 32)
+	n, _ := f2.ReadAt(b, 0)
+	assert.Equal(t, "synced", string(b[:n]))
+
+	lock2, err := fs.Lock("/flock")
+	assert.Nil(t, err)
+	hold, err = lock2.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+}
+
+func TestFS_Rename(t *testing.T) {
+	fs := New(memfs.New())
+	assert.Nil(t, fs.MkdirAll("/merge", os.ModePerm))
+	f, err := fs.OpenFile("/merge/1.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, fio.DateFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("merged"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Close())
+
+	// 重命名之后仍然保留持久化的数据
+	assert.Nil(t, fs.Rename("/merge/1.data", "/1.data"))
+	assert.Nil(t, fs.Restart())
+	info, err := fs.Stat("/1.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+}
@@ -4,12 +4,17 @@ import "os"
 
 // FileIO 标准系统文件 IO
 type FileIO struct {
-	fd *os.File
+	fd File
 }
 
 // NewFileIOManager 创建文件IO
 func NewFileIOManager(fileName string) (*FileIO, error) {
-	fd, err := os.OpenFile(
+	return newFileIOManager(OSFileSystem, fileName)
+}
+
+// newFileIOManager 在指定的文件系统上创建文件IO
+func newFileIOManager(fs FileSystem, fileName string) (*FileIO, error) {
+	fd, err := fs.OpenFile(
 		fileName,
 		os.O_CREATE|os.O_RDWR|os.O_APPEND,
 		DateFilePerm,
@@ -43,3 +48,15 @@ func (fio *FileIO) Size() (int64, error) {
 	}
 	return stat.Size(), nil
 }
+
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
+// Allocate 只有操作系统的文件支持预分配，其他文件系统上忽略
+func (fio *FileIO) Allocate(size int64) error {
+	if fd, ok := fio.fd.(*os.File); ok {
+		return preallocate(fd, size)
+	}
+	return nil
+}
@@ -23,6 +23,14 @@ func TestNewFileIOManager(t *testing.T) {
 	assert.NotNil(t, fio)
 }
 
+func TestNewIOManager_UnsupportedIOType(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bitcask-go-unsupported-io-type.data")
+	defer destoryFile(path)
+	ioManager, err := NewIOManager(OSFileSystem, path, DirectIO+1)
+	assert.Equal(t, ErrUnsupportedIOType, err)
+	assert.Nil(t, ioManager)
+}
+
 func TestFileIO_Write(t *testing.T) {
 	path := filepath.Join(DataBasePath, "a.data")
 	fio, err := NewFileIOManager(path)
@@ -94,3 +102,28 @@ func TestFileIO_Close(t *testing.T) {
 	assert.Nil(t, err)
 
 }
+
+func TestFileIO_Allocate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocate.data")
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+
+	// 预分配不改变文件大小，写入依然从文件末尾开始
+	err = fio.Allocate(1024 * 1024)
+	assert.Nil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	size, err = fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	b := make([]byte, 5)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-a", string(b))
+	assert.Nil(t, fio.Close())
+}
@@ -0,0 +1,106 @@
+package fio
+
+import (
+	"github.com/gofrs/flock"
+	"io"
+	"os"
+	"syscall"
+)
+
+// FileSystem 文件系统接口，数据目录中所有的文件操作都通过它完成
+type FileSystem interface {
+	// OpenFile 按照 flag 和 perm 打开文件，和 os.OpenFile 语义相同
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldPath, newPath string) error
+	// Link 为 oldPath 创建硬链接 newPath，newPath 已经存在时返回错误
+	Link(oldPath, newPath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir 读取目录下的所有文件和子目录，按文件名排序
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	// Lock 获取 name 对应的文件锁，用于保证多个进程之间的互斥
+	Lock(name string) (FileLock, error)
+	// AvailableSize 获取 path 所在文件系统剩余的可用空间
+	AvailableSize(path string) (uint64, error)
+}
+
+// File 文件系统中打开的文件
+type File interface {
+	io.ReaderAt
+	io.Writer
+	Sync() error
+	Close() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// FileLock 文件锁
+type FileLock interface {
+	// TryLock 尝试获取锁，锁已经被占用时返回 false
+	TryLock() (bool, error)
+	Unlock() error
+}
+
+// OSFileSystem 操作系统的文件系统
+var OSFileSystem FileSystem = osFileSystem{}
+
+// IsOSFileSystem fs 中的文件是否直接保存在操作系统的文件系统上
+// 包装其他文件系统的实现（例如故障注入文件系统）通过 Base 方法返回被包装的文件系统
+func IsOSFileSystem(fs FileSystem) bool {
+	for fs != OSFileSystem {
+		wrapper, ok := fs.(interface{ Base() FileSystem })
+		if !ok {
+			return false
+		}
+		fs = wrapper.Base()
+	}
+	return true
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osFileSystem) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) Lock(name string) (FileLock, error) {
+	return flock.New(name), nil
+}
+
+func (osFileSystem) AvailableSize(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -1,7 +1,11 @@
 package fio
 
+import "errors"
+
 const DateFilePerm = 0644
 
+var ErrUnsupportedIOType = errors.New("unsupported io type")
+
 type FileIOType = byte
 
 const (
@@ -9,6 +13,8 @@ const (
 	StandardIO FileIOType = iota
 	// Memory Map 映射文件 IO
 	MemoryMap
+	// DirectIO 绕过页缓存的直接 IO
+	DirectIO
 )
 
 // IOManager IO 管理器
@@ -19,16 +25,26 @@ type IOManager interface {
 	Close() error
 	// Size 获取文件大小
 	Size() (int64, error)
+	// Truncate 将文件截断为 size 大小，之后的写入从 size 处开始
+	Truncate(size int64) error
+	// Allocate 预先分配 size 大小的空间，不改变 Size 返回的数据大小
+	Allocate(size int64) error
 }
 
-// NewIOManager 初始化 IOManager，目前仅支持标准 FileIO
-func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
+// NewIOManager 初始化 IOManager
+// 内存映射和直接 IO 依赖操作系统的文件描述符，其他文件系统上统一使用标准文件 IO
+func NewIOManager(fs FileSystem, fileName string, ioType FileIOType) (IOManager, error) {
+	if fs != OSFileSystem {
+		return newFileIOManager(fs, fileName)
+	}
 	switch ioType {
 	case StandardIO:
 		return NewFileIOManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case DirectIO:
+		return NewDirectIOManager(fileName)
 	default:
-		panic("unsupported io type")
+		return nil, ErrUnsupportedIOType
 	}
 }
@@ -0,0 +1,417 @@
+package memfs
+
+// 内存文件系统
+// 所有的文件都保存在内存中，进程退出之后数据即丢失，用于测试和临时数据库
+
+import (
+	"bitcask-go/fio"
+	"io"
+	iofs "io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FS 内存文件系统
+type FS struct {
+	lock  *sync.RWMutex
+	files map[string]*fileData // 文件路径 -> 文件内容
+	dirs  map[string]time.Time // 目录路径 -> 修改时间
+	locks map[string]bool      // 已经被占用的文件锁
+}
+
+// New 创建一个空的内存文件系统
+func New() *FS {
+	return &FS{
+		lock:  new(sync.RWMutex),
+		files: make(map[string]*fileData),
+		dirs:  map[string]time.Time{string(filepath.Separator): time.Now()},
+		locks: make(map[string]bool),
+	}
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (fio.File, error) {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fd, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		if _, isDir := fs.dirs[name]; isDir {
+			return nil, pathError("open", name, syscall.EISDIR)
+		}
+		return nil, pathError("open", name, os.ErrNotExist)
+	case !ok:
+		if _, isDir := fs.dirs[filepath.Dir(name)]; !isDir {
+			return nil, pathError("open", name, os.ErrNotExist)
+		}
+		fd = &fileData{lock: new(sync.RWMutex), mode: perm, modTime: time.Now()}
+		fs.files[name] = fd
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		fd.truncate(0)
+	}
+	return &file{name: name, data: fd, flag: flag}, nil
+}
+
+func (fs *FS) Rename(oldPath, newPath string) error {
+	oldPath, newPath = clean(oldPath), clean(newPath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, isDir := fs.dirs[filepath.Dir(newPath)]; !isDir {
+		return linkError("rename", oldPath, newPath, os.ErrNotExist)
+	}
+
+	// 重命名文件，会覆盖已经存在的文件
+	if fd, ok := fs.files[oldPath]; ok {
+		if _, isDir := fs.dirs[newPath]; isDir {
+			return linkError("rename", oldPath, newPath, os.ErrExist)
+		}
+		delete(fs.files, oldPath)
+		fs.files[newPath] = fd
+		return nil
+	}
+
+	// 重命名目录，目录下的所有文件跟着移动
+	if _, ok := fs.dirs[oldPath]; !ok {
+		return linkError("rename", oldPath, newPath, os.ErrNotExist)
+	}
+	if _, ok := fs.files[newPath]; ok {
+		return linkError("rename", oldPath, newPath, os.ErrExist)
+	}
+	for dir, modTime := range fs.dirs {
+		if rel, ok := relative(oldPath, dir); ok {
+			delete(fs.dirs, dir)
+			fs.dirs[filepath.Join(newPath, rel)] = modTime
+		}
+	}
+	for name, fd := range fs.files {
+		if rel, ok := relative(oldPath, name); ok {
+			delete(fs.files, name)
+			fs.files[filepath.Join(newPath, rel)] = fd
+		}
+	}
+	return nil
+}
+
+// Link 新的路径和原文件共享同一份数据，不能链接目录
+func (fs *FS) Link(oldPath, newPath string) error {
+	oldPath, newPath = clean(oldPath), clean(newPath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fd, ok := fs.files[oldPath]
+	if !ok {
+		return linkError("link", oldPath, newPath, os.ErrNotExist)
+	}
+	if _, isDir := fs.dirs[filepath.Dir(newPath)]; !isDir {
+		return linkError("link", oldPath, newPath, os.ErrNotExist)
+	}
+	_, fileExists := fs.files[newPath]
+	_, dirExists := fs.dirs[newPath]
+	if fileExists || dirExists {
+		return linkError("link", oldPath, newPath, os.ErrExist)
+	}
+	fs.files[newPath] = fd
+	return nil
+}
+
+func (fs *FS) Remove(name string) error {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if len(fs.children(name)) > 0 {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *FS) RemoveAll(path string) error {
+	path = clean(path)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for dir := range fs.dirs {
+		if _, ok := relative(path, dir); ok || dir == path {
+			delete(fs.dirs, dir)
+		}
+	}
+	for name := range fs.files {
+		if _, ok := relative(path, name); ok || name == path {
+			delete(fs.files, name)
+		}
+	}
+	return nil
+}
+
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	path = clean(path)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return pathError("mkdir", dir, syscall.ENOTDIR)
+		}
+		if _, ok := fs.dirs[dir]; ok {
+			break
+		}
+		fs.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (fs *FS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	if _, ok := fs.dirs[name]; !ok {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	children := fs.children(name)
+	entries := make([]os.DirEntry, 0, len(children))
+	for _, child := range children {
+		info, _ := fs.stat(child)
+		entries = append(entries, iofs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.stat(name)
+}
+
+// Lock 内存文件系统中的锁只在当前进程内有效
+func (fs *FS) Lock(name string) (fio.FileLock, error) {
+	return &fileLock{fs: fs, name: clean(name)}, nil
+}
+
+// AvailableSize 内存文件系统不限制容量
+func (fs *FS) AvailableSize(path string) (uint64, error) {
+	return math.MaxInt64, nil
+}
+
+func (fs *FS) stat(name string) (os.FileInfo, error) {
+	if fd, ok := fs.files[name]; ok {
+		return fd.stat(name), nil
+	}
+	if modTime, ok := fs.dirs[name]; ok {
+		return &fileInfo{name: filepath.Base(name), mode: os.ModeDir | os.ModePerm, modTime: modTime}, nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+// children 获取目录下直接包含的文件和子目录
+func (fs *FS) children(dir string) []string {
+	var children []string
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	return children
+}
+
+// fileData 文件的内容，同一个文件可以被多次打开
+type fileData struct {
+	lock    *sync.RWMutex
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fd *fileData) truncate(size int64) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	if size <= int64(len(fd.data)) {
+		fd.data = fd.data[:size]
+	} else {
+		fd.data = append(fd.data, make([]byte, size-int64(len(fd.data)))...)
+	}
+	fd.modTime = time.Now()
+}
+
+func (fd *fileData) stat(name string) os.FileInfo {
+	fd.lock.RLock()
+	defer fd.lock.RUnlock()
+	return &fileInfo{name: filepath.Base(name), size: int64(len(fd.data)), mode: fd.mode, modTime: fd.modTime}
+}
+
+// file 打开的内存文件
+type file struct {
+	name   string
+	data   *fileData
+	flag   int
+	offset int64 // 非追加模式下的写入位置
+	closed bool
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, pathError("read", f.name, os.ErrClosed)
+	}
+	f.data.lock.RLock()
+	defer f.data.lock.RUnlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, pathError("write", f.name, os.ErrClosed)
+	}
+	f.data.lock.Lock()
+	defer f.data.lock.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+	end := f.offset + int64(len(b))
+	if end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	copy(f.data.data[f.offset:end], b)
+	f.offset = end
+	f.data.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *file) Sync() error {
+	if f.closed {
+		return pathError("sync", f.name, os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return pathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, pathError("stat", f.name, os.ErrClosed)
+	}
+	return f.data.stat(f.name), nil
+}
+
+func (f *file) Truncate(size int64) error {
+	if f.closed {
+		return pathError("truncate", f.name, os.ErrClosed)
+	}
+	f.data.truncate(size)
+	return nil
+}
+
+// fileInfo 实现 os.FileInfo
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return nil }
+
+// fileLock 进程内的文件锁
+type fileLock struct {
+	fs     *FS
+	name   string
+	locked bool
+}
+
+func (fl *fileLock) TryLock() (bool, error) {
+	fl.fs.lock.Lock()
+	defer fl.fs.lock.Unlock()
+	if fl.locked {
+		return true, nil
+	}
+	if fl.fs.locks[fl.name] {
+		return false, nil
+	}
+	fl.fs.locks[fl.name] = true
+	fl.locked = true
+	return true, nil
+}
+
+func (fl *fileLock) Unlock() error {
+	fl.fs.lock.Lock()
+	defer fl.fs.lock.Unlock()
+	if fl.locked {
+		delete(fl.fs.locks, fl.name)
+		fl.locked = false
+	}
+	return nil
+}
+
+func clean(name string) string {
+	name = filepath.Clean(name)
+	if !filepath.IsAbs(name) {
+		name = string(filepath.Separator) + name
+	}
+	return name
+}
+
+// relative 判断 name 是否在目录 dir 之下，返回相对路径
+func relative(dir, name string) (string, bool) {
+	prefix := dir + string(filepath.Separator)
+	if dir == string(filepath.Separator) {
+		prefix = dir
+	}
+	if !strings.HasPrefix(name, prefix) || name == dir {
+		return "", false
+	}
+	return strings.TrimPrefix(name, prefix), true
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+func linkError(op, oldPath, newPath string, err error) error {
+	return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: err}
+}
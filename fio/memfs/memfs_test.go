@@ -0,0 +1,190 @@
+package memfs
+
+import (
+	"bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestFS_OpenFile(t *testing.T) {
+	fs := New()
+
+	// 父目录不存在
+	_, err := fs.OpenFile("/a/b.data", os.O_CREATE|os.O_RDWR, fio.DateFilePerm)
+	assert.True(t, os.IsNotExist(err))
+
+	err = fs.MkdirAll("/a", os.ModePerm)
+	assert.Nil(t, err)
+	_, err = fs.OpenFile("/a/b.data", os.O_RDWR, fio.DateFilePerm)
+	assert.True(t, os.IsNotExist(err))
+
+	f, err := fs.OpenFile("/a/b.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, fio.DateFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(" bitcask"))
+	assert.Nil(t, err)
+
+	// 同一个文件再次打开，读到的是相同的内容
+	f2, err := fs.OpenFile("/a/b.data", os.O_RDWR, fio.DateFilePerm)
+	assert.Nil(t, err)
+	b := make([]byte, 7)
+	n, err := f2.ReadAt(b, 6)
+	assert.Equal(t, 7, n)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), b)
+
+	n, err = f2.ReadAt(b, 10)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, io.EOF, err)
+
+	info, err := f2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), info.Size())
+	assert.Equal(t, "b.data", info.Name())
+
+	err = f2.Truncate(5)
+	assert.Nil(t, err)
+	info, err = fs.Stat("/a/b.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	assert.Nil(t, f.Close())
+	_, err = f.Write([]byte("closed"))
+	assert.NotNil(t, err)
+
+	// O_TRUNC 清空文件
+	f3, err := fs.OpenFile("/a/b.data", os.O_CREATE|os.O_TRUNC|os.O_RDWR, fio.DateFilePerm)
+	assert.Nil(t, err)
+	info, err = f3.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestFS_ReadDir(t *testing.T) {
+	fs := New()
+	err := fs.MkdirAll("/db/sub", os.ModePerm)
+	assert.Nil(t, err)
+	for _, name := range []string{"/db/2.data", "/db/1.data", "/db/sub/3.data"} {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR, fio.DateFilePerm)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+
+	entries, err := fs.ReadDir("/db")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "1.data", entries[0].Name())
+	assert.Equal(t, "2.data", entries[1].Name())
+	assert.Equal(t, "sub", entries[2].Name())
+	assert.True(t, entries[2].IsDir())
+
+	_, err = fs.ReadDir("/not-exist")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFS_Rename_Remove(t *testing.T) {
+	fs := New()
+	err := fs.MkdirAll("/db-merge", os.ModePerm)
+	assert.Nil(t, err)
+	err = fs.MkdirAll("/db", os.ModePerm)
+	assert.Nil(t, err)
+	f, err := fs.OpenFile("/db-merge/1.data", os.O_CREATE|os.O_RDWR, fio.DateFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("merged"))
+	assert.Nil(t, err)
+
+	err = fs.Rename("/db-merge/1.data", "/db/1.data")
+	assert.Nil(t, err)
+	_, err = fs.Stat("/db-merge/1.data")
+	assert.True(t, os.IsNotExist(err))
+	info, err := fs.Stat("/db/1.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+
+	// 非空目录不能直接删除
+	err = fs.Remove("/db")
+	assert.NotNil(t, err)
+	err = fs.Remove("/db/1.data")
+	assert.Nil(t, err)
+	err = fs.Remove("/db")
+	assert.Nil(t, err)
+
+	err = fs.RemoveAll("/db-merge")
+	assert.Nil(t, err)
+	_, err = fs.Stat("/db-merge")
+	assert.True(t, os.IsNotExist(err))
+	err = fs.RemoveAll("/not-exist")
+	assert.Nil(t, err)
+}
+
+func TestFS_Link(t *testing.T) {
+	fs := New()
+	err := fs.MkdirAll("/db", os.ModePerm)
+	assert.Nil(t, err)
+	f, err := fs.OpenFile("/db/1.data", os.O_CREATE|os.O_RDWR, fio.DateFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("data"))
+	assert.Nil(t, err)
+
+	// 链接和原文件共享数据，删除原文件之后链接仍然可以读取
+	err = fs.Link("/db/1.data", "/db/2.data")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("-more"))
+	assert.Nil(t, err)
+	err = fs.Remove("/db/1.data")
+	assert.Nil(t, err)
+	info, err := fs.Stat("/db/2.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), info.Size())
+
+	err = fs.Link("/db/1.data", "/db/3.data")
+	assert.True(t, os.IsNotExist(err))
+	err = fs.Link("/db/2.data", "/db")
+	assert.True(t, os.IsExist(err))
+	err = fs.Link("/db/2.data", "/not-exist/2.data")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFS_Lock(t *testing.T) {
+	fs := New()
+	lock1, err := fs.Lock("/db/flock")
+	assert.Nil(t, err)
+	lock2, err := fs.Lock("/db/flock")
+	assert.Nil(t, err)
+
+	hold, err := lock1.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+	hold, err = lock2.TryLock()
+	assert.Nil(t, err)
+	assert.False(t, hold)
+
+	assert.Nil(t, lock1.Unlock())
+	hold, err = lock2.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, hold)
+}
+
+func TestFS_IOManager(t *testing.T) {
+	fs := New()
+	err := fs.MkdirAll("/db", os.ModePerm)
+	assert.Nil(t, err)
+
+	// 内存文件系统上总是使用标准 IO
+	ioManager, err := fio.NewIOManager(fs, "/db/1.data", fio.MemoryMap)
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	size, err := ioManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	b := make([]byte, 5)
+	_, err = ioManager.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	assert.Nil(t, ioManager.Close())
+}
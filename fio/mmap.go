@@ -1,43 +1,152 @@
 package fio
 
 import (
-	"golang.org/x/exp/mmap"
+	"golang.org/x/sys/unix"
+	"io"
 	"os"
 )
 
+const (
+	mmapMinGrowSize = 64 * 1024        // 映射区域每次至少扩展 64KB
+	mmapMaxGrowSize = 64 * 1024 * 1024 // 映射区域每次最多扩展 64MB
+)
+
+// MMap 内存文件映射 IO，写入时按块扩展文件并重新映射
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	fd   *os.File
+	data []byte // 映射的内存区域，长度即为文件当前的大小
+	size int64  // 已经写入的数据大小，文件中超出的部分是预先分配的空间
 }
 
 // NewMMapIOManager 初始化 MMap IO
 func NewMMapIOManager(fileName string) (*MMap, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DateFilePerm)
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DateFilePerm)
 	if err != nil {
 		return nil, err
 	}
-	reader, err := mmap.Open(fileName)
+	stat, err := fd.Stat()
 	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	mp := &MMap{fd: fd, size: stat.Size()}
+	if err := mp.remap(stat.Size()); err != nil {
+		_ = fd.Close()
 		return nil, err
 	}
-	return &MMap{readerAt: reader}, nil
+	return mp, nil
 }
 
 func (mp *MMap) Read(bytes []byte, offset int64) (int, error) {
-	return mp.readerAt.ReadAt(bytes, offset)
+	if offset >= mp.size {
+		return 0, io.EOF
+	}
+	n := copy(bytes, mp.data[offset:mp.size])
+	if n < len(bytes) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 func (mp *MMap) Write(bytes []byte) (int, error) {
-	panic("implement me")
+	end := mp.size + int64(len(bytes))
+	if end > int64(len(mp.data)) {
+		if err := mp.grow(end); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(mp.data[mp.size:end], bytes)
+	mp.size += int64(n)
+	return n, nil
 }
 
 func (mp *MMap) Sync() error {
-	panic("implement me")
+	if mp.size == 0 {
+		return nil
+	}
+	return unix.Msync(mp.data, unix.MS_SYNC)
 }
 
+// Close 解除映射，并截断文件中没有使用的预分配空间
 func (mp *MMap) Close() error {
-	return mp.readerAt.Close()
+	if err := mp.unmap(); err != nil {
+		return err
+	}
+	if err := mp.fd.Truncate(mp.size); err != nil {
+		return err
+	}
+	return mp.fd.Close()
 }
 
 func (mp *MMap) Size() (int64, error) {
-	return int64(mp.readerAt.Len()), nil
+	return mp.size, nil
+}
+
+func (mp *MMap) Truncate(size int64) error {
+	if size > int64(len(mp.data)) {
+		if err := mp.grow(size); err != nil {
+			return err
+		}
+	}
+	// 截断部分清零，保证之后读到的是空的数据
+	clear(mp.data[size:])
+	mp.size = size
+	return nil
+}
+
+// Allocate 扩展映射区域，文件中超出数据大小的部分是全零的预分配空间
+func (mp *MMap) Allocate(size int64) error {
+	if size <= int64(len(mp.data)) {
+		return nil
+	}
+	if err := allocate(mp.fd, size); err != nil {
+		return err
+	}
+	if err := mp.unmap(); err != nil {
+		return err
+	}
+	return mp.remap(size)
+}
+
+// grow 扩展文件，使其至少可以容纳 size 字节的数据，并重新映射
+func (mp *MMap) grow(size int64) error {
+	capacity := int64(len(mp.data))
+	growSize := min(max(capacity, mmapMinGrowSize), mmapMaxGrowSize)
+	newCapacity := max(capacity+growSize, size)
+
+	// 按页对齐
+	pageSize := int64(os.Getpagesize())
+	newCapacity = (newCapacity + pageSize - 1) / pageSize * pageSize
+
+	if err := allocate(mp.fd, newCapacity); err != nil {
+		return err
+	}
+	if err := mp.unmap(); err != nil {
+		return err
+	}
+	return mp.remap(newCapacity)
+}
+
+func (mp *MMap) remap(size int64) error {
+	if size == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(int(mp.fd.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	mp.data = data
+	return nil
+}
+
+func (mp *MMap) unmap() error {
+	if mp.data == nil {
+		return nil
+	}
+	if err := unix.Munmap(mp.data); err != nil {
+		return err
+	}
+	mp.data = nil
+	return nil
 }
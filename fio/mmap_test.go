@@ -1,8 +1,10 @@
 package fio
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -46,3 +48,130 @@ func TestMMap_Read(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, int64(n2+n3), size)
 }
+
+func TestMMap_Write(t *testing.T) {
+	path := filepath.Join(DataBasePath, "mmap-b.data")
+	mmapIO, err := NewMMapIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, mmapIO)
+
+	n, err := mmapIO.Write([]byte(""))
+	assert.Equal(t, 0, n)
+	assert.Nil(t, err)
+
+	n, err = mmapIO.Write([]byte("key_a"))
+	assert.Equal(t, 5, n)
+	assert.Nil(t, err)
+
+	// 超过一次扩展的大小，需要多次重新映射
+	value := bytes.Repeat([]byte("v"), 3*mmapMinGrowSize)
+	n, err = mmapIO.Write(value)
+	assert.Equal(t, len(value), n)
+	assert.Nil(t, err)
+
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5+len(value)), size)
+
+	b := make([]byte, 5)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_a", string(b))
+	b2 := make([]byte, len(value))
+	_, err = mmapIO.Read(b2, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, value, b2)
+
+	// 读取超过已写入的数据
+	n, err = mmapIO.Read(make([]byte, 10), size-5)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMMap_Sync_Close(t *testing.T) {
+	path := filepath.Join(DataBasePath, "mmap-c.data")
+	mmapIO, err := NewMMapIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+
+	_, err = mmapIO.Write([]byte("key_a"))
+	assert.Nil(t, err)
+	err = mmapIO.Sync()
+	assert.Nil(t, err)
+
+	// 预分配的空间在关闭时被截断
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Greater(t, stat.Size(), int64(5))
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+
+	// 重新打开之后继续追加写入
+	mmapIO, err = NewMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = mmapIO.Write([]byte("key_b"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_akey_b", string(b))
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+}
+
+func TestMMap_Truncate(t *testing.T) {
+	path := filepath.Join(DataBasePath, "mmap-d.data")
+	mmapIO, err := NewMMapIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+
+	_, err = mmapIO.Write([]byte("key_akey_b"))
+	assert.Nil(t, err)
+	err = mmapIO.Truncate(5)
+	assert.Nil(t, err)
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	_, err = mmapIO.Write([]byte("key_c"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key_akey_c", string(b))
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+}
+
+func TestMMap_Allocate(t *testing.T) {
+	path := filepath.Join("/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database", "mmap-allocate.data")
+	mmapIO, err := NewMMapIOManager(path)
+	defer destoryFile(path)
+	assert.Nil(t, err)
+
+	err = mmapIO.Allocate(1024 * 1024)
+	assert.Nil(t, err)
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	// 预分配的空间都在文件中，数据大小之后的部分全是零
+	_, err = mmapIO.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	err = mmapIO.Sync()
+	assert.Nil(t, err)
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024*1024), stat.Size())
+
+	// 关闭时截断预分配的空间
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+}
@@ -84,7 +84,12 @@ func handleListKeys(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	keys := db.ListKeys()
+	keys, err := db.ListKeys()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to list keys: %v", err)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	var res []string
 	for _, key := range keys {
@@ -99,7 +104,12 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	stat := db.Stat()
+	stat, err := db.Stat()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to get stat: %v", err)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(writer).Encode(stat)
 }
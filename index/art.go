@@ -5,67 +5,257 @@ import (
 	"bytes"
 	"sort"
 	"sync"
-)
-
-import (
-	goart "github.com/plar/go-adaptive-radix-tree"
+	"unsafe"
 )
 
 // AdaptiveRadixTree 自适应基数树索引
-// 主要封装了 https://github.com/plar/go-adaptive-radix-tree 库
+// 内部节点使用路径压缩，每个节点只保存从父节点到它的一段 key，具有公共前缀的 key 共享前缀的内存，
+// 子节点按照第一个字节有序保存在数组中，数组的大小随着子节点的数量变化。
+// key 的片段保存在 arena 中，位置索引直接保存在节点中，不需要为每次写入单独分配内存
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex
+	root  *artNode
+	size  int   // key 的数量
+	nodes int64 // 除根节点之外的节点数量
+	lock  *sync.RWMutex
+	arena *keyArena
 }
 
+// artNode 基数树的节点
+type artNode struct {
+	prefix   string     // 从父节点到这个节点的 key 片段，保存在 arena 中
+	labels   []byte     // 每个子节点 prefix 的第一个字节，从小到大排列
+	children []*artNode // 和 labels 一一对应的子节点
+	pos      packedPos  // 位置索引，leaf 为 true 时有效
+	leaf     bool       // 从根节点到这个节点的路径是否是一个 key
+}
+
+// artNodeSize 每个节点大约占用的内存：节点本身和它在父节点中的 label 与指针，不包括 key 片段
+const artNodeSize = int64(unsafe.Sizeof(artNode{})) + 9
+
 // NewART 创建一个空的自适应基数树索引
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
-		lock: new(sync.RWMutex),
+		root:  &artNode{},
+		lock:  new(sync.RWMutex),
+		arena: newKeyArena(),
 	}
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	art.lock.Lock()
-	oldValue, _ := art.tree.Insert(key, pos)
-	art.lock.Unlock()
-	if oldValue == nil {
+// child 查找第一个字节为 b 的子节点，返回它应该在的位置和是否存在
+func (n *artNode) child(b byte) (int, bool) {
+	i := sort.Search(len(n.labels), func(i int) bool {
+		return n.labels[i] >= b
+	})
+	return i, i < len(n.labels) && n.labels[i] == b
+}
+
+func (n *artNode) insertChild(i int, child *artNode) {
+	n.labels = append(n.labels, 0)
+	copy(n.labels[i+1:], n.labels[i:])
+	n.labels[i] = child.prefix[0]
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *artNode) removeChild(i int) {
+	n.labels = append(n.labels[:i], n.labels[i+1:]...)
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// search 查找 key 对应的节点，不存在时返回 nil
+func (art *AdaptiveRadixTree) search(key []byte) *artNode {
+	node := art.root
+	for len(key) > 0 {
+		i, ok := node.child(key[0])
+		if !ok {
+			return nil
+		}
+		node = node.children[i]
+		if !bytes.HasPrefix(key, bytesOf(node.prefix)) {
+			return nil
+		}
+		key = key[len(node.prefix):]
+	}
+	if !node.leaf {
 		return nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return node
+}
+
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	// 已经存在的 key 直接更新位置索引，不需要修改树
+	if node := art.search(key); node != nil {
+		oldPos := node.pos.unpack()
+		node.pos = packPos(pos)
+		return oldPos, nil
+	}
+
+	node := art.root
+	for len(key) > 0 {
+		i, ok := node.child(key[0])
+		if !ok {
+			// 剩下的 key 作为新的子节点，只有这一段需要复制到 arena 中
+			node.insertChild(i, &artNode{prefix: art.arena.alloc(key), pos: packPos(pos), leaf: true})
+			art.nodes++
+			art.size++
+			return nil, nil
+		}
+		child := node.children[i]
+		n := commonPrefixLen(child.prefix, key)
+		if n < len(child.prefix) {
+			// 只匹配了子节点的一部分，把公共部分分裂成新的中间节点，两个节点共用原来 key 片段的内存
+			mid := &artNode{
+				prefix:   child.prefix[:n],
+				labels:   []byte{child.prefix[n]},
+				children: []*artNode{child},
+			}
+			child.prefix = child.prefix[n:]
+			node.children[i] = mid
+			art.nodes++
+			child = mid
+		}
+		node = child
+		key = key[n:]
+	}
+	node.pos = packPos(pos)
+	node.leaf = true
+	art.size++
+	return nil, nil
+}
+
+// commonPrefixLen prefix 和 key 的公共前缀长度
+func commonPrefixLen(prefix string, key []byte) int {
+	n := min(len(prefix), len(key))
+	for i := 0; i < n; i++ {
+		if prefix[i] != key[i] {
+			return i
+		}
+	}
+	return n
 }
 
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
-	if !found {
-		return nil
+	node := art.search(key)
+	if node == nil {
+		return nil, nil
 	}
-	return value.(*data.LogRecordPos)
+	return node.pos.unpack(), nil
 }
 
-func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	art.lock.Lock()
-	oldValue, deleted := art.tree.Delete(key)
-	art.lock.Unlock()
-	if oldValue == nil {
-		return nil, false
+	defer art.lock.Unlock()
+	var parent *artNode
+	var index int
+	node := art.root
+	for len(key) > 0 {
+		i, ok := node.child(key[0])
+		if !ok {
+			return nil, false, nil
+		}
+		child := node.children[i]
+		if !bytes.HasPrefix(key, bytesOf(child.prefix)) {
+			return nil, false, nil
+		}
+		parent, index, node = node, i, child
+		key = key[len(child.prefix):]
+	}
+	if !node.leaf {
+		return nil, false, nil
+	}
+	oldPos := node.pos.unpack()
+	node.pos = packedPos{}
+	node.leaf = false
+	art.size--
+
+	// 删除没有子节点的节点，只剩一个子节点的节点和子节点合并，保持路径压缩
+	if parent != nil {
+		switch len(node.children) {
+		case 0:
+			parent.removeChild(index)
+			art.arena.free(bytesOf(node.prefix))
+			art.nodes--
+			if parent != art.root && !parent.leaf && len(parent.children) == 1 {
+				art.mergeChild(parent)
+			}
+		case 1:
+			art.mergeChild(node)
+		}
+	}
+	art.compactIfNeeded()
+	return oldPos, true, nil
+}
+
+// mergeChild 把只有一个子节点的节点和子节点合并成一个节点
+func (art *AdaptiveRadixTree) mergeChild(node *artNode) {
+	child := node.children[0]
+	prefix := make([]byte, 0, len(node.prefix)+len(child.prefix))
+	prefix = append(append(prefix, node.prefix...), child.prefix...)
+	art.arena.free(bytesOf(node.prefix))
+	art.arena.free(bytesOf(child.prefix))
+	*node = *child
+	node.prefix = art.arena.alloc(prefix)
+	art.nodes--
+}
+
+// compactIfNeeded 废弃的 key 片段过多时，将所有的 key 片段复制到新的 arena 中
+func (art *AdaptiveRadixTree) compactIfNeeded() {
+	if !art.arena.needCompact() {
+		return
+	}
+	arena := newKeyArena()
+	var copyPrefix func(node *artNode)
+	copyPrefix = func(node *artNode) {
+		node.prefix = arena.alloc(bytesOf(node.prefix))
+		for _, child := range node.children {
+			copyPrefix(child)
+		}
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	copyPrefix(art.root)
+	art.arena = arena
 }
 
-func (art *AdaptiveRadixTree) Size() int {
+// forEach 按照 key 从小到大的顺序遍历，传给 fn 的 key 在遍历过程中会被修改，需要保存时要复制
+func (art *AdaptiveRadixTree) forEach(fn func(key []byte, pos packedPos)) {
+	var key []byte
+	var visit func(node *artNode)
+	visit = func(node *artNode) {
+		key = append(key, node.prefix...)
+		if node.leaf {
+			fn(key, node.pos)
+		}
+		for _, child := range node.children {
+			visit(child)
+		}
+		key = key[:len(key)-len(node.prefix)]
+	}
+	visit(art.root)
+}
+
+func (art *AdaptiveRadixTree) Size() (int, error) {
 	art.lock.RLock()
-	size := art.tree.Size()
+	size := art.size
 	art.lock.RUnlock()
-	return size
+	return size, nil
+}
+
+func (art *AdaptiveRadixTree) MemorySize() int64 {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return art.arena.size + art.nodes*artNodeSize
 }
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+
+func (art *AdaptiveRadixTree) Iterator(reverse bool) (Iterator, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return NewARTIterator(art.tree, reverse)
+	return NewARTIterator(art, reverse), nil
 }
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
@@ -78,19 +268,20 @@ type artIterator struct {
 	values       []*Item // key 和 位置索引
 }
 
-// NewARTIterator 创建一个 art 索引迭代器
-func NewARTIterator(art goart.Tree, reverse bool) *artIterator {
+// NewARTIterator 创建一个 art 索引迭代器，需要持有索引的锁
+// 树中只保存 key 的片段，迭代器中的 key 是拼接之后复制出来的
+func NewARTIterator(art *AdaptiveRadixTree, reverse bool) *artIterator {
 	var idx int
-	values := make([]*Item, art.Size())
+	values := make([]*Item, art.size)
 
 	if reverse {
-		idx = art.Size() - 1
+		idx = art.size - 1
 	}
 
-	saveValues := func(node goart.Node) bool {
+	saveValues := func(key []byte, pos packedPos) {
 		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+			key: append([]byte(nil), key...),
+			pos: pos.unpack(),
 		}
 		values[idx] = item
 		if reverse {
@@ -98,10 +289,9 @@ func NewARTIterator(art goart.Tree, reverse bool) *artIterator {
 		} else {
 			idx++
 		}
-		return true
 	}
 
-	art.ForEach(saveValues)
+	art.forEach(saveValues)
 	return &artIterator{
 		currentIndex: 0,
 		reverse:      reverse,
@@ -8,7 +8,8 @@ import (
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
 	art := NewART()
-	res1 := art.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	res1, err := art.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
 }
@@ -16,44 +17,63 @@ func TestAdaptiveRadixTree_Put(t *testing.T) {
 func TestAdaptiveRadixTree_Get(t *testing.T) {
 	art := NewART()
 	art.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
-	pos := art.Get([]byte("hello"))
+	pos, err := art.Get([]byte("hello"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos)
 
 	// 测试不存在的key
-	pos = art.Get([]byte("hello2"))
+	pos, err = art.Get([]byte("hello2"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 
 	// 重复的key，改变 pos
-	oldValue := art.Put([]byte("hello"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	oldValue, err := art.Put([]byte("hello"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.Nil(t, err)
 	assert.Equal(t, &data.LogRecordPos{1, 1, 0}, oldValue)
-	pos = art.Get([]byte("hello"))
+	pos, err = art.Get([]byte("hello"))
+	assert.Nil(t, err)
 	assert.Equal(t, &data.LogRecordPos{2, 2, 0}, pos)
 }
 
 func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art := NewART()
 	// 删除不存在的key
-	oldValue1, res1 := art.Delete([]byte("notExist"))
+	oldValue1, res1, err := art.Delete([]byte("notExist"))
+	assert.Nil(t, err)
 	assert.False(t, res1)
 	assert.Nil(t, oldValue1)
 
 	// 删除存在的key
 	art.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
-	oldValue2, res2 := art.Delete([]byte("hello"))
+	oldValue2, res2, err := art.Delete([]byte("hello"))
+	assert.Nil(t, err)
 	assert.True(t, res2)
 	assert.Equal(t, &data.LogRecordPos{1, 1, 0}, oldValue2)
-	assert.Nil(t, art.Get([]byte("hello")))
+	assert.Nil(t, getPos(t, art, []byte("hello")))
+}
+
+// 覆盖已经存在的 key 时原地更新位置索引，只为返回的旧位置分配内存
+func TestAdaptiveRadixTree_Put_Allocs(t *testing.T) {
+	art := NewART()
+	key := []byte("hello")
+	art.Put(key, &data.LogRecordPos{Fid: 1, Offset: 1})
+	pos := &data.LogRecordPos{Fid: 2, Offset: 2}
+	allocs := testing.AllocsPerRun(100, func() {
+		art.Put(key, pos)
+	})
+	assert.Equal(t, float64(1), allocs)
+	assert.Equal(t, pos, getPos(t, art, key))
 }
 
 func TestAdaptiveRadixTree_Size(t *testing.T) {
 	art := NewART()
-	assert.Equal(t, 0, art.Size())
+	assert.Equal(t, 0, indexSize(t, art))
 	art.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
-	assert.Equal(t, 1, art.Size())
+	assert.Equal(t, 1, indexSize(t, art))
 	art.Put([]byte("hello2"), &data.LogRecordPos{Fid: 2, Offset: 2})
-	assert.Equal(t, 2, art.Size())
+	assert.Equal(t, 2, indexSize(t, art))
 	art.Delete([]byte("hello"))
-	assert.Equal(t, 1, art.Size())
+	assert.Equal(t, 1, indexSize(t, art))
 
 }
 
@@ -61,13 +81,16 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art := NewART()
 
 	// 1. art 为空的情况
-	iter1 := art.Iterator(false)
+	iter1, err := art.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, false, iter1.Valid())
 
 	// 2. art 中有一条数据的情况
-	res1 := art.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	res1, err := art.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	iter2 := art.Iterator(false)
+	iter2, err := art.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.EqualValues(t, []byte("aa"), iter2.Key())
 	assert.NotNil(t, iter2.Value)
@@ -78,28 +101,32 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art.Put([]byte("bb"), &data.LogRecordPos{Fid: 2, Offset: 22})
 	art.Put([]byte("cc"), &data.LogRecordPos{Fid: 3, Offset: 33})
 	art.Put([]byte("cc"), &data.LogRecordPos{Fid: 4, Offset: 44})
-	iter3 := art.Iterator(false)
+	iter3, err := art.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
 
 	}
 
-	iter3 = art.Iterator(true)
+	iter3, err = art.Iterator(true)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
 	}
 
 	// 4. 测试 seek
-	iter4 := art.Iterator(false)
+	iter4, err := art.Iterator(false)
+	assert.Nil(t, err)
 	iter4.Seek([]byte("bc"))
 	assert.Equal(t, true, iter4.Valid())
 	assert.EqualValues(t, []byte("cc"), iter4.Key())
 	assert.Equal(t, &data.LogRecordPos{4, 44, 0}, iter4.Value())
 
 	// 5. 测试反向 seek
-	iter5 := art.Iterator(true)
+	iter5, err := art.Iterator(true)
+	assert.Nil(t, err)
 	iter5.Seek([]byte("cb"))
 	assert.Equal(t, true, iter5.Valid())
 	assert.EqualValues(t, []byte("bb"), iter5.Key())
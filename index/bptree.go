@@ -5,54 +5,182 @@ package index
 
 import (
 	"bitcask-go/data"
+	"encoding/binary"
 	bolt "go.etcd.io/bbolt"
+	"io"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
-const bptreeIndexFileName = "bptree-index"
+const BPTreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+// 合并并发写入时最多等待的时间，bolt 默认的 10ms 对单个 key 的写入来说太长了
+const bptreeBatchDelay = 500 * time.Microsecond
+
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta") // 存放索引自身的元信息
+	mergeFileIdKey  = []byte("merge-file-id")
+	seqNoKey        = []byte("seq-no")
+)
 
 type BPlusTree struct {
-	tree *bolt.DB
+	tree     *bolt.DB
+	inflight int32 // 正在进行的 PutBatched 的数量
 }
 
 // 初始化 B+ 树索引
-func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
-	opts := bolt.DefaultOptions
-	opts.NoSync = !syncWrites
-	bptree, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, nil)
+// bolt 的每个事务提交时都会持久化，不受数据库的 SyncWrites 配置影响：不持久化时掉电可能损坏索引文件，
+// 而 B+ 树索引不会从数据文件中重建，损坏之后数据库就无法打开
+func NewBPlusTree(dirPath string) (*BPlusTree, error) {
+	bptree, err := bolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, nil)
 	if err != nil {
-		panic("filed to open bptree")
+		return nil, err
 	}
 
 	// 创建索引桶
 	if err := bptree.Update(func(tx *bolt.Tx) error {
-		_, err2 := tx.CreateBucketIfNotExists(indexBucketName)
-		return err2
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
+		return err
 	}); err != nil {
-		panic("filed to create bucket")
+		_ = bptree.Close()
+		return nil, err
 	}
 
-	return &BPlusTree{tree: bptree}
+	bptree.MaxBatchDelay = bptreeBatchDelay
+	return &BPlusTree{tree: bptree}, nil
 }
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	var oldValue []byte
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldValue = bucket.Get(key)
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
-		println("filed to put key into bptree")
-		panic(err)
+		return nil, err
 	}
 	if len(oldValue) == 0 {
+		return nil, nil
+	}
+	return data.DecodeLogRecordPos(oldValue), nil
+}
+
+// PutBatched 和其他协程并发的写入合并到同一个 bolt 事务中提交，减少持久化的次数
+// 没有并发的写入时直接提交，避免等待合并的延迟
+// 写入之后才更新索引时，同一个 key 的提交顺序可能和写入数据文件的顺序不一致，所以只保留更新的位置。
+// 返回失效的位置：被覆盖的旧位置，或者索引中已经有更新的位置时返回 pos 本身
+func (bpt *BPlusTree) PutBatched(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	update := bpt.tree.Update
+	if atomic.AddInt32(&bpt.inflight, 1) > 1 {
+		update = bpt.tree.Batch
+	}
+	defer atomic.AddInt32(&bpt.inflight, -1)
+
+	var stalePos *data.LogRecordPos
+	// Batch 中的事务失败时 fn 可能被单独重试，每次执行都要重新设置结果
+	if err := update(func(tx *bolt.Tx) error {
+		stalePos = nil
+		bucket := tx.Bucket(indexBucketName)
+		if oldValue := bucket.Get(key); len(oldValue) != 0 {
+			oldPos := data.DecodeLogRecordPos(oldValue)
+			if !positionBefore(oldPos, pos) {
+				stalePos = pos
+				return nil
+			}
+			stalePos = oldPos
+		}
+		return bucket.Put(key, data.EncodeLogRecordPos(pos))
+	}); err != nil {
+		return nil, err
+	}
+	return stalePos, nil
+}
+
+// ApplyBatch 在一个事务中更新一批索引，positions[i] 为 nil 时删除 keys[i]
+// 返回每个 key 被覆盖或者删除的旧位置，不存在时为 nil
+func (bpt *BPlusTree) ApplyBatch(keys [][]byte, positions []*data.LogRecordPos) ([]*data.LogRecordPos, error) {
+	oldPositions := make([]*data.LogRecordPos, len(keys))
+	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
+		return applyBatch(tx, keys, positions, oldPositions)
+	}); err != nil {
+		return nil, err
+	}
+	return oldPositions, nil
+}
+
+// CommitBatch 和 ApplyBatch 相同，并在同一个事务中持久化提交的事务序列号
+func (bpt *BPlusTree) CommitBatch(seqNo uint64, keys [][]byte, positions []*data.LogRecordPos) ([]*data.LogRecordPos, error) {
+	oldPositions := make([]*data.LogRecordPos, len(keys))
+	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
+		if err := applyBatch(tx, keys, positions, oldPositions); err != nil {
+			return err
+		}
+		return putSeqNo(tx, seqNo)
+	}); err != nil {
+		return nil, err
+	}
+	return oldPositions, nil
+}
+
+func applyBatch(tx *bolt.Tx, keys [][]byte, positions, oldPositions []*data.LogRecordPos) error {
+	bucket := tx.Bucket(indexBucketName)
+	for i, key := range keys {
+		if oldValue := bucket.Get(key); len(oldValue) != 0 {
+			oldPositions[i] = data.DecodeLogRecordPos(oldValue)
+		}
+		var err error
+		if positions[i] == nil {
+			err = bucket.Delete(key)
+		} else {
+			err = bucket.Put(key, data.EncodeLogRecordPos(positions[i]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyIngest 在一个事务中写入导入的索引，返回失效的位置
+// 索引中已有的位置比导入的更新时保留原来的位置并返回导入的位置，启动时重新完成导入也不会覆盖导入之后的写入
+func (bpt *BPlusTree) ApplyIngest(keys [][]byte, positions []*data.LogRecordPos) ([]*data.LogRecordPos, error) {
+	oldPositions := make([]*data.LogRecordPos, len(keys))
+	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, key := range keys {
+			if oldValue := bucket.Get(key); len(oldValue) != 0 {
+				oldPos := data.DecodeLogRecordPos(oldValue)
+				if !positionBefore(oldPos, positions[i]) {
+					oldPositions[i] = positions[i]
+					continue
+				}
+				oldPositions[i] = oldPos
+			}
+			if err := bucket.Put(key, data.EncodeLogRecordPos(positions[i])); err != nil {
+				return err
+			}
+		}
 		return nil
+	}); err != nil {
+		return nil, err
 	}
-	return data.DecodeLogRecordPos(oldValue)
+	return oldPositions, nil
 }
 
-func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+// positionBefore a 是否比 b 更早写入数据文件
+func positionBefore(a, b *data.LogRecordPos) bool {
+	if a.Fid != b.Fid {
+		return a.Fid < b.Fid
+	}
+	return a.Offset < b.Offset
+}
+
+func (bpt *BPlusTree) Get(key []byte) (*data.LogRecordPos, error) {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -62,12 +190,12 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		panic("filed to get key from bptree")
+		return nil, err
 	}
-	return pos
+	return pos, nil
 }
 
-func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	var oldValue []byte
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -78,27 +206,132 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 
 		return nil
 	}); err != nil {
-		panic("filed to delete key from bptree")
+		return nil, false, err
 	}
 	// 删除了一个不存在的 key，返回 nil
 	if len(oldValue) == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	return data.DecodeLogRecordPos(oldValue), true
+	return data.DecodeLogRecordPos(oldValue), true, nil
 }
-func (bpt *BPlusTree) Size() int {
+func (bpt *BPlusTree) Size() (int, error) {
 	var size int
 	if err := bpt.tree.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("filed to get size from bptree")
+		return 0, err
 	}
-	return size
+	return size, nil
+}
+
+// MemorySize B+ 树索引保存在磁盘上，不占用内存索引的空间
+func (bpt *BPlusTree) MemorySize() int64 {
+	return 0
+}
+
+// MergeFileId 获取索引已经同步到的 merge 边界（nonMergeFileId），从未同步过则返回 0
+func (bpt *BPlusTree) MergeFileId() (uint32, error) {
+	var fileId uint32
+	err := bpt.tree.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucketName).Get(mergeFileIdKey)
+		if len(value) == 4 {
+			fileId = binary.BigEndian.Uint32(value)
+		}
+		return nil
+	})
+	return fileId, err
+}
+
+// SeqNo 获取持久化的事务序列号，从未保存过则返回 0
+func (bpt *BPlusTree) SeqNo() (uint64, error) {
+	var seqNo uint64
+	err := bpt.tree.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucketName).Get(seqNoKey)
+		if len(value) == 8 {
+			seqNo = binary.BigEndian.Uint64(value)
+		}
+		return nil
+	})
+	return seqNo, err
+}
+
+// SetSeqNo 持久化事务序列号
+func (bpt *BPlusTree) SetSeqNo(seqNo uint64) error {
+	return bpt.tree.Update(func(tx *bolt.Tx) error {
+		return putSeqNo(tx, seqNo)
+	})
+}
+
+func putSeqNo(tx *bolt.Tx, seqNo uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, seqNo)
+	return tx.Bucket(metaBucketName).Put(seqNoKey, value)
+}
+
+// ApplyMerge 在一个事务中，把仍指向已被合并的旧文件（fid < nonMergeFileId）的索引改写为 merge 后的新位置，
+// 不在 merge 结果中的（被 merge 时保留的旧文件中更新的墓碑删除）直接删除，并记录 merge 边界。
+// merge 期间被重新写入或删除的 key 不在旧文件中，保持不变
+func (bpt *BPlusTree) ApplyMerge(nonMergeFileId uint32, keys [][]byte, positions []*data.LogRecordPos) error {
+	mergePositions := make(map[string]*data.LogRecordPos, len(keys))
+	for i, key := range keys {
+		mergePositions[string(key)] = positions[i]
+	}
+	return bpt.tree.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		// 遍历时修改会让游标失效，先找出需要改写的 key
+		var oldKeys [][]byte
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			if data.DecodeLogRecordPos(value).Fid < nonMergeFileId {
+				oldKeys = append(oldKeys, append([]byte(nil), key...))
+			}
+		}
+		for _, key := range oldKeys {
+			pos, ok := mergePositions[string(key)]
+			if !ok {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put(key, data.EncodeLogRecordPos(pos)); err != nil {
+				return err
+			}
+		}
+
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, nonMergeFileId)
+		return tx.Bucket(metaBucketName).Put(mergeFileIdKey, value)
+	})
+}
+
+// BPlusTreeSnapshot B+ 树索引在某一时刻的只读快照
+// 快照存在期间 bolt 文件不能扩容，写入可能被阻塞，用完之后需要尽快关闭
+type BPlusTreeSnapshot struct {
+	tx *bolt.Tx
+}
+
+// Snapshot 获取索引当前的快照，之后的修改不会影响快照
+func (bpt *BPlusTree) Snapshot() (*BPlusTreeSnapshot, error) {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &BPlusTreeSnapshot{tx: tx}, nil
+}
+
+// WriteTo 把快照写成一个完整的 B+ 树索引文件
+func (s *BPlusTreeSnapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.tx.WriteTo(w)
+}
+
+func (s *BPlusTreeSnapshot) Close() error {
+	return s.tx.Rollback()
 }
 
-func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
+func (bpt *BPlusTree) Iterator(reverse bool) (Iterator, error) {
 	return NewBptreeIterator(bpt.tree, reverse)
 }
 
@@ -114,11 +347,11 @@ type bptreeIterator struct {
 	currValue []byte
 }
 
-func NewBptreeIterator(bpt *bolt.DB, reverse bool) *bptreeIterator {
+func NewBptreeIterator(bpt *bolt.DB, reverse bool) (*bptreeIterator, error) {
 	// 开启一个事务
 	tx, err := bpt.Begin(false)
 	if err != nil {
-		panic("filed to begin tx")
+		return nil, err
 	}
 	bpti := &bptreeIterator{
 		tx:      tx,
@@ -126,7 +359,7 @@ func NewBptreeIterator(bpt *bolt.DB, reverse bool) *bptreeIterator {
 		reverse: reverse,
 	}
 	bpti.Rewind()
-	return bpti
+	return bpti, nil
 }
 func (bpti *bptreeIterator) Rewind() {
 	if bpti.reverse {
@@ -2,81 +2,99 @@ package index
 
 import (
 	"bitcask-go/data"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
 const dirPath = "/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database/"
 
 func TestBPlusTree_Put(t *testing.T) {
-	bptree := NewBPlusTree(dirPath, false)
+	bptree, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bptree.tree.Path()
 		os.Remove(filePath)
 	}()
-	res1 := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	res1, err := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	assert.Equal(t, 1, bptree.Size())
-	res2 := bptree.Put([]byte("bbb"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.Equal(t, 1, indexSize(t, bptree))
+	res2, err := bptree.Put([]byte("bbb"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	assert.Equal(t, 2, bptree.Size())
+	assert.Equal(t, 2, indexSize(t, bptree))
 
 }
 
 func TestBPlusTree_Get(t *testing.T) {
-	bptree := NewBPlusTree(dirPath, false)
+	bptree, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bptree.tree.Path()
 		os.Remove(filePath)
 	}()
 
 	// 1. 测试不存在的key
-	pos1 := bptree.Get([]byte("bbb"))
+	pos1, err := bptree.Get([]byte("bbb"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 
 	// 2. 插入一个key为 hello 的元素
-	res2 := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	res2, err := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	pos2 := bptree.Get([]byte("hello"))
+	pos2, err := bptree.Get([]byte("hello"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 1}, pos2)
 
 	// 3. 修改 hello 的 pos
-	res3 := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	res3, err := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.Nil(t, err)
 	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 1}, res3) // 返回旧值
-	pos3 := bptree.Get([]byte("hello"))
+	pos3, err := bptree.Get([]byte("hello"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos3)
 	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 2}, pos3)
 
 }
 
 func TestBPlusTree_Delete(t *testing.T) {
-	bptree := NewBPlusTree(dirPath, false)
+	bptree, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bptree.tree.Path()
 		os.Remove(filePath)
 	}()
 
 	// 1. 插入一个key为 hello 的元素
-	res1 := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	res1, err := bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
 	// 2. 删除一个不存在的key
-	pos, res2 := bptree.Delete([]byte("bbb"))
+	pos, res2, err := bptree.Delete([]byte("bbb"))
+	assert.Nil(t, err)
 	assert.False(t, res2)
 	assert.Nil(t, pos)
 
 	// 3. 删除一个存在的key
-	recordPos, res3 := bptree.Delete([]byte("hello"))
+	recordPos, res3, err := bptree.Delete([]byte("hello"))
+	assert.Nil(t, err)
 	assert.True(t, res3)
-	assert.Equal(t, 0, bptree.Size())
+	assert.Equal(t, 0, indexSize(t, bptree))
 	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 1}, recordPos)
 
 }
 
 func TestBPlusTree_Size(t *testing.T) {
-	bptree := NewBPlusTree(dirPath, false)
+	bptree, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bptree.tree.Path()
 		os.Remove(filePath)
@@ -85,25 +103,29 @@ func TestBPlusTree_Size(t *testing.T) {
 	bptree.Put([]byte("hello"), &data.LogRecordPos{Fid: 1, Offset: 1})
 	bptree.Put([]byte("world"), &data.LogRecordPos{Fid: 2, Offset: 2})
 	bptree.Put([]byte("bitcask"), &data.LogRecordPos{Fid: 3, Offset: 3})
-	assert.Equal(t, 3, bptree.Size())
+	assert.Equal(t, 3, indexSize(t, bptree))
 }
 
 func TestBPlusTree_Iterator(t *testing.T) {
-	bptree := NewBPlusTree(dirPath, false)
+	bptree, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bptree.tree.Path()
 		os.Remove(filePath)
 	}()
 
 	// 1. bptree 为空的情况
-	iter1 := bptree.Iterator(false)
+	iter1, err := bptree.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, false, iter1.Valid())
 	iter1.Close()
 
 	// 2. bptree 中有一条数据的情况
-	res1 := bptree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	res1, err := bptree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	iter2 := bptree.Iterator(false)
+	iter2, err := bptree.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.EqualValues(t, []byte("aa"), iter2.Key())
 	assert.NotNil(t, iter2.Value)
@@ -115,14 +137,16 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	bptree.Put([]byte("bb"), &data.LogRecordPos{Fid: 2, Offset: 22})
 	bptree.Put([]byte("cc"), &data.LogRecordPos{Fid: 3, Offset: 33})
 	bptree.Put([]byte("cc"), &data.LogRecordPos{Fid: 4, Offset: 44})
-	iter3 := bptree.Iterator(false)
+	iter3, err := bptree.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
 
 	}
 
-	iter3 = bptree.Iterator(true)
+	iter3, err = bptree.Iterator(true)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
@@ -130,7 +154,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	iter3.Close()
 
 	// 4. 测试 seek
-	iter4 := bptree.Iterator(false)
+	iter4, err := bptree.Iterator(false)
+	assert.Nil(t, err)
 	iter4.Seek([]byte("bc"))
 	assert.Equal(t, true, iter4.Valid())
 	assert.EqualValues(t, []byte("cc"), iter4.Key())
@@ -138,7 +163,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	iter4.Close()
 
 	// 5. 测试反向 seek
-	iter5 := bptree.Iterator(true)
+	iter5, err := bptree.Iterator(true)
+	assert.Nil(t, err)
 
 	iter5.Seek([]byte("cb"))
 	assert.Equal(t, true, iter5.Valid())
@@ -149,7 +175,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 
 // 这个和 btree 中的反向不太一样，需要注意下
 func TestReverseSeek(t *testing.T) {
-	bpti := NewBPlusTree(dirPath, false)
+	bpti, err := NewBPlusTree(dirPath)
+	assert.Nil(t, err)
 	defer func() {
 		filePath := bpti.tree.Path()
 		os.Remove(filePath)
@@ -159,8 +186,121 @@ func TestReverseSeek(t *testing.T) {
 	bpti.Put([]byte("bb"), &data.LogRecordPos{Fid: 2, Offset: 22})
 	bpti.Put([]byte("cc"), &data.LogRecordPos{Fid: 3, Offset: 33})
 	bpti.Put([]byte("dd"), &data.LogRecordPos{Fid: 4, Offset: 44})
-	iter := bpti.Iterator(true)
+	iter, err := bpti.Iterator(true)
+	assert.Nil(t, err)
 
 	iter.Seek([]byte("cb"))
 	assert.EqualValues(t, []byte("cc"), iter.Key())
 }
+
+func TestBPlusTree_Errors(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-errors")
+	defer os.RemoveAll(dir)
+
+	// 索引文件损坏时返回错误
+	err := os.WriteFile(filepath.Join(dir, BPTreeIndexFileName), []byte("not a bbolt file"), 0644)
+	assert.Nil(t, err)
+	_, err = NewBPlusTree(dir)
+	assert.NotNil(t, err)
+	_, err = NewIndexer(BPTree, dir)
+	assert.NotNil(t, err)
+	_, err = NewIndexer(IndexType(100), dir)
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+
+	// bbolt 关闭之后的读写都返回错误
+	err = os.Remove(filepath.Join(dir, BPTreeIndexFileName))
+	assert.Nil(t, err)
+	bptree, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	_, err = bptree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, err)
+	err = bptree.Close()
+	assert.Nil(t, err)
+
+	_, err = bptree.Put([]byte("bb"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = bptree.Get([]byte("aa"))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, _, err = bptree.Delete([]byte("aa"))
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = bptree.Size()
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = bptree.Iterator(false)
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+
+	// 分片索引中任意一个分片出错都返回错误
+	si, err := NewShardedIndex(4, func() (Indexer, error) { return bptree, nil })
+	assert.Nil(t, err)
+	_, err = si.Size()
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = si.Iterator(false)
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+	_, err = NewShardedIndex(4, func() (Indexer, error) { return nil, ErrUnsupportedIndexType })
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+}
+
+// bolt 的提交总是要持久化，否则掉电之后索引文件可能损坏
+func TestBPlusTree_Sync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-sync")
+	defer os.RemoveAll(dir)
+	bptree, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	assert.False(t, bptree.tree.NoSync)
+	assert.False(t, bptree.tree.NoFreelistSync)
+	assert.Nil(t, bptree.Close())
+}
+
+func TestBPlusTree_Batch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-batch")
+	defer os.RemoveAll(dir)
+	bptree, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	defer bptree.Close()
+
+	// 只保留更新的位置，返回失效的位置
+	stalePos, err := bptree.PutBatched([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 10, Size: 5})
+	assert.Nil(t, err)
+	assert.Nil(t, stalePos)
+	stalePos, err = bptree.PutBatched([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 20, Size: 6})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 20, Size: 6}, stalePos)
+	stalePos, err = bptree.PutBatched([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 30, Size: 7})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 10, Size: 5}, stalePos)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 30, Size: 7}, getPos(t, bptree, []byte("aa")))
+
+	// 并发写入合并到同一个事务中
+	wg := new(sync.WaitGroup)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, err := bptree.PutBatched([]byte(fmt.Sprintf("key-%d-%d", w, i)), &data.LogRecordPos{Fid: 3, Offset: int64(i)})
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 161, indexSize(t, bptree))
+
+	// 一个事务中写入和删除
+	oldPositions, err := bptree.ApplyBatch(
+		[][]byte{[]byte("aa"), []byte("bb"), []byte("key-0-0"), []byte("not-exist")},
+		[]*data.LogRecordPos{nil, {Fid: 4, Offset: 1}, nil, nil},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []*data.LogRecordPos{{Fid: 2, Offset: 30, Size: 7}, nil, {Fid: 3, Offset: 0}, nil}, oldPositions)
+	assert.Nil(t, getPos(t, bptree, []byte("aa")))
+	assert.Nil(t, getPos(t, bptree, []byte("key-0-0")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 4, Offset: 1}, getPos(t, bptree, []byte("bb")))
+	assert.Equal(t, 160, indexSize(t, bptree))
+
+	// 提交事务时和索引一起持久化序列号
+	oldPositions, err = bptree.CommitBatch(7, [][]byte{[]byte("bb")}, []*data.LogRecordPos{{Fid: 5, Offset: 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, []*data.LogRecordPos{{Fid: 4, Offset: 1}}, oldPositions)
+	seqNo, err := bptree.SeqNo()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), seqNo)
+}
@@ -2,85 +2,122 @@ package index
 
 import (
 	"bitcask-go/data"
-	"bytes"
 	"github.com/google/btree"
 	"sort"
 	"sync"
+	"unsafe"
 )
 
 type Btree struct {
-	tree *btree.BTree
-	lock *sync.RWMutex
+	tree  *btree.BTreeG[btreeItem]
+	lock  *sync.RWMutex
+	arena *keyArena
 }
 
+// btreeItem BTree 中保存的索引项，位置索引直接保存在索引项中
+type btreeItem struct {
+	key string // 保存在 arena 中的 key
+	pos packedPos
+}
+
+func btreeItemLess(a, b btreeItem) bool {
+	return a.key < b.key
+}
+
+// btreeItemSize 每个索引项除 key 之外大约占用的内存：索引项本身，以及节点没有填满和节点指针的开销
+const btreeItemSize = int64(unsafe.Sizeof(btreeItem{})) + 32
+
 // NewBtree 创建一个Btree
 func NewBtree() *Btree {
 	return &Btree{
-		tree: btree.New(32),
-		lock: new(sync.RWMutex),
+		tree:  btree.NewG(32, btreeItemLess),
+		lock:  new(sync.RWMutex),
+		arena: newKeyArena(),
 	}
 }
-func (bt *Btree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	it := &Item{key: key, pos: pos}
+func (bt *Btree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	bt.lock.Lock()
-	oldItem := bt.tree.ReplaceOrInsert(it)
-	bt.lock.Unlock()
-	if oldItem == nil {
-		return nil
+	defer bt.lock.Unlock()
+	// 已经存在的 key 继续使用原来的内存，只更新位置索引
+	if oldItem, ok := bt.tree.Get(btreeItem{key: stringOf(key)}); ok {
+		bt.tree.ReplaceOrInsert(btreeItem{key: oldItem.key, pos: packPos(pos)})
+		return oldItem.pos.unpack(), nil
 	}
-	return oldItem.(*Item).pos
+	bt.tree.ReplaceOrInsert(btreeItem{key: bt.arena.alloc(key), pos: packPos(pos)})
+	return nil, nil
 }
 
-func (bt *Btree) Get(key []byte) *data.LogRecordPos {
-	item := &Item{key: key}
-	// 读 不用加锁
-	btreeItem := bt.tree.Get(item)
-	if btreeItem == nil {
-		return nil
+func (bt *Btree) Get(key []byte) (*data.LogRecordPos, error) {
+	bt.lock.RLock()
+	item, ok := bt.tree.Get(btreeItem{key: stringOf(key)})
+	bt.lock.RUnlock()
+	if !ok {
+		return nil, nil
 	}
-	return btreeItem.(*Item).pos
+	return item.pos.unpack(), nil
 }
 
-func (bt *Btree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	item := &Item{key: key}
+func (bt *Btree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	bt.lock.Lock()
-	oldItem := bt.tree.Delete(item)
-	bt.lock.Unlock()
-	if oldItem == nil {
-		return nil, false
+	defer bt.lock.Unlock()
+	oldItem, ok := bt.tree.Delete(btreeItem{key: stringOf(key)})
+	if !ok {
+		return nil, false, nil
+	}
+	bt.arena.free(key)
+	if bt.arena.needCompact() {
+		bt.compact()
 	}
-	return oldItem.(*Item).pos, true
+	return oldItem.pos.unpack(), true, nil
 }
 
-func (bt *Btree) Iterator(reverse bool) Iterator {
-	if bt.tree == nil {
-		return nil
-	}
-	return NewBtreeIterator(bt.tree, reverse)
+// compact 将所有的 key 复制到新的 arena 中，释放已经删除的 key 占用的内存
+// 迭代器中的快照仍然引用旧的内存，旧的 arena 不再修改，所以迭代器不受影响
+func (bt *Btree) compact() {
+	arena := newKeyArena()
+	tree := btree.NewG(32, btreeItemLess)
+	bt.tree.Ascend(func(item btreeItem) bool {
+		tree.ReplaceOrInsert(btreeItem{key: arena.alloc(bytesOf(item.key)), pos: item.pos})
+		return true
+	})
+	bt.tree, bt.arena = tree, arena
+}
+
+func (bt *Btree) Iterator(reverse bool) (Iterator, error) {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return NewBtreeIterator(bt.tree, reverse), nil
 }
 
-func (bt *Btree) Size() int {
-	return bt.tree.Len()
+func (bt *Btree) Size() (int, error) {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.tree.Len(), nil
 }
+
+func (bt *Btree) MemorySize() int64 {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.arena.size + int64(bt.tree.Len())*btreeItemSize
+}
+
 func (bt *Btree) Close() error {
 	return nil
 }
 
 // BTree 索引迭代器
 type btreeIterator struct {
-	currentIndex int     // 当前索引
-	reverse      bool    // 是否是反向遍历
-	values       []*Item // key 和 位置索引
+	currentIndex int         // 当前索引
+	reverse      bool        // 是否是反向遍历
+	values       []btreeItem // key 和 位置索引
 }
 
-func NewBtreeIterator(bt *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, bt.Len())
+func NewBtreeIterator(bt *btree.BTreeG[btreeItem], reverse bool) *btreeIterator {
+	values := make([]btreeItem, 0, bt.Len())
 
 	// 遍历 btree, 将数据保存到 values 数组中
-	saveValues := func(item btree.Item) bool {
-		values[idx] = item.(*Item)
-		idx++
+	saveValues := func(item btreeItem) bool {
+		values = append(values, item)
 		return true
 	}
 	if reverse {
@@ -100,13 +137,14 @@ func (bti *btreeIterator) Rewind() {
 }
 
 func (bti *btreeIterator) Seek(key []byte) {
+	target := stringOf(key)
 	if bti.reverse {
 		bti.currentIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
+			return bti.values[i].key <= target
 		})
 	} else {
 		bti.currentIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
+			return bti.values[i].key >= target
 		})
 	}
 }
@@ -120,11 +158,11 @@ func (bti *btreeIterator) Valid() bool {
 }
 
 func (bti *btreeIterator) Key() []byte {
-	return bti.values[bti.currentIndex].key
+	return bytesOf(bti.values[bti.currentIndex].key)
 }
 
 func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.values[bti.currentIndex].pos
+	return bti.values[bti.currentIndex].pos.unpack()
 }
 
 func (bti *btreeIterator) Close() {
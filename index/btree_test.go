@@ -8,14 +8,17 @@ import (
 
 func TestBtree_Put(t *testing.T) {
 	btree := NewBtree()
-	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 11})
+	res1, err := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	res2 := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	res2, err := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
 
 	// 返回的是旧值
-	res3 := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 3, Offset: 33})
+	res3, err := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 3, Offset: 33})
+	assert.Nil(t, err)
 	assert.Equal(t, &data.LogRecordPos{2, 22, 0}, res3)
 }
 
@@ -23,21 +26,26 @@ func TestBtree_Get(t *testing.T) {
 	btree := NewBtree()
 
 	// 插入一个key为nil的元素
-	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 20, Offset: 2})
+	res1, err := btree.Put(nil, &data.LogRecordPos{Fid: 20, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	pos1 := btree.Get(nil)
+	pos1, err := btree.Get(nil)
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(20), pos1.Fid)
 	assert.Equal(t, int64(2), pos1.Offset)
 
 	// 插入一个key为aa的元素
-	res2 := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	res2, err := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
 	// 插入相同的key,修改 地址
-	res3 := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	res3, err := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	assert.Nil(t, err)
 	assert.Equal(t, &data.LogRecordPos{2, 2, 0}, res3)
 
-	pos2 := btree.Get([]byte("aa"))
+	pos2, err := btree.Get([]byte("aa"))
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(2), pos2.Fid)
 	assert.Equal(t, int64(22), pos2.Offset)
 }
@@ -45,21 +53,26 @@ func TestBtree_Get(t *testing.T) {
 func TestBtree_Delete(t *testing.T) {
 	btree := NewBtree()
 	// 删除一个 key 为 nil 的元素
-	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 11})
+	res1, err := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	oldValue1, res2 := btree.Delete(nil)
+	oldValue1, res2, err := btree.Delete(nil)
+	assert.Nil(t, err)
 	assert.True(t, res2)
 	assert.Equal(t, &data.LogRecordPos{1, 11, 0}, oldValue1)
 
 	// 删除一个 key 为 asd 的元素
-	res3 := btree.Put([]byte("asd"), &data.LogRecordPos{Fid: 2, Offset: 201})
+	res3, err := btree.Put([]byte("asd"), &data.LogRecordPos{Fid: 2, Offset: 201})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
-	oldValue3, res4 := btree.Delete([]byte("asd"))
+	oldValue3, res4, err := btree.Delete([]byte("asd"))
+	assert.Nil(t, err)
 	assert.True(t, res4)
 	assert.Equal(t, &data.LogRecordPos{2, 201, 0}, oldValue3)
 
 	// 删除一个不存在的 key
-	pos, ok := btree.Delete([]byte("not exist key"))
+	pos, ok, err := btree.Delete([]byte("not exist key"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 	assert.False(t, ok)
 }
@@ -68,13 +81,16 @@ func TestBtree_Iterator(t *testing.T) {
 	btree := NewBtree()
 
 	// 1. btree 为空的情况
-	iter1 := btree.Iterator(false)
+	iter1, err := btree.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, false, iter1.Valid())
 
 	// 2. btree 中有一条数据的情况
-	res1 := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	res1, err := btree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	iter2 := btree.Iterator(false)
+	iter2, err := btree.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.EqualValues(t, []byte("aa"), iter2.Key())
 	assert.NotNil(t, iter2.Value)
@@ -85,28 +101,32 @@ func TestBtree_Iterator(t *testing.T) {
 	btree.Put([]byte("bb"), &data.LogRecordPos{Fid: 2, Offset: 22})
 	btree.Put([]byte("cc"), &data.LogRecordPos{Fid: 3, Offset: 33})
 	btree.Put([]byte("cc"), &data.LogRecordPos{Fid: 4, Offset: 44})
-	iter3 := btree.Iterator(false)
+	iter3, err := btree.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
 
 	}
 
-	iter3 = btree.Iterator(true)
+	iter3, err = btree.Iterator(true)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.Equal(t, true, iter3.Valid())
 		assert.NotNil(t, iter3.Key())
 	}
 
 	// 4. 测试 seek
-	iter4 := btree.Iterator(false)
+	iter4, err := btree.Iterator(false)
+	assert.Nil(t, err)
 	iter4.Seek([]byte("bc"))
 	assert.Equal(t, true, iter4.Valid())
 	assert.EqualValues(t, []byte("cc"), iter4.Key())
 	assert.Equal(t, &data.LogRecordPos{4, 44, 0}, iter4.Value())
 
 	// 5. 测试反向 seek
-	iter5 := btree.Iterator(true)
+	iter5, err := btree.Iterator(true)
+	assert.Nil(t, err)
 	iter5.Seek([]byte("cb"))
 	assert.Equal(t, true, iter5.Valid())
 	assert.EqualValues(t, []byte("bb"), iter5.Key())
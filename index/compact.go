@@ -0,0 +1,88 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"unsafe"
+)
+
+// bytesOf 将 arena 中的字符串转换为字节数组，不复制数据，返回的数据不能修改
+func bytesOf(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// stringOf 将 key 转换为字符串，不复制数据，只能用于查找，不能保存在索引中
+func stringOf(key []byte) string {
+	return unsafe.String(unsafe.SliceData(key), len(key))
+}
+
+// packedPos 紧凑的位置索引，直接保存在索引项中，不需要为每个 key 单独分配 *data.LogRecordPos
+// 字段按照大小排列，没有对齐填充，只占 16 字节
+type packedPos struct {
+	offset int64
+	fid    uint32
+	size   uint32
+}
+
+func packPos(pos *data.LogRecordPos) packedPos {
+	return packedPos{offset: pos.Offset, fid: pos.Fid, size: pos.Size}
+}
+
+func (p packedPos) unpack() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: p.fid, Offset: p.offset, Size: p.size}
+}
+
+const (
+	// arenaMinChunkSize 和 arenaMaxChunkSize 每次向 Go 申请的 key 内存块大小的范围
+	// 内存块的大小随着已经申请的内存增长，key 比较少时不会浪费太多的空间
+	arenaMinChunkSize = 1024
+	arenaMaxChunkSize = 64 * 1024
+	// arenaMaxKeySize 超过这个大小的 key 单独分配，避免浪费内存块的剩余空间
+	arenaMaxKeySize = arenaMaxChunkSize / 8
+	// arenaCompactSize 废弃的 key 超过这个大小，并且超过 arena 的一半时，重新整理 arena
+	// 重新整理时复制的数据不会超过废弃的数据，分摊到每次删除上的开销是常数
+	arenaCompactSize = arenaMaxChunkSize
+)
+
+// keyArena key 的内存分配器
+// 索引中的 key 都复制到大块的内存中，而不是每个 key 单独分配，减少内存碎片和 GC 需要扫描的对象。
+// key 以字符串的形式保存，比字节数组少 8 字节。复制之后索引也不会再引用调用方传进来的切片（例如启动时从数据文件中读取的整条记录）。
+// 已经分配的内存不会被修改和复用，删除或者覆盖的 key 只记录为废弃，由索引在废弃的数据过多时整体重建。
+type keyArena struct {
+	chunk   []byte // 当前正在分配的内存块
+	size    int64  // 已经申请的内存大小
+	garbage int64  // 已经废弃的 key 大小
+}
+
+func newKeyArena() *keyArena {
+	return &keyArena{}
+}
+
+// alloc 将 key 复制到 arena 中，返回的字符串和 key 的内容相同，引用 arena 中的内存
+func (a *keyArena) alloc(key []byte) string {
+	n := len(key)
+	if n == 0 {
+		return ""
+	}
+	if n > arenaMaxKeySize {
+		a.size += int64(n)
+		return string(key)
+	}
+	if len(a.chunk)+n > cap(a.chunk) {
+		chunkSize := max(min(int(a.size), arenaMaxChunkSize), arenaMinChunkSize, n)
+		a.chunk = make([]byte, 0, chunkSize)
+		a.size += int64(chunkSize)
+	}
+	start := len(a.chunk)
+	a.chunk = append(a.chunk, key...)
+	return unsafe.String(&a.chunk[start], n)
+}
+
+// free 记录废弃的 key
+func (a *keyArena) free(key []byte) {
+	a.garbage += int64(len(key))
+}
+
+// needCompact 废弃的 key 是否已经足够多，需要重建 arena
+func (a *keyArena) needCompact() bool {
+	return a.garbage > arenaCompactSize && a.garbage > a.size/2
+}
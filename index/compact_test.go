@@ -0,0 +1,121 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPackedPos(t *testing.T) {
+	pos := &data.LogRecordPos{Fid: 12, Offset: 1 << 40, Size: 1024}
+	assert.Equal(t, pos, packPos(pos).unpack())
+}
+
+func TestKeyArena_Alloc(t *testing.T) {
+	arena := newKeyArena()
+	key := []byte("key-1")
+	arenaKey := arena.alloc(key)
+	assert.Equal(t, "key-1", arenaKey)
+
+	// 复制之后和原来的 key 不共用内存
+	key[0] = 'x'
+	assert.Equal(t, "key-1", arenaKey)
+	assert.Equal(t, "", arena.alloc(nil))
+
+	// 大的 key 单独分配
+	bigKey := bytes.Repeat([]byte("k"), arenaMaxKeySize+1)
+	assert.Equal(t, string(bigKey), arena.alloc(bigKey))
+	assert.Equal(t, int64(arenaMinChunkSize+arenaMaxKeySize+1), arena.size)
+
+	arena.free(bigKey)
+	assert.False(t, arena.needCompact())
+}
+
+// 索引不能引用调用方传进来的 key，删除大量的 key 之后内存可以被回收
+func TestIndex_Compact(t *testing.T) {
+	indexes := map[string]func() Indexer{
+		"btree": func() Indexer { return NewBtree() },
+		"art":   func() Indexer { return NewART() },
+		"hash":  func() Indexer { return NewHashIndex() },
+	}
+	for name, newIndexer := range indexes {
+		t.Run(name, func(t *testing.T) {
+			indexer := newIndexer()
+			key := []byte("reused-key-buffer")
+			indexer.Put(key, &data.LogRecordPos{Fid: 1, Offset: 1})
+			copy(key, "modified")
+			assert.NotNil(t, getPos(t, indexer, []byte("reused-key-buffer")))
+			indexer.Delete([]byte("reused-key-buffer"))
+
+			// key 之间没有很长的公共前缀，ART 中也不能共享
+			bigKey := func(i int) []byte {
+				return append(utils.GetTestKey(i), bytes.Repeat([]byte("k"), 10*1024)...)
+			}
+			for i := 0; i < 1000; i++ {
+				indexer.Put(bigKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+			memorySize := indexer.MemorySize()
+			assert.Greater(t, memorySize, int64(1000*10*1024))
+
+			for i := 0; i < 900; i++ {
+				_, ok, err := indexer.Delete(bigKey(i))
+				assert.Nil(t, err)
+				assert.True(t, ok)
+			}
+			assert.Less(t, indexer.MemorySize(), memorySize/2)
+
+			assert.Equal(t, 100, indexSize(t, indexer))
+			for i := 900; i < 1000; i++ {
+				assert.Equal(t, int64(i), getPos(t, indexer, bigKey(i)).Offset)
+			}
+			iter, err := indexer.Iterator(false)
+			assert.Nil(t, err)
+			i := 900
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.Equal(t, bigKey(i), iter.Key())
+				i++
+			}
+			assert.Equal(t, 1000, i)
+		})
+	}
+}
+
+// ART 中具有公共前缀的 key 共享前缀的内存，其他索引为每个 key 保存完整的 key
+func TestART_Prefix_Shared(t *testing.T) {
+	prefix := bytes.Repeat([]byte("p"), 1024)
+	key := func(i int) []byte {
+		return append(append([]byte(nil), prefix...), utils.GetTestKey(i)...)
+	}
+	art, bt := NewART(), NewBtree()
+	for i := 0; i < 10000; i++ {
+		art.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		bt.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Greater(t, bt.MemorySize(), int64(10000*1024))
+	assert.Less(t, art.MemorySize(), int64(10000*1024)/2)
+
+	for i := 0; i < 10000; i++ {
+		assert.Equal(t, int64(i), getPos(t, art, key(i)).Offset)
+	}
+	assert.Nil(t, getPos(t, art, prefix))
+	assert.Nil(t, getPos(t, art, key(10000)))
+
+	// 删除之后剩下的 key 和顺序不变
+	for i := 0; i < 10000; i += 2 {
+		_, ok, err := art.Delete(key(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 5000, indexSize(t, art))
+	iter, err := art.Iterator(true)
+	assert.Nil(t, err)
+	i := 9999
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, key(i), iter.Key())
+		assert.Equal(t, int64(i), iter.Value().Offset)
+		i -= 2
+	}
+	assert.Equal(t, -1, i)
+}
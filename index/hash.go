@@ -0,0 +1,164 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// 哈希索引的分片数量，每个分片使用单独的锁，减少并发读写时的锁竞争
+const hashShardNum = 64
+
+// HashIndex 分片的哈希表索引
+// 只支持点查询的负载不需要 key 的顺序，哈希表的查找是 O(1) 的，
+// 位置索引以紧凑的形式直接保存在哈希表中，key 保存在 arena 中，每个 key 占用的内存也比树形索引少。
+// 迭代时对所有 key 做一次快照并排序。
+type HashIndex struct {
+	shards [hashShardNum]*hashShard
+}
+
+type hashShard struct {
+	items map[string]packedPos // key 是指向 arena 中内存的字符串
+	arena *keyArena
+	lock  *sync.RWMutex
+}
+
+// hashEntrySize 每个 key 除 key 本身之外大约占用的内存：字符串头、位置索引和哈希表的 bucket 开销
+const hashEntrySize = int64(unsafe.Sizeof("")+unsafe.Sizeof(packedPos{})) + 20
+
+func newHashShard() *hashShard {
+	return &hashShard{
+		items: make(map[string]packedPos),
+		arena: newKeyArena(),
+		lock:  new(sync.RWMutex),
+	}
+}
+
+// NewHashIndex 创建一个空的哈希索引
+func NewHashIndex() *HashIndex {
+	h := &HashIndex{}
+	for i := range h.shards {
+		h.shards[i] = newHashShard()
+	}
+	return h
+}
+
+// hashKey 计算 key 的 FNV-1a 哈希值，用于选择分片
+func hashKey(key []byte) uint32 {
+	var hash uint32 = 2166136261
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return hash
+}
+
+func (h *HashIndex) shard(key []byte) *hashShard {
+	return h.shards[hashKey(key)%hashShardNum]
+}
+
+func (h *HashIndex) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	s := h.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldPos, ok := s.items[string(key)]
+	// 更新已经存在的 key 时，哈希表中的 key 也会被替换为新的 key，旧的 key 废弃
+	s.items[s.arena.alloc(key)] = packPos(pos)
+	if !ok {
+		return nil, nil
+	}
+	s.arena.free(key)
+	s.compactIfNeeded()
+	return oldPos.unpack(), nil
+}
+
+func (h *HashIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	s := h.shard(key)
+	s.lock.RLock()
+	pos, ok := s.items[string(key)]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return pos.unpack(), nil
+}
+
+func (h *HashIndex) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	s := h.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldPos, ok := s.items[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(s.items, string(key))
+	s.arena.free(key)
+	s.compactIfNeeded()
+	return oldPos.unpack(), true, nil
+}
+
+// compactIfNeeded 废弃的 key 过多时，将所有的 key 复制到新的 arena 中
+func (s *hashShard) compactIfNeeded() {
+	if !s.arena.needCompact() {
+		return
+	}
+	arena := newKeyArena()
+	items := make(map[string]packedPos, len(s.items))
+	for key, pos := range s.items {
+		items[arena.alloc(bytesOf(key))] = pos
+	}
+	s.items, s.arena = items, arena
+}
+
+func (h *HashIndex) Size() (int, error) {
+	return h.size(), nil
+}
+
+func (h *HashIndex) size() int {
+	var size int
+	for _, s := range h.shards {
+		s.lock.RLock()
+		size += len(s.items)
+		s.lock.RUnlock()
+	}
+	return size
+}
+
+func (h *HashIndex) MemorySize() int64 {
+	var size int64
+	for _, s := range h.shards {
+		s.lock.RLock()
+		size += s.arena.size + int64(len(s.items))*hashEntrySize
+		s.lock.RUnlock()
+	}
+	return size
+}
+
+// Iterator 对所有的 key 做快照并排序，迭代器和 BTree 索引的相同
+func (h *HashIndex) Iterator(reverse bool) (Iterator, error) {
+	values := make([]btreeItem, 0, h.size())
+	for _, s := range h.shards {
+		s.lock.RLock()
+		for key, pos := range s.items {
+			values = append(values, btreeItem{key: key, pos: pos})
+		}
+		s.lock.RUnlock()
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		if reverse {
+			return values[i].key > values[j].key
+		}
+		return values[i].key < values[j].key
+	})
+	return &btreeIterator{
+		currentIndex: 0,
+		reverse:      reverse,
+		values:       values,
+	}, nil
+}
+
+func (h *HashIndex) Close() error {
+	return nil
+}
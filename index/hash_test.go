@@ -0,0 +1,171 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func TestHashIndex_Put_Get(t *testing.T) {
+	hash := NewHashIndex()
+	res1, err := hash.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
+	assert.Nil(t, res1)
+	assert.Equal(t, &data.LogRecordPos{1, 11, 0}, getPos(t, hash, nil))
+
+	res2, err := hash.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22, Size: 10})
+	assert.Nil(t, err)
+	assert.Nil(t, res2)
+	// 返回的是旧值
+	res3, err := hash.Put([]byte("aa"), &data.LogRecordPos{Fid: 3, Offset: 33, Size: 12})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{2, 22, 10}, res3)
+	assert.Equal(t, &data.LogRecordPos{3, 33, 12}, getPos(t, hash, []byte("aa")))
+
+	assert.Nil(t, getPos(t, hash, []byte("not-exist")))
+	assert.Equal(t, 2, indexSize(t, hash))
+}
+
+func TestHashIndex_Delete(t *testing.T) {
+	hash := NewHashIndex()
+	oldPos, ok, err := hash.Delete([]byte("not-exist"))
+	assert.Nil(t, err)
+	assert.Nil(t, oldPos)
+	assert.False(t, ok)
+
+	hash.Put([]byte("asd"), &data.LogRecordPos{Fid: 2, Offset: 201})
+	oldPos, ok, err = hash.Delete([]byte("asd"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{2, 201, 0}, oldPos)
+	assert.Nil(t, getPos(t, hash, []byte("asd")))
+	assert.Equal(t, 0, indexSize(t, hash))
+}
+
+func TestHashIndex_Iterator(t *testing.T) {
+	hash := NewHashIndex()
+	iter1, err := hash.Iterator(false)
+	assert.Nil(t, err)
+	assert.False(t, iter1.Valid())
+
+	// 分布在不同分片中的 key，迭代时按照顺序返回
+	for i := 99; i >= 0; i-- {
+		hash.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter2, err := hash.Iterator(false)
+	assert.Nil(t, err)
+	var i int
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		assert.Equal(t, utils.GetTestKey(i), iter2.Key())
+		assert.Equal(t, int64(i), iter2.Value().Offset)
+		i++
+	}
+	assert.Equal(t, 100, i)
+
+	iter3, err := hash.Iterator(true)
+	assert.Nil(t, err)
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		i--
+		assert.Equal(t, utils.GetTestKey(i), iter3.Key())
+	}
+	assert.Equal(t, 0, i)
+
+	// 测试 seek
+	seekKey := append(utils.GetTestKey(50), 'a')
+	iter4, err := hash.Iterator(false)
+	assert.Nil(t, err)
+	iter4.Seek(seekKey)
+	assert.True(t, iter4.Valid())
+	assert.Equal(t, utils.GetTestKey(51), iter4.Key())
+	iter3.Seek(seekKey)
+	assert.True(t, iter3.Valid())
+	assert.Equal(t, utils.GetTestKey(50), iter3.Key())
+
+	// 迭代器是快照，之后的修改不影响迭代器
+	hash.Put(utils.GetTestKey(50), &data.LogRecordPos{Fid: 2, Offset: 50})
+	assert.Equal(t, uint32(1), iter3.Value().Fid)
+}
+
+// 比较各个内存索引的读写性能
+func benchmarkIndexes() map[string]func() Indexer {
+	return map[string]func() Indexer{
+		"Btree": func() Indexer { return NewBtree() },
+		"ART":   func() Indexer { return NewART() },
+		"Hash":  func() Indexer { return NewHashIndex() },
+	}
+}
+
+func BenchmarkIndex_Put(b *testing.B) {
+	for name, newIndexer := range benchmarkIndexes() {
+		b.Run(name, func(b *testing.B) {
+			indexer := newIndexer()
+			keys := make([][]byte, b.N)
+			for i := range keys {
+				keys[i] = utils.GetTestKey(i)
+			}
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				indexer.Put(keys[i], &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+		})
+	}
+}
+
+func BenchmarkIndex_Get(b *testing.B) {
+	const keyNum = 100000
+	keys := make([][]byte, keyNum)
+	for i := range keys {
+		keys[i] = utils.GetTestKey(i)
+	}
+	// 随机的读取顺序
+	lookups := make([][]byte, keyNum)
+	for i, j := range rand.Perm(keyNum) {
+		lookups[i] = keys[j]
+	}
+	for name, newIndexer := range benchmarkIndexes() {
+		b.Run(name, func(b *testing.B) {
+			indexer := newIndexer()
+			for i, key := range keys {
+				indexer.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if pos, _ := indexer.Get(lookups[i%keyNum]); pos == nil {
+					b.Fatalf("key %s not found", lookups[i%keyNum])
+				}
+			}
+		})
+	}
+}
+
+// 比较各个内存索引中每个 key 占用的内存，包括 key 本身和位置索引
+func BenchmarkIndex_Memory(b *testing.B) {
+	const keyNum = 100000
+	for name, newIndexer := range benchmarkIndexes() {
+		b.Run(name, func(b *testing.B) {
+			var stats runtime.MemStats
+			var total uint64
+			var estimated int64
+			for n := 0; n < b.N; n++ {
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				before := stats.HeapAlloc
+				indexer := newIndexer()
+				for i := 0; i < keyNum; i++ {
+					indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				total += stats.HeapAlloc - before
+				estimated += indexer.MemorySize()
+			}
+			b.ReportMetric(float64(total)/float64(b.N*keyNum), "bytes/key")
+			b.ReportMetric(float64(estimated)/float64(b.N*keyNum), "estimated-bytes/key")
+		})
+	}
+}
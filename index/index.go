@@ -2,20 +2,22 @@ package index
 
 import (
 	"bitcask-go/data"
-	"bytes"
-	"github.com/google/btree"
+	"errors"
 )
 
 // Indexer 通用索引接口
 type Indexer interface {
-	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos // 返回被覆盖的旧值（没有的话返回 nil)
-	Get(key []byte) *data.LogRecordPos
-	Delete(key []byte) (*data.LogRecordPos, bool) // 返回被删除的旧值,和是否删除成功
-	Iterator(reverse bool) Iterator
-	Size() int    // Size 索引中存在的所有 键值对的数量
-	Close() error // Close 关闭索引
+	Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) // 返回被覆盖的旧值（没有的话返回 nil)
+	Get(key []byte) (*data.LogRecordPos, error)
+	Delete(key []byte) (*data.LogRecordPos, bool, error) // 返回被删除的旧值,和是否删除成功
+	Iterator(reverse bool) (Iterator, error)
+	Size() (int, error) // Size 索引中存在的所有 键值对的数量
+	MemorySize() int64  // MemorySize 索引大约占用的内存大小，字节为单位
+	Close() error       // Close 关闭索引
 }
 
+var ErrUnsupportedIndexType = errors.New("unsupported index type")
+
 type IndexType = int8
 
 const (
@@ -27,18 +29,23 @@ const (
 
 	// BPlusTree 持久化二叉树索引，存储索引到磁盘上
 	BPTree
+
+	// Hash 分片的哈希表索引，只适合点查询
+	Hash
 )
 
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+func NewIndexer(typ IndexType, dirPath string) (Indexer, error) {
 	switch typ {
 	case BTree:
-		return NewBtree()
+		return NewBtree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
-		return NewBPlusTree(dirPath, sync)
+		return NewBPlusTree(dirPath)
+	case Hash:
+		return NewHashIndex(), nil
 	default:
-		panic("unsupported index type")
+		return nil, ErrUnsupportedIndexType
 	}
 }
 
@@ -47,10 +54,6 @@ type Item struct {
 	pos *data.LogRecordPos
 }
 
-func (item *Item) Less(bi btree.Item) bool {
-	return bytes.Compare(item.key, bi.(*Item).key) == -1
-}
-
 // Iterator 通用索引迭代器
 type Iterator interface {
 	// Rewind 倒回到迭代器的起点，即第一个迭代器
@@ -65,7 +68,7 @@ type Iterator interface {
 	// Valid 判断当前迭代器是否有效, 即是否已经到了迭代器的末尾
 	Valid() bool
 
-	// Key 获取当前迭代器的 key
+	// Key 获取当前迭代器的 key，返回的数据可能引用索引内部的内存，调用方不能修改
 	Key() []byte
 
 	// Value 获取当前迭代器的 value 所在的位置索引
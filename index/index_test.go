@@ -0,0 +1,21 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// getPos 读取 key 的位置索引，索引出错时测试失败
+func getPos(t testing.TB, indexer Indexer, key []byte) *data.LogRecordPos {
+	pos, err := indexer.Get(key)
+	assert.Nil(t, err)
+	return pos
+}
+
+// indexSize 获取索引中 key 的数量，索引出错时测试失败
+func indexSize(t testing.TB, indexer Indexer) int {
+	size, err := indexer.Size()
+	assert.Nil(t, err)
+	return size
+}
@@ -0,0 +1,210 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"container/heap"
+	"sync"
+)
+
+// ShardedIndex 分片索引
+// 按照 key 的哈希值将数据分散到多个子索引中，每个子索引使用自己的锁，
+// 并发写入不同分片的 key 时不会互相阻塞。迭代时按照 key 的顺序合并所有分片的迭代器。
+// 每个分片的迭代器各自在创建时获取快照，合并之后并不是整个索引在同一时刻的一致性快照：
+// 创建迭代器的过程中并发的写入，可能只在后创建迭代器的分片中可见
+type ShardedIndex struct {
+	shards []Indexer
+	locks  []sync.Mutex // PutIfNewer 中读取和写入同一个分片时使用
+}
+
+// NewShardedIndex 创建 shardNum 个分片的索引，newShard 用于创建每个分片的子索引
+func NewShardedIndex(shardNum int, newShard func() (Indexer, error)) (*ShardedIndex, error) {
+	si := &ShardedIndex{
+		shards: make([]Indexer, 0, shardNum),
+		locks:  make([]sync.Mutex, shardNum),
+	}
+	for i := 0; i < shardNum; i++ {
+		shard, err := newShard()
+		if err != nil {
+			_ = si.Close()
+			return nil, err
+		}
+		si.shards = append(si.shards, shard)
+	}
+	return si, nil
+}
+
+func (si *ShardedIndex) shard(key []byte) Indexer {
+	return si.shards[hashKey(key)%uint32(len(si.shards))]
+}
+
+// PutIfNewer 索引中没有 key，或者 pos 比已有的位置更新时才写入，只锁住 key 所在的分片
+// 在数据库的锁外更新索引时，同一个 key 的更新顺序可能和写入数据文件的顺序不一致，所以只保留更新的位置。
+// 返回失效的位置：被覆盖的旧位置，或者索引中已经有更新的位置时返回 pos 本身。不能和同一个 key 的 Put、Delete 并发调用
+func (si *ShardedIndex) PutIfNewer(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	i := hashKey(key) % uint32(len(si.shards))
+	si.locks[i].Lock()
+	defer si.locks[i].Unlock()
+
+	shard := si.shards[i]
+	oldPos, err := shard.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if oldPos != nil && !positionBefore(oldPos, pos) {
+		return pos, nil
+	}
+	return shard.Put(key, pos)
+}
+
+func (si *ShardedIndex) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	return si.shard(key).Put(key, pos)
+}
+
+func (si *ShardedIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	return si.shard(key).Get(key)
+}
+
+func (si *ShardedIndex) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	return si.shard(key).Delete(key)
+}
+
+func (si *ShardedIndex) Size() (int, error) {
+	var size int
+	for _, shard := range si.shards {
+		shardSize, err := shard.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += shardSize
+	}
+	return size, nil
+}
+
+func (si *ShardedIndex) MemorySize() int64 {
+	var size int64
+	for _, shard := range si.shards {
+		size += shard.MemorySize()
+	}
+	return size
+}
+
+func (si *ShardedIndex) Iterator(reverse bool) (Iterator, error) {
+	iters := make([]Iterator, 0, len(si.shards))
+	for _, shard := range si.shards {
+		iter, err := shard.Iterator(reverse)
+		if err != nil {
+			for _, iter := range iters {
+				iter.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	return newShardedIterator(iters, reverse), nil
+}
+
+func (si *ShardedIndex) Close() error {
+	var err error
+	for _, shard := range si.shards {
+		if closeErr := shard.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// shardedIterator 分片索引迭代器
+// 同一个 key 只会存在于一个分片中，用堆按照 key 的顺序归并各个分片的迭代器即可
+type shardedIterator struct {
+	iters   []Iterator
+	reverse bool
+	valid   []int // 还有数据的分片迭代器下标，按照当前 key 组成的堆
+}
+
+func newShardedIterator(iters []Iterator, reverse bool) *shardedIterator {
+	it := &shardedIterator{iters: iters, reverse: reverse}
+	it.init()
+	return it
+}
+
+// init 子迭代器的位置改变之后，重新建堆
+func (it *shardedIterator) init() {
+	it.valid = it.valid[:0]
+	for i, iter := range it.iters {
+		if iter.Valid() {
+			it.valid = append(it.valid, i)
+		}
+	}
+	heap.Init(it)
+}
+
+func (it *shardedIterator) Len() int {
+	return len(it.valid)
+}
+
+func (it *shardedIterator) Less(i, j int) bool {
+	cmp := bytes.Compare(it.iters[it.valid[i]].Key(), it.iters[it.valid[j]].Key())
+	if it.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (it *shardedIterator) Swap(i, j int) {
+	it.valid[i], it.valid[j] = it.valid[j], it.valid[i]
+}
+
+func (it *shardedIterator) Push(x any) {
+	it.valid = append(it.valid, x.(int))
+}
+
+func (it *shardedIterator) Pop() any {
+	n := len(it.valid)
+	x := it.valid[n-1]
+	it.valid = it.valid[:n-1]
+	return x
+}
+
+func (it *shardedIterator) Rewind() {
+	for _, iter := range it.iters {
+		iter.Rewind()
+	}
+	it.init()
+}
+
+func (it *shardedIterator) Seek(key []byte) {
+	for _, iter := range it.iters {
+		iter.Seek(key)
+	}
+	it.init()
+}
+
+func (it *shardedIterator) Next() {
+	iter := it.iters[it.valid[0]]
+	iter.Next()
+	if iter.Valid() {
+		heap.Fix(it, 0)
+	} else {
+		heap.Pop(it)
+	}
+}
+
+func (it *shardedIterator) Valid() bool {
+	return len(it.valid) > 0
+}
+
+func (it *shardedIterator) Key() []byte {
+	return it.iters[it.valid[0]].Key()
+}
+
+func (it *shardedIterator) Value() *data.LogRecordPos {
+	return it.iters[it.valid[0]].Value()
+}
+
+func (it *shardedIterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+	it.valid = nil
+}
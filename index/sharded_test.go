@@ -0,0 +1,169 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func newTestShardedIndex() *ShardedIndex {
+	si, _ := NewShardedIndex(8, func() (Indexer, error) { return NewBtree(), nil })
+	return si
+}
+
+func TestShardedIndex_Put_Get_Delete(t *testing.T) {
+	si := newTestShardedIndex()
+	res1, err := si.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
+	assert.Nil(t, res1)
+	res2, err := si.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{1, 11, 0}, res2)
+	assert.Equal(t, &data.LogRecordPos{2, 22, 0}, getPos(t, si, []byte("aa")))
+	assert.Nil(t, getPos(t, si, []byte("bb")))
+
+	for i := 0; i < 100; i++ {
+		si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Equal(t, 101, indexSize(t, si))
+
+	oldPos, ok, err := si.Delete([]byte("aa"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{2, 22, 0}, oldPos)
+	_, ok, err = si.Delete([]byte("aa"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 100, indexSize(t, si))
+	assert.Nil(t, si.Close())
+}
+
+func TestShardedIndex_Iterator(t *testing.T) {
+	si := newTestShardedIndex()
+	iter1, err := si.Iterator(false)
+	assert.Nil(t, err)
+	assert.False(t, iter1.Valid())
+
+	// 各个分片的数据按照 key 的顺序合并
+	for _, i := range rand.Perm(200) {
+		si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter2, err := si.Iterator(false)
+	assert.Nil(t, err)
+	var i int
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		assert.Equal(t, utils.GetTestKey(i), iter2.Key())
+		assert.Equal(t, int64(i), iter2.Value().Offset)
+		i++
+	}
+	assert.Equal(t, 200, i)
+
+	iter3, err := si.Iterator(true)
+	assert.Nil(t, err)
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		i--
+		assert.Equal(t, utils.GetTestKey(i), iter3.Key())
+	}
+	assert.Equal(t, 0, i)
+
+	// 测试 seek
+	seekKey := append(utils.GetTestKey(50), 'a')
+	iter2.Seek(seekKey)
+	assert.True(t, iter2.Valid())
+	assert.Equal(t, utils.GetTestKey(51), iter2.Key())
+	iter2.Next()
+	assert.Equal(t, utils.GetTestKey(52), iter2.Key())
+	iter3.Seek(seekKey)
+	assert.True(t, iter3.Valid())
+	assert.Equal(t, utils.GetTestKey(50), iter3.Key())
+	iter3.Next()
+	assert.Equal(t, utils.GetTestKey(49), iter3.Key())
+
+	iter2.Close()
+	iter3.Close()
+	assert.False(t, iter3.Valid())
+}
+
+func TestShardedIndex_PutIfNewer(t *testing.T) {
+	si := newTestShardedIndex()
+	res1, err := si.PutIfNewer([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	assert.Nil(t, err)
+	assert.Nil(t, res1)
+
+	// 比索引中更旧的位置不会覆盖，返回它自己
+	res2, err := si.PutIfNewer([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{1, 11, 0}, res2)
+	assert.Equal(t, &data.LogRecordPos{2, 22, 0}, getPos(t, si, []byte("aa")))
+
+	// 更新的位置覆盖索引，返回旧的位置
+	res3, err := si.PutIfNewer([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 33})
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{2, 22, 0}, res3)
+	assert.Equal(t, &data.LogRecordPos{2, 33, 0}, getPos(t, si, []byte("aa")))
+}
+
+// 并发读写索引，需要使用 go test -race 运行才能检查出数据竞争
+func TestIndex_Concurrent(t *testing.T) {
+	indexes := map[string]func() Indexer{
+		"btree":   func() Indexer { return NewBtree() },
+		"art":     func() Indexer { return NewART() },
+		"hash":    func() Indexer { return NewHashIndex() },
+		"sharded": func() Indexer { return newTestShardedIndex() },
+	}
+	for name, newIndexer := range indexes {
+		t.Run(name, func(t *testing.T) {
+			indexer := newIndexer()
+			const workers, keyNum = 8, 500
+			wg := new(sync.WaitGroup)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(int64(w)))
+					for i := 0; i < 2000; i++ {
+						key := utils.GetTestKey(rnd.Intn(keyNum))
+						switch rnd.Intn(4) {
+						case 0:
+							indexer.Delete(key)
+						case 1:
+							iter, err := indexer.Iterator(rnd.Intn(2) == 0)
+							assert.Nil(t, err)
+							for iter.Rewind(); iter.Valid(); iter.Next() {
+								_ = iter.Value()
+							}
+							iter.Close()
+						default:
+							indexer.Put(key, &data.LogRecordPos{Fid: uint32(w), Offset: int64(i)})
+							_ = getPos(t, indexer, key)
+						}
+						_ = indexSize(t, indexer)
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			// 每个 key 只能被一个 worker 写入，检查最终的数据是否一致
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < keyNum; i += workers {
+						key := []byte(fmt.Sprintf("owned-%d", i))
+						indexer.Put(key, &data.LogRecordPos{Fid: uint32(w), Offset: int64(i)})
+					}
+				}(w)
+			}
+			wg.Wait()
+			for i := 0; i < keyNum; i++ {
+				pos, err := indexer.Get([]byte(fmt.Sprintf("owned-%d", i)))
+				assert.Nil(t, err)
+				assert.Equal(t, &data.LogRecordPos{Fid: uint32(i % workers), Offset: int64(i)}, pos)
+			}
+		})
+	}
+}
@@ -14,8 +14,11 @@ type Iterator struct {
 }
 
 // NewIterator 初始化迭代器
-func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIterator := db.index.Iterator(opts.Reverse)
+func (db *DB) NewIterator(opts IteratorOptions) (*Iterator, error) {
+	indexIterator, err := db.index.Iterator(opts.Reverse)
+	if err != nil {
+		return nil, err
+	}
 
 	iterator := Iterator{
 		indexIterator: indexIterator,
@@ -24,7 +27,7 @@ func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
 	}
 	// 跳过不符合前缀的 key
 	iterator.skipToNext()
-	return &iterator
+	return &iterator, nil
 }
 
 func (it *Iterator) Rewind() {
@@ -46,8 +49,9 @@ func (it *Iterator) Valid() bool {
 	return it.indexIterator.Valid()
 }
 
+// Key 获取当前迭代器的 key，返回的是复制出来的数据，调用方可以修改和保留
 func (it *Iterator) Key() []byte {
-	return it.indexIterator.Key()
+	return bytes.Clone(it.indexIterator.Key())
 }
 
 // Value 获取当前迭代器的 value 值
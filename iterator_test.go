@@ -17,7 +17,8 @@ func TestDB_NewIterator(t *testing.T) {
 	assert.NotNil(t, db)
 
 	// 初始化迭代器
-	iter := db.NewIterator(DefaultIteratorOptions)
+	iter, err := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
 	defer iter.Close()
 	assert.NotNil(t, iter)
 	assert.Equal(t, false, iter.Valid())
@@ -40,7 +41,8 @@ func TestIterator_Value(t *testing.T) {
 	assert.Nil(t, err)
 
 	// 初始化迭代器
-	iter := db.NewIterator(DefaultIteratorOptions)
+	iter, err := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
 	assert.NotNil(t, iter)
 	assert.Equal(t, true, iter.Valid())
 	resValue, err := iter.Value()
@@ -57,7 +59,8 @@ func TestIterator_Value(t *testing.T) {
 	_ = db.Put(key2, value2)
 	iteratorOpts := DefaultIteratorOptions
 	iteratorOpts.Prefix = []byte("a")
-	iter2 := db.NewIterator(iteratorOpts)
+	iter2, err := db.NewIterator(iteratorOpts)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.EqualValues(t, key2, iter2.Key())
 	resValue2, err := iter2.Value()
@@ -90,7 +93,8 @@ func TestIterator_Multi_Value(t *testing.T) {
 	iteratorOpts := DefaultIteratorOptions
 	iteratorOpts.Reverse = true
 	iteratorOpts.Prefix = []byte("a")
-	iter := db.NewIterator(iteratorOpts)
+	iter, err := db.NewIterator(iteratorOpts)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		// t.Log("key = ", string(iter.Key()))
 		assert.NotNil(t, iter.Key())
@@ -100,7 +104,8 @@ func TestIterator_Multi_Value(t *testing.T) {
 	// seek 测试
 	iteratorOpts.Prefix = []byte("")
 	iteratorOpts.Reverse = true
-	iter2 := db.NewIterator(iteratorOpts)
+	iter2, err := db.NewIterator(iteratorOpts)
+	assert.Nil(t, err)
 	for iter2.Seek([]byte("c")); iter2.Valid(); iter2.Next() {
 		// t.Log("key = ", string(iter2.Key()))
 		assert.NotNil(t, iter2.Key())
@@ -2,17 +2,28 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"io"
 	"os"
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 const (
-	mergeDirName     = "-merge"
-	mergeFinishedKey = "merge.finished"
+	mergeDirName      = "-merge"
+	mergeFinishedKey  = "merge.finished"
+	mergeKeptFilesKey = "merge.kept-files"
+)
+
+// merge 过程中的阶段，用于测试时通过 DB.mergeHook 在对应阶段注入操作
+const (
+	mergeStageRotate   = "rotate"   // 轮转活跃文件并释放锁之后
+	mergeStageRewrite  = "rewrite"  // 有效数据写入 mergeDB 之后，持久化之前
+	mergeStageFinished = "finished" // 写入 merge 完成标识之后
 )
 
 // Merge 清理无效数据，生成 Hint 文件
@@ -22,35 +33,46 @@ func (db *DB) Merge() error {
 		return nil
 	}
 
-	// 加锁
+	// 加锁，B+ 树索引还要等待正在更新的索引
+	db.indexUpdateLock.Lock()
 	db.lock.Lock()
+	unlock := func() {
+		db.lock.Unlock()
+		db.indexUpdateLock.Unlock()
+	}
 
 	// 是否有进程在 Merge
 	if db.isMerging {
-		db.lock.Unlock()
+		unlock()
 		return ErrMergeIsPrecessing
 	}
 
+	// 写缓冲区中的数据也要计入数据量
+	if err := db.activeFile.Flush(); err != nil {
+		unlock()
+		return err
+	}
+
 	// 查看可以 merge 的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := utils.DirSize(db.options.FS, db.options.DirPath)
 	if err != nil {
-		db.lock.Unlock()
+		unlock()
 		return err
 	}
 	// 没达到阈值，不用合并
 	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
-		db.lock.Unlock()
+		unlock()
 		return ErrMergeRatioUnreached
 	}
 
 	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
+	availableDiskSize, err := db.options.FS.AvailableSize(db.options.DirPath)
 	if err != nil {
-		db.lock.Unlock()
+		unlock()
 		return err
 	}
 	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
-		db.lock.Unlock()
+		unlock()
 		return ErrNoEnoughSpaceForMerge
 	}
 
@@ -59,16 +81,9 @@ func (db *DB) Merge() error {
 		db.isMerging = false
 	}()
 
-	// 将当前活跃文件转化为旧的数据文件
-	if err := db.activeFile.Sync(); err != nil {
-		db.lock.Unlock()
-		return err
-	}
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-	// 创建新的活跃文件,用于在 Merge 过程中的读写
-	if err := db.setActiveDateFile(); err != nil {
-		db.lock.Unlock()
+	// 将当前活跃文件转化为旧的数据文件，创建新的活跃文件,用于在 Merge 过程中的读写
+	if err := db.rotateActiveFile(); err != nil {
+		unlock()
 		return err
 	}
 	nonMergeFileId := db.activeFile.FileId
@@ -78,19 +93,28 @@ func (db *DB) Merge() error {
 	for _, df := range db.olderFiles {
 		mergeFiles = append(mergeFiles, df)
 	}
-	db.lock.Unlock() // 及时释放锁，为了在 Merge 过程中能够正常的读写新的数据
+
+	// 在锁内获取索引的快照，事务提交时持有锁写数据并更新索引，所以快照中要么包含一个事务的全部修改，要么都不包含。
+	// 不能在重写时查找最新的索引：轮转之后没有持久化的写入会让旧版本被丢弃，崩溃丢失这些写入之后旧版本也找不回来了
+	iter, err := db.index.Iterator(false)
+	unlock() // 及时释放锁，为了在 Merge 过程中能够正常的读写新的数据
+	if err != nil {
+		return err
+	}
+	validPositions := mergePositions(iter, nonMergeFileId)
+	db.runMergeHook(mergeStageRotate)
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 
 	// 创建新的 Merge 文件夹
 	mergePath := db.getMergePath()
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
+	if _, err := db.options.FS.Stat(mergePath); err == nil {
+		if err := db.options.FS.RemoveAll(mergePath); err != nil {
 			return err // 如果存在的话，删除旧的 Merge 文件夹
 		}
 	}
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+	if err := db.options.FS.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
 
@@ -98,16 +122,54 @@ func (db *DB) Merge() error {
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.IndexCheckpointInterval = 0
+	mergeOptions.OnOpenPhase = nil
+	// merge 文件在完成之后才会持久化并使用，崩溃时整个 merge 都会被丢弃，可以一直开启写缓冲
+	mergeOptions.WriteBufferSize = syncedFileWriteBufferSize
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	// merge 失败时也要关闭 mergeDB，释放 merge 目录的文件锁，之后才能重新 merge
+	mergeDBClosed := false
+	defer func() {
+		if !mergeDBClosed {
+			_ = mergeDB.Close()
+		}
+	}()
 
-	// 新建 Hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	// 数据目录中可能还有不在 mergeFiles 中的旧文件（比如在运行过程中从备份拷贝进来的），它们不会被删除，
+	// 重启时排在 merge 文件之前回放，被删除的 key 如果在其中还有更早的版本，就需要保留墓碑；
+	// 其中有更新版本的 key 不能写入 merge 文件，否则回放时会覆盖掉更新的版本
+	outside, err := db.readOutsideMergeFiles(mergeFiles, nonMergeFileId)
 	if err != nil {
 		return err
 	}
+	keptFileIds := outside.fileIds
+
+	// 新建 Hint 文件存储索引，有保留的旧文件时启动需要按顺序回放所有文件，不生成 hint 文件
+	var hintWriter *data.HintWriter
+	if len(keptFileIds) == 0 {
+		hintFile, err := data.OpenHintFile(db.options.FS, mergePath)
+		if err != nil {
+			return err
+		}
+		if err := hintFile.SetWriteBuffer(syncedFileWriteBufferSize); err != nil {
+			return err
+		}
+		defer hintFile.Close()
+		hintWriter = data.NewHintWriter(hintFile)
+	}
+
+	keepTombstone := func(key []byte) error {
+		_, err := mergeDB.appendLogRecord(&data.LogRecord{
+			Key:  encodeKeyWithSeqNo(key, nonTransactionSeqNo),
+			Type: data.LogRecordDeleted,
+		})
+		return err
+	}
+	// 事务中的墓碑在读到事务完成的标识之后才能保留
+	txnTombstones := make(map[uint64][][]byte)
 
 	// 遍历处理 mergeFiles 中的 DataFile
 	for _, dataFile := range mergeFiles {
@@ -121,12 +183,17 @@ func (db *DB) Merge() error {
 				return err
 			}
 
-			realKey, _ := DecodeKeyWithSeqNo(record.Key)
-			recordPos := db.index.Get(realKey)
+			realKey, seqNo := DecodeKeyWithSeqNo(record.Key)
+			if fileId, ok := outside.newest[string(realKey)]; ok && fileId > dataFile.FileId && record.Type != data.LogRecordTxnFinished {
+				offset += size
+				continue
+			}
 
-			// 和内存中的索引位置比较，如果是有效数据，则写入 mergeDB
-			if recordPos != nil && recordPos.Fid == dataFile.FileId && recordPos.Offset == offset {
-				// 清除事务标记, 并写入
+			// 和索引快照中的位置比较，如果是有效数据，则写入 mergeDB
+			// 被覆盖的旧数据直接丢弃；墓碑只有在保留的旧文件中还有这个 key 更早的版本时才保留，
+			// 其他更早的版本都在 mergeFiles 中，安装时会和墓碑一起被删除
+			if _, ok := validPositions[mergePosition{fid: dataFile.FileId, offset: offset}]; ok {
+				// 索引只会指向已经提交的事务数据，所以可以清除事务标记, 并写入
 				record.Key = encodeKeyWithSeqNo(realKey, nonTransactionSeqNo)
 				mergeRecordPos, err := mergeDB.appendLogRecord(record)
 				if err != nil {
@@ -134,162 +201,566 @@ func (db *DB) Merge() error {
 				}
 
 				// 更新 hint 文件,将当前位置写入 hint 文件
-				if err := hintFile.WriteHintRecord(realKey, mergeRecordPos); err != nil {
-					return err
+				if hintWriter != nil {
+					if err := hintWriter.WriteHintRecord(realKey, mergeRecordPos); err != nil {
+						return err
+					}
 				}
+			} else if record.Type == data.LogRecordDeleted {
+				if fileId, ok := outside.oldest[string(realKey)]; ok && fileId < dataFile.FileId {
+					if seqNo == nonTransactionSeqNo {
+						if err := keepTombstone(realKey); err != nil {
+							return err
+						}
+					} else {
+						txnTombstones[seqNo] = append(txnTombstones[seqNo], append([]byte(nil), realKey...))
+					}
+				}
+			} else if record.Type == data.LogRecordTxnFinished {
+				for _, key := range txnTombstones[seqNo] {
+					if err := keepTombstone(key); err != nil {
+						return err
+					}
+				}
+				delete(txnTombstones, seqNo)
 			}
 			// 到下一个 record 的位置
 			offset += size
 		}
 	}
 
-	// 持久化 mergeDB
-	if err := hintFile.Sync(); err != nil {
-		return err
+	db.runMergeHook(mergeStageRewrite)
+
+	// 写入 hint 文件的结尾记录，持久化 mergeDB
+	if hintWriter != nil {
+		if err := hintWriter.Finish(); err != nil {
+			return err
+		}
 	}
 	if err := mergeDB.Sync(); err != nil {
 		return err
 	}
+	mergeDBClosed = true
+	if err := mergeDB.Close(); err != nil {
+		return err
+	}
+
+	// merge 文件要排在保留的旧文件之后回放，移动到紧挨着 nonMergeFileId 之前的文件 id 上，并记录需要保留的旧文件
+	if len(keptFileIds) > 0 {
+		if err := db.moveMergeFilesUp(mergePath, nonMergeFileId, keptFileIds); err != nil {
+			return err
+		}
+		keptFile, err := data.OpenMergeKeptFilesFile(db.options.FS, mergePath)
+		if err != nil {
+			return err
+		}
+		defer keptFile.Close()
+		if err := writeFileIdsRecord(keptFile, mergeKeptFilesKey, keptFileIds); err != nil {
+			return err
+		}
+	}
 
 	// 写入标识 merge 完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishFile(mergePath)
+	mergeFinishedFile, err := data.OpenMergeFinishFile(db.options.FS, mergePath)
 	if err != nil {
 		return err
 	}
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
-	}
-	encodeLogRecord, _ := data.EncodeLogRecord(mergeFinRecord)
-	if err := mergeFinishedFile.Write(encodeLogRecord); err != nil {
+	defer mergeFinishedFile.Close()
+	if err := writeFileIdRecord(mergeFinishedFile, mergeFinishedKey, nonMergeFileId); err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+	db.runMergeHook(mergeStageFinished)
+
+	return nil
+}
+
+// mergePosition 数据在旧文件中的位置
+type mergePosition struct {
+	fid    uint32
+	offset int64
+}
+
+// mergePositions 从锁内获取的索引快照中取出所有位于 nonMergeFileId 之前文件中的数据位置，不需要持有数据库的锁
+func mergePositions(iter index.Iterator, nonMergeFileId uint32) map[mergePosition]struct{} {
+	defer iter.Close()
+	positions := make(map[mergePosition]struct{})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		pos := iter.Value()
+		if pos.Fid < nonMergeFileId {
+			positions[mergePosition{fid: pos.Fid, offset: pos.Offset}] = struct{}{}
+		}
+	}
+	return positions
+}
+
+func (db *DB) runMergeHook(stage string) {
+	if db.mergeHook != nil {
+		db.mergeHook(stage)
+	}
+}
+
+// outsideMergeFiles 数据目录中没有参与 merge 的旧文件
+type outsideMergeFiles struct {
+	fileIds []uint32          // 文件 id，从小到大排列
+	oldest  map[string]uint32 // 出现过的 key 和包含它的最小文件 id
+	newest  map[string]uint32 // 回放时会生效的 key 和包含它的最大文件 id，没有完成的事务中的数据不算
+}
+
+// readOutsideMergeFiles 找出数据目录中 nonMergeFileId 之前但不在 mergeFiles 中的数据文件，并读取其中的 key
+func (db *DB) readOutsideMergeFiles(mergeFiles []*data.DataFile, nonMergeFileId uint32) (*outsideMergeFiles, error) {
+	merged := make(map[uint32]struct{}, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		merged[dataFile.FileId] = struct{}{}
+	}
+	dirEntries, err := db.options.FS.ReadDir(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		if _, ok := merged[uint32(fileId)]; !ok && uint32(fileId) < nonMergeFileId {
+			fileIds = append(fileIds, uint32(fileId))
+		}
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	outside := &outsideMergeFiles{
+		fileIds: fileIds,
+		oldest:  make(map[string]uint32),
+		newest:  make(map[string]uint32),
+	}
+	// 事务中的 key 在读到事务完成的标识之后才会生效
+	txnKeys := make(map[uint64][]string)
+	for _, fileId := range fileIds {
+		dataFile, err := data.OpenDateFile(db.options.FS, db.options.DirPath, fileId, fio.StandardIO)
+		if err != nil {
+			return nil, err
+		}
+		var offset int64
+		for {
+			record, size, err := dataFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = dataFile.Close()
+				return nil, err
+			}
+			offset += size
+			realKey, seqNo := DecodeKeyWithSeqNo(record.Key)
+			if record.Type == data.LogRecordTxnFinished {
+				for _, key := range txnKeys[seqNo] {
+					outside.newest[key] = fileId
+				}
+				delete(txnKeys, seqNo)
+				continue
+			}
+			if _, ok := outside.oldest[string(realKey)]; !ok {
+				outside.oldest[string(realKey)] = fileId
+			}
+			if seqNo == nonTransactionSeqNo {
+				outside.newest[string(realKey)] = fileId
+			} else {
+				txnKeys[seqNo] = append(txnKeys[seqNo], string(realKey))
+			}
+		}
+		if err := dataFile.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return outside, nil
+}
+
+// moveMergeFilesUp 把 merge 目录中从 0 开始编号的数据文件移动到 nonMergeFileId 之前的最后几个文件 id 上，
+// 这些文件 id 必须都大于保留的旧文件
+func (db *DB) moveMergeFilesUp(mergePath string, nonMergeFileId uint32, keptFileIds []uint32) error {
+	dirEntries, err := db.options.FS.ReadDir(mergePath)
+	if err != nil {
 		return err
 	}
+	var fileNum uint32
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			fileNum++
+		}
+	}
+	if fileNum > nonMergeFileId || nonMergeFileId-fileNum <= keptFileIds[len(keptFileIds)-1] {
+		return ErrNoFileIdForMerge
+	}
 
+	// 从后往前移动，避免覆盖还没有移动的文件
+	firstFileId := nonMergeFileId - fileNum
+	for i := fileNum; i > 0; i-- {
+		srcPath := data.GetDataFileName(mergePath, i-1)
+		destPath := data.GetDataFileName(mergePath, firstFileId+i-1)
+		if err := db.options.FS.Rename(srcPath, destPath); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (db *DB) getMergePath() string {
-	dir := path.Dir(path.Clean(db.options.DirPath))
-	base := path.Base(db.options.DirPath)
+	return mergePathOf(db.options.DirPath)
+}
+
+// mergePathOf 数据目录 dirPath 对应的 merge 目录
+func mergePathOf(dirPath string) string {
+	dir := path.Dir(path.Clean(dirPath))
+	base := path.Base(dirPath)
 	return path.Join(dir, base+mergeDirName)
 }
 
 // 在数据库启动的时候对 mergeIndex（在 hint 文件中） 进行处理
+// 安装过程可能在任意一步崩溃，下次启动时会从 merge 文件夹继续安装，所以每一步都需要可以重复执行
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergePath()
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.options.FS.Stat(mergePath); os.IsNotExist(err) {
 		return nil // 数据库不存在 merge 文件夹
 	}
-	defer func() {
-		if err := os.RemoveAll(mergePath); err != nil {
-			panic(err)
-		}
-	}()
 
 	// 遍历 mergeDB 下的文件，找出需要 merge 的data数据
-	var mergeFinished bool
+	var mergeFinished, oldFilesRemoved bool
 	var mergeFileNames []string
-	dirEntries, err := os.ReadDir(mergePath)
+	dirEntries, err := db.options.FS.ReadDir(mergePath)
 	if err != nil {
 		return err
 	}
 	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
+		switch entry.Name() {
+		case data.MergeFinishedFileName:
+			// merge 完成的标识最后再移动
 			mergeFinished = true
+		case data.MergeInstallingFileName:
+			oldFilesRemoved = true
+		case data.MergeKeptFilesFileName:
+			// 保留的旧文件只在删除旧文件时使用
+		case data.SeqNoFileName, fileLockName, index.BPTreeIndexFileName:
+			// 跳过 seqNo 文件、文件锁和 mergeDB 自己的 B+ 树索引，原数据库的索引会根据 hint 文件改写
+		default:
+			mergeFileNames = append(mergeFileNames, entry.Name())
 		}
-		// 跳过 seqNo 文件
-		if entry.Name() == data.SeqNoFileName {
-			continue
-		}
-		// 跳过 block 文件
-		if entry.Name() == fileLockName {
-			continue
-		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
 	}
 
-	// 如果没有找到 mergeFinished 文件，则直接返回
+	// 如果没有找到 mergeFinished 文件，说明 merge 没有完成，直接丢弃
 	if !mergeFinished {
-		return nil
+		return db.options.FS.RemoveAll(mergePath)
 	}
 
 	// 找出合并文件的边界
+	// mergeFinished 文件在写入并持久化之前崩溃，内容是空的或者不完整，同样说明 merge 没有完成
 	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if (err == io.EOF || err == data.ErrInvalidCRC) && !oldFilesRemoved {
+		return db.options.FS.RemoveAll(mergePath)
+	}
 	if err != nil {
 		return err
 	}
 
-	// 删除 原数据库中 旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		filePath := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(filePath); err == nil {
-			if err := os.Remove(filePath); err != nil {
+	// 删除 原数据库中 旧的数据文件，merge 时没有参与合并的旧文件需要保留
+	// 如果上次安装已经删除过旧文件，原目录中 nonMergeFileId 之前的文件就是已经移动过去的 merge 文件，不能再删除
+	if !oldFilesRemoved {
+		keptFileIds, err := db.getMergeKeptFileIds(mergePath)
+		if err != nil {
+			return err
+		}
+		kept := make(map[uint32]struct{}, len(keptFileIds))
+		for _, fileId := range keptFileIds {
+			kept[fileId] = struct{}{}
+		}
+
+		// 检查点中的位置指向旧的数据文件，需要在删除旧文件之前删除
+		if err := db.removeCheckpoint(); err != nil {
+			return err
+		}
+		// 上一次 merge 的 hint 文件指向被删除的文件，这次 merge 也可能没有生成新的 hint 文件
+		hintFilePath := path.Join(db.options.DirPath, data.HintFileName)
+		if _, err := db.options.FS.Stat(hintFilePath); err == nil {
+			if err := db.options.FS.Remove(hintFilePath); err != nil {
 				return err
 			}
 		}
+
+		var fileId uint32 = 0
+		for ; fileId < nonMergeFileId; fileId++ {
+			if _, ok := kept[fileId]; ok {
+				continue
+			}
+			filePath := data.GetDataFileName(db.options.DirPath, fileId)
+			if _, err := db.options.FS.Stat(filePath); err == nil {
+				if err := db.options.FS.Remove(filePath); err != nil {
+					return err
+				}
+			}
+		}
+
+		// 标记旧文件已经删除完毕
+		installingFile, err := db.options.FS.OpenFile(path.Join(mergePath, data.MergeInstallingFileName), os.O_CREATE|os.O_TRUNC|os.O_RDWR, fio.DateFilePerm)
+		if err != nil {
+			return err
+		}
+		if err := installingFile.Sync(); err != nil {
+			return err
+		}
+		if err := installingFile.Close(); err != nil {
+			return err
+		}
 	}
 
-	// 将 mergeDB 中的数据文件 移动到 原数据库 中
+	// 将 mergeDB 中的数据文件 移动到 原数据库 中，最后移动 merge 完成的标识
+	mergeFileNames = append(mergeFileNames, data.MergeFinishedFileName)
 	for _, fileName := range mergeFileNames {
 		srcPath := path.Join(mergePath, fileName)
 		destPath := path.Join(db.options.DirPath, fileName)
-		if err := os.Rename(srcPath, destPath); err != nil {
+		if err := db.options.FS.Rename(srcPath, destPath); err != nil {
 			return err
 		}
 	}
-	return nil
+	return db.options.FS.RemoveAll(mergePath)
 }
 
 // getNonMergeFileId 从 mergeFinished 文件中获取非合并文件的边界
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-	mergeFinishFile, err := data.OpenMergeFinishFile(dirPath)
+	mergeFinishFile, err := data.OpenMergeFinishFile(db.options.FS, dirPath)
 	if err != nil {
 		return 0, err
 	}
+	defer mergeFinishFile.Close()
+	return readFileIdRecord(mergeFinishFile)
+}
 
-	record, _, err := mergeFinishFile.ReadLogRecord(0)
+// getMergeKeptFileIds 获取 merge 时保留的旧数据文件，没有保留的文件时返回 nil
+func (db *DB) getMergeKeptFileIds(mergePath string) ([]uint32, error) {
+	if _, err := db.options.FS.Stat(path.Join(mergePath, data.MergeKeptFilesFileName)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	keptFile, err := data.OpenMergeKeptFilesFile(db.options.FS, mergePath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer keptFile.Close()
+	return readFileIdsRecord(keptFile)
+}
 
-	noMergeFileId, err := strconv.Atoi(string(record.Value))
+// writeFileIdRecord 向标识文件中写入一条 value 为文件 id 的记录并持久化
+func writeFileIdRecord(file *data.DataFile, key string, fileId uint32) error {
+	record, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(key),
+		Value: []byte(strconv.Itoa(int(fileId))),
+	})
+	if err := file.Write(record); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readFileIdRecord 读取标识文件中记录的文件 id
+func readFileIdRecord(file *data.DataFile) (uint32, error) {
+	record, _, err := file.ReadLogRecord(0)
+	if err != nil {
+		return 0, err
+	}
+	fileId, err := strconv.Atoi(string(record.Value))
 	if err != nil {
 		return 0, err
 	}
-	return uint32(noMergeFileId), nil
+	return uint32(fileId), nil
 }
 
-// loadIndexFromHintFile 从 hint 文件中加载索引
-func (db *DB) loadIndexFromHintFile() error {
+// writeFileIdsRecord 向标识文件中写入一条 value 为多个文件 id 的记录并持久化，文件 id 之间用逗号分隔
+func writeFileIdsRecord(file *data.DataFile, key string, fileIds []uint32) error {
+	ids := make([]string, len(fileIds))
+	for i, fileId := range fileIds {
+		ids[i] = strconv.Itoa(int(fileId))
+	}
+	record, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(key),
+		Value: []byte(strings.Join(ids, ",")),
+	})
+	if err := file.Write(record); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readFileIdsRecord 读取标识文件中记录的多个文件 id
+func readFileIdsRecord(file *data.DataFile) ([]uint32, error) {
+	record, _, err := file.ReadLogRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, id := range strings.Split(string(record.Value), ",") {
+		fileId, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	return fileIds, nil
+}
+
+// loadIndexFromHintFile 从 hint 文件中加载 merge 文件的索引，返回需要从哪个位置开始回放数据文件
+// hint 文件不存在或者校验失败时返回零值，需要从头回放所有的数据文件
+func (db *DB) loadIndexFromHintFile() (data.LogRecordPos, error) {
+	mergeFinishedFilePath := path.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := db.options.FS.Stat(mergeFinishedFilePath); os.IsNotExist(err) {
+		return data.LogRecordPos{}, nil // 没有发生过 merge
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+	if err != nil {
+		return data.LogRecordPos{}, err
+	}
+
+	keys, positions, err := db.readHintFile(nonMergeFileId)
+	if err == data.ErrInvalidHintFile {
+		return data.LogRecordPos{}, nil
+	}
+	if err != nil {
+		return data.LogRecordPos{}, err
+	}
+	for i, key := range keys {
+		if _, err := db.index.Put(key, positions[i]); err != nil {
+			return data.LogRecordPos{}, err
+		}
+	}
+	return data.LogRecordPos{Fid: nonMergeFileId}, nil
+}
+
+// readHintFile 读取并校验 hint 文件，其中的索引必须都指向 nonMergeFileId 之前存在的数据文件
+// hint 文件不存在、不完整或者和数据文件对不上时返回 ErrInvalidHintFile
+func (db *DB) readHintFile(nonMergeFileId uint32) ([][]byte, []*data.LogRecordPos, error) {
 	hintFilePath := path.Join(db.options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFilePath); os.IsNotExist(err) {
-		return nil // hintFile 不存在
+	if _, err := db.options.FS.Stat(hintFilePath); os.IsNotExist(err) {
+		return nil, nil, data.ErrInvalidHintFile
 	}
 
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := data.OpenHintFile(db.options.FS, db.options.DirPath)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer hintFile.Close()
 
-	// 读取 hintFile 中的索引
-	var offset int64 = 0
-	for {
-		record, size, err := hintFile.ReadLogRecord(offset)
-		if err != nil {
-			if err == io.EOF {
-				break // 读到 文件末尾
+	keys, positions, footer, err := data.ReadHintFile(hintFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if footer.Count > 0 {
+		if footer.MaxFid >= nonMergeFileId {
+			return nil, nil, data.ErrInvalidHintFile
+		}
+		for fid := footer.MinFid; fid <= footer.MaxFid; fid++ {
+			if db.getDataFile(fid) == nil {
+				return nil, nil, data.ErrInvalidHintFile
 			}
-			return err
 		}
-		key := record.Key
-		pos := data.DecodeLogRecordPos(record.Value)
-		db.index.Put(key, pos)
+	}
+	return keys, positions, nil
+}
 
-		offset += size // 读取下一个索引
+// scanMergeFiles 按顺序读取 nonMergeFileId 之前的文件，获取每个 key 最后的数据位置，hint 文件不能使用时代替 hint 文件
+// merge 文件中只有有效的数据和需要保留的墓碑，它们之前可能还有 merge 时保留下来的旧文件
+func (db *DB) scanMergeFiles(nonMergeFileId uint32) ([][]byte, []*data.LogRecordPos, error) {
+	latest := make(map[string]*data.LogRecordPos)
+	apply := func(key []byte, recordType data.LogRecordType, pos *data.LogRecordPos) {
+		if recordType == data.LogRecordDeleted {
+			delete(latest, string(key))
+		} else {
+			latest[string(key)] = pos
+		}
 	}
-	return nil
+	txnRecords := make(map[uint64][]*data.TransactionRecord)
+	for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
+		dataFile := db.getDataFile(fileId)
+		if dataFile == nil {
+			continue
+		}
+		var offset int64 = 0
+		for {
+			record, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, nil, err
+			}
+			realKey, seqNo := DecodeKeyWithSeqNo(record.Key)
+			pos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
+			if seqNo == nonTransactionSeqNo {
+				apply(realKey, record.Type, pos)
+			} else if record.Type == data.LogRecordTxnFinished {
+				for _, txnRecord := range txnRecords[seqNo] {
+					apply(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+				}
+				delete(txnRecords, seqNo)
+			} else {
+				txnRecords[seqNo] = append(txnRecords[seqNo], &data.TransactionRecord{
+					Pos:    pos,
+					Record: &data.LogRecord{Key: realKey, Type: record.Type},
+				})
+			}
+			offset += size
+		}
+	}
+
+	keys := make([][]byte, 0, len(latest))
+	positions := make([]*data.LogRecordPos, 0, len(latest))
+	for key, pos := range latest {
+		keys = append(keys, []byte(key))
+		positions = append(positions, pos)
+	}
+	return keys, positions, nil
+}
+
+// rewriteBPTreeIndex B+ 树索引持久化在磁盘上，merge 之后其中的位置仍指向已被删除的旧文件，
+// 需要根据 hint 文件将这些位置改写为 merge 后的新位置。newIndex 为 true 时索引是新建的，hint 文件中的索引需要全部加载
+func (db *DB) rewriteBPTreeIndex(newIndex bool) error {
+	bptree, ok := db.index.(*index.BPlusTree)
+	if !ok {
+		return nil
+	}
+
+	mergeFinishedFilePath := path.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := db.options.FS.Stat(mergeFinishedFilePath); os.IsNotExist(err) {
+		return nil // 没有发生过 merge
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+
+	// 索引已经同步过这次 merge 的结果
+	mergeFileId, err := bptree.MergeFileId()
+	if err != nil {
+		return err
+	}
+	if mergeFileId == nonMergeFileId {
+		return nil
+	}
+
+	// hint 文件不能使用时，直接从 merge 文件中获取数据的位置
+	keys, positions, err := db.readHintFile(nonMergeFileId)
+	if err == data.ErrInvalidHintFile {
+		keys, positions, err = db.scanMergeFiles(nonMergeFileId)
+	}
+	if err != nil {
+		return err
+	}
+
+	if newIndex {
+		if _, err := bptree.ApplyBatch(keys, positions); err != nil {
+			return err
+		}
+		return bptree.ApplyMerge(nonMergeFileId, keys, positions)
+	}
+	return bptree.ApplyMerge(nonMergeFileId, keys, positions)
 }
@@ -2,10 +2,18 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/fio/faultfs"
+	"bitcask-go/fio/memfs"
 	"bitcask-go/utils"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -22,7 +30,7 @@ func Test_getMergePath(t *testing.T) {
 	db.Put(utils.GetTestKey(1), utils.GetRandomValue(1024))
 
 	db.Put(utils.GetTestKey(2), utils.GetRandomValue(1024))
-	_, err = data.OpenHintFile(dir)
+	_, err = data.OpenHintFile(fio.OSFileSystem, dir)
 }
 
 // 没有任何数据的情况下进行 merge
@@ -66,7 +74,7 @@ func TestDB_Merge_With_Data(t *testing.T) {
 		_ = db2.Close()
 	}()
 
-	keys := db2.ListKeys()
+	keys := listKeys(t, db2)
 	assert.Equal(t, 10000, len(keys))
 
 	for i := 0; i < 10000; i++ {
@@ -112,7 +120,7 @@ func TestDB_Merge_With_Delete_And_Put(t *testing.T) {
 		_ = db2.Close()
 	}()
 
-	keys := db2.ListKeys()
+	keys := listKeys(t, db2)
 	assert.Equal(t, 20000, len(keys))
 
 	// 验证删除的数据
@@ -161,7 +169,7 @@ func TestDB_Merge_With_Delete(t *testing.T) {
 		_ = db2.Close()
 	}()
 
-	keys := db2.ListKeys()
+	keys := listKeys(t, db2)
 	assert.Equal(t, 0, len(keys))
 
 }
@@ -215,7 +223,7 @@ func TestDB_Merge_With_New_Data(t *testing.T) {
 		destoryDB(db2)
 	}()
 	assert.Nil(t, err)
-	keys := db2.ListKeys()
+	keys := listKeys(t, db2)
 	assert.Equal(t, 10000, len(keys))
 
 	for i := 60000; i < 70000; i++ {
@@ -224,7 +232,7 @@ func TestDB_Merge_With_New_Data(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 
-	//keys := db2.ListKeys()
+	//keys := listKeys(t, db2)
 	//assert.Equal(t, 2000, len(keys))
 
 	//for i := 5000; i < 7000; i++ {
@@ -234,3 +242,753 @@ func TestDB_Merge_With_New_Data(t *testing.T) {
 	//	assert.NotNil(t, val)
 	//}
 }
+
+// B+ 树索引：merge 之后重启，索引需要指向 merge 后的新位置
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	opts.IndexType = BPlusTree
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 300; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 300; i < 600; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("newPut"))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// merge 完成之后的写入，不能被 hint 文件中的旧位置覆盖
+	for i := 600; i < 700; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("afterMerge"))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(700))
+	assert.Nil(t, err)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		keys := listKeys(t, db)
+		assert.Equal(t, 699, len(keys))
+		for i := 0; i < 300; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 300; i < 600; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, "newPut", string(val))
+		}
+		for i := 600; i < 700; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, "afterMerge", string(val))
+		}
+		_, err := db.Get(utils.GetTestKey(700))
+		assert.Equal(t, ErrKeyNotFound, err)
+		for i := 701; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, 1024, len(val))
+		}
+	}
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+
+	// 再次重启，索引不会被重复改写
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	check(db3)
+}
+
+// simulateCrash 模拟进程崩溃：不保存 seqNo，也不做持久化，直接释放文件锁和文件句柄
+func simulateCrash(db *DB) {
+	_ = db.fileLock.Unlock()
+	_ = db.index.Close()
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+}
+
+// 准备一个完成了 merge 但还没有安装的数据库，返回 merge 的边界
+func prepareMergedDB(t *testing.T, opts Options) uint32 {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 250; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	simulateCrash(db)
+
+	nonMergeFileId, err := db.getNonMergeFileId(db.getMergePath())
+	assert.Nil(t, err)
+	return nonMergeFileId
+}
+
+func checkMergedDB(t *testing.T, db *DB) {
+	assert.Equal(t, 50, len(listKeys(t, db)))
+	for i := 0; i < 250; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 250; i < 300; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, 1024, len(val))
+	}
+}
+
+// 安装 merge 文件时崩溃，重启后被删除的 key 不会重新出现，有效数据也不会丢失
+func TestDB_Merge_Crash_During_Install(t *testing.T) {
+	opts := DefaultOptions
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+
+	// 1. 删除旧文件的过程中崩溃
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-install1")
+	opts.DirPath = dir
+	nonMergeFileId := prepareMergedDB(t, opts)
+	for fileId := uint32(0); fileId < nonMergeFileId/2; fileId++ {
+		err := os.Remove(data.GetDataFileName(dir, fileId))
+		assert.Nil(t, err)
+	}
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	checkMergedDB(t, db)
+	destoryDB(db)
+
+	// 2. 旧文件已经删除，移动 merge 文件的过程中崩溃
+	dir, _ = os.MkdirTemp(DefaultOptions.DirPath, "bitcask-go-merge-install2")
+	opts.DirPath = dir
+	nonMergeFileId = prepareMergedDB(t, opts)
+	mergePath := path.Join(path.Dir(dir), path.Base(dir)+mergeDirName)
+	for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
+		_ = os.Remove(data.GetDataFileName(dir, fileId))
+	}
+	_, err = os.Create(path.Join(mergePath, data.MergeInstallingFileName))
+	assert.Nil(t, err)
+	err = os.Rename(data.GetDataFileName(mergePath, 0), data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkMergedDB(t, db)
+
+	// 再次重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+	checkMergedDB(t, db)
+}
+
+// merge 完成标识在持久化之前崩溃，内容为空或者不完整，重启时丢弃这次 merge，原来的数据文件保持不变
+func TestDB_Merge_Incomplete_Finished_File(t *testing.T) {
+	sizes := map[string]func(size int64) int64{
+		"empty":     func(size int64) int64 { return 0 },
+		"truncated": func(size int64) int64 { return size / 2 },
+	}
+	for name, truncatedSize := range sizes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-finished")
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.DataFileMergeRatio = 0
+			nonMergeFileId := prepareMergedDB(t, opts)
+
+			mergePath := mergePathOf(dir)
+			finishedPath := path.Join(mergePath, data.MergeFinishedFileName)
+			stat, err := os.Stat(finishedPath)
+			assert.Nil(t, err)
+			err = os.Truncate(finishedPath, truncatedSize(stat.Size()))
+			assert.Nil(t, err)
+
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			defer destoryDB(db)
+			checkMergedDB(t, db)
+			_, err = os.Stat(mergePath)
+			assert.True(t, os.IsNotExist(err))
+			for fileId := uint32(0); fileId <= nonMergeFileId; fileId++ {
+				_, err := os.Stat(data.GetDataFileName(dir, fileId))
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// 没有参与 merge 的旧文件（比如从备份中拷贝回来的）中的旧版本，不能让被删除的 key 重新出现
+func TestDB_Merge_Deleted_Keys_Stay_Hidden(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-hidden")
+	backupDir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-hidden-backup")
+	defer os.RemoveAll(backupDir)
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 300; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+		assert.Nil(t, err)
+	}
+	_, err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	for i := 0; i < 250; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkMergedDB(t, db)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 将备份中保存着被删除 key 的旧文件拷贝到 merge 之后空出来的文件 id 上
+	nonMergeFileId, err := db.getNonMergeFileId(dir)
+	assert.Nil(t, err)
+	gapFileId := nonMergeFileId - 1
+	_, err = os.Stat(data.GetDataFileName(dir, gapFileId))
+	assert.True(t, os.IsNotExist(err))
+	oldData, err := os.ReadFile(data.GetDataFileName(backupDir, 0))
+	assert.Nil(t, err)
+	err = os.WriteFile(data.GetDataFileName(dir, gapFileId), oldData, 0644)
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkMergedDB(t, db)
+
+	// 再次 merge，重启后被删除的 key 依然不存在
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+	checkMergedDB(t, db)
+}
+
+// 运行过程中拷贝进来的旧文件不在 merge 范围内，被删除的 key 在其中还有更早的版本，merge 要保留这些 key 的墓碑，
+// 直到这个旧文件也参与了 merge
+func TestDB_Merge_Tombstones_For_Outside_Files(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-merge-tombstones")
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			assert.Nil(t, err)
+
+			for n := 0; n < 2; n++ {
+				for i := 0; i < 300; i++ {
+					err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+					assert.Nil(t, err)
+				}
+			}
+			oldData, err := os.ReadFile(data.GetDataFileName(dir, 0))
+			assert.Nil(t, err)
+			err = db.Merge()
+			assert.Nil(t, err)
+			err = db.Close()
+			assert.Nil(t, err)
+
+			// merge 之后空出来的文件 id 上拷贝进保存着旧版本的文件，它不在运行中的数据库里
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			nonMergeFileId, err := db.getNonMergeFileId(dir)
+			assert.Nil(t, err)
+			outsideFileId := nonMergeFileId - 1
+			_, err = os.Stat(data.GetDataFileName(dir, outsideFileId))
+			assert.True(t, os.IsNotExist(err))
+			for i := 0; i < 300; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+				assert.Nil(t, err)
+			}
+			err = os.WriteFile(data.GetDataFileName(dir, outsideFileId), oldData, 0644)
+			assert.Nil(t, err)
+			for i := 0; i < 250; i++ {
+				err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+
+			// 旧文件被保留下来，不使用 hint 文件，按顺序回放时墓碑仍然在旧版本之后
+			err = db.Merge()
+			assert.Nil(t, err)
+			err = db.Close()
+			assert.Nil(t, err)
+			for i := 0; i < 2; i++ {
+				db, err = Open(opts)
+				assert.Nil(t, err)
+				checkMergedDB(t, db)
+				_, err = os.Stat(data.GetDataFileName(dir, outsideFileId))
+				assert.Nil(t, err)
+				_, err = os.Stat(path.Join(dir, data.HintFileName))
+				assert.True(t, os.IsNotExist(err))
+				err = db.Close()
+				assert.Nil(t, err)
+			}
+
+			// 旧文件参与 merge 之后，不再有更早的版本，墓碑都可以丢弃
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			err = db.Merge()
+			assert.Nil(t, err)
+			err = db.Close()
+			assert.Nil(t, err)
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			defer destoryDB(db)
+			checkMergedDB(t, db)
+			nonMergeFileId, err = db.getNonMergeFileId(dir)
+			assert.Nil(t, err)
+			for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
+				dataFile := db.getDataFile(fileId)
+				if dataFile == nil {
+					continue
+				}
+				var offset int64
+				for {
+					record, size, err := dataFile.ReadLogRecord(offset)
+					if err != nil {
+						assert.Equal(t, io.EOF, err)
+						break
+					}
+					assert.Equal(t, data.LogRecordNormal, record.Type)
+					offset += size
+				}
+			}
+		})
+	}
+}
+
+// 保留的旧文件中有比 merge 文件更新的删除时，重启后以这个删除为准，被删除的 key 不会因为 merge 重新出现
+func TestDB_Merge_Newer_Delete_In_Outside_File(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-merge-newer-delete")
+			opts.DirPath = dir
+			opts.DataFileSize = 64 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			assert.Nil(t, err)
+
+			for n := 0; n < 2; n++ {
+				for i := 0; i < 300; i++ {
+					err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+					assert.Nil(t, err)
+				}
+			}
+			err = db.Merge()
+			assert.Nil(t, err)
+			err = db.Close()
+			assert.Nil(t, err)
+
+			// 另一个数据库中删除前 250 个 key，得到一个保存着删除记录的文件
+			deleteOpts := DefaultOptions
+			deleteDir, _ := os.MkdirTemp("", "bitcask-go-merge-newer-delete-src")
+			deleteOpts.DirPath = deleteDir
+			deleteDB, err := Open(deleteOpts)
+			assert.Nil(t, err)
+			for i := 0; i < 250; i++ {
+				err := deleteDB.Put(utils.GetTestKey(i), []byte("deleted"))
+				assert.Nil(t, err)
+				err = deleteDB.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+			deleteData, err := os.ReadFile(data.GetDataFileName(deleteDir, 0))
+			assert.Nil(t, err)
+			destoryDB(deleteDB)
+
+			// 拷贝到 merge 文件之后空出来的文件 id 上，比 merge 文件中这些 key 的版本更新
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			nonMergeFileId, err := db.getNonMergeFileId(dir)
+			assert.Nil(t, err)
+			outsideFileId := nonMergeFileId - 1
+			_, err = os.Stat(data.GetDataFileName(dir, outsideFileId))
+			assert.True(t, os.IsNotExist(err))
+			for n := 0; n < 10; n++ {
+				for i := 250; i < 300; i++ {
+					err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(1024))
+					assert.Nil(t, err)
+				}
+			}
+			err = os.WriteFile(data.GetDataFileName(dir, outsideFileId), deleteData, 0644)
+			assert.Nil(t, err)
+
+			err = db.Merge()
+			assert.Nil(t, err)
+			err = db.Close()
+			assert.Nil(t, err)
+			for n := 0; n < 2; n++ {
+				db, err = Open(opts)
+				assert.Nil(t, err)
+				checkMergedDB(t, db)
+				_, err = os.Stat(data.GetDataFileName(dir, outsideFileId))
+				assert.Nil(t, err)
+				if n == 1 {
+					destoryDB(db)
+				} else {
+					err = db.Close()
+					assert.Nil(t, err)
+				}
+			}
+		})
+	}
+}
+
+// 模拟事务提交到一半时崩溃：数据已经写入，但没有写入事务完成的标识
+func writeUncommittedBatch(db *DB, puts, deletes [][]byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
+	for _, key := range puts {
+		record := &data.LogRecord{Key: encodeKeyWithSeqNo(key, seqNo), Value: []byte("new")}
+		if _, err := db.appendLogRecord(record); err != nil {
+			return err
+		}
+	}
+	for _, key := range deletes {
+		record := &data.LogRecord{Key: encodeKeyWithSeqNo(key, seqNo), Type: data.LogRecordDeleted}
+		if _, err := db.appendLogRecord(record); err != nil {
+			return err
+		}
+	}
+	return db.activeFile.Sync()
+}
+
+// merge 以轮转时的索引快照为准，过程中覆盖和删除的 key 的旧版本仍然写入 merge 文件，重启之后以新的写入为准
+func TestDB_Merge_Writes_During_Rewrite(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-rewrite")
+			opts.DirPath = dir
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			for i := 0; i < 1000; i++ {
+				err := db.Put(utils.GetTestKey(i), []byte("old"))
+				assert.Nil(t, err)
+			}
+
+			db.mergeHook = func(stage string) {
+				if stage != mergeStageRotate {
+					return
+				}
+				for i := 0; i < 300; i++ {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+				}
+				for i := 300; i < 600; i++ {
+					assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+				}
+			}
+			assert.Nil(t, db.Merge())
+			db.mergeHook = nil
+
+			// merge 文件中是轮转时所有 key 的旧版本
+			mergeFile, err := data.OpenDateFile(fio.OSFileSystem, db.getMergePath(), 0, fio.StandardIO)
+			assert.Nil(t, err)
+			var count int
+			var offset int64
+			for {
+				record, size, err := mergeFile.ReadLogRecord(offset)
+				if err == io.EOF {
+					break
+				}
+				assert.Nil(t, err)
+				realKey, _ := DecodeKeyWithSeqNo(record.Key)
+				assert.Equal(t, "old", string(record.Value), string(realKey))
+				offset += size
+				count++
+			}
+			assert.Equal(t, 1000, count)
+			assert.Nil(t, mergeFile.Close())
+			assert.Nil(t, db.Close())
+
+			db2, err := Open(opts)
+			defer destoryDB(db2)
+			assert.Nil(t, err)
+			values := readAll(t, db2)
+			assert.Equal(t, 700, len(values))
+			for i := 0; i < 1000; i++ {
+				switch {
+				case i < 300:
+					assert.Equal(t, "new", values[string(utils.GetTestKey(i))])
+				case i >= 600:
+					assert.Equal(t, "old", values[string(utils.GetTestKey(i))])
+				}
+			}
+		})
+	}
+}
+
+// merge 过程中提交的写入没有持久化，merge 完成之后掉电丢失这些写入，重启之后旧版本仍然存在，事务也不会只生效一部分
+func TestDB_Merge_Unsynced_Writes_Crash(t *testing.T) {
+	fs := faultfs.New(memfs.New())
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-merge-unsynced"
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.FS = fs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("old"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Sync())
+	expected := readAll(t, db)
+
+	db.mergeHook = func(stage string) {
+		if stage != mergeStageRotate {
+			return
+		}
+		wb := db.NewWriteBatch(WriteBatchOptions{MaxBatchSize: 1000, SyncWrites: false})
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("new")))
+		}
+		for i := 100; i < 150; i++ {
+			assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, wb.Commit())
+		assert.Nil(t, db.Put(utils.GetTestKey(150), []byte("new")))
+	}
+	assert.Nil(t, db.Merge())
+
+	// 掉电丢失 merge 过程中没有持久化的写入，merge 的结果已经持久化
+	assert.Nil(t, fs.Restart())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, readAll(t, db2))
+	assert.Nil(t, db2.Close())
+}
+
+// 在 merge 的各个阶段提交事务并崩溃，重启之后事务要么全部可见，要么全部不可见
+func TestDB_Merge_Txn_Crash(t *testing.T) {
+	errCrash := errors.New("crash")
+	stages := []string{mergeStageRotate, mergeStageRewrite, mergeStageFinished}
+	indexTypes := map[string]IndexerType{"btree": BTree, "art": ART, "hash": Hash, "bptree": BPlusTree}
+	for name, indexType := range indexTypes {
+		for _, stage := range stages {
+			for _, committed := range []bool{true, false} {
+				t.Run(fmt.Sprintf("%s-%s-committed-%v", name, stage, committed), func(t *testing.T) {
+					opts := DefaultOptions
+					dir, _ := os.MkdirTemp(opts.DirPath, "bitcask-go-merge-txn")
+					opts.DirPath = dir
+					opts.DataFileSize = 64 * 1024
+					opts.DataFileMergeRatio = 0
+					opts.IndexType = indexType
+					db, err := Open(opts)
+					assert.Nil(t, err)
+
+					for i := 0; i < 200; i++ {
+						err := db.Put(utils.GetTestKey(i), []byte("old"))
+						assert.Nil(t, err)
+					}
+					for i := 0; i < 50; i++ {
+						err := db.Delete(utils.GetTestKey(i))
+						assert.Nil(t, err)
+					}
+
+					// 事务：修改 100-149，删除 150-199，新增 200-249
+					var puts, deletes [][]byte
+					for i := 100; i < 150; i++ {
+						puts = append(puts, utils.GetTestKey(i))
+					}
+					for i := 200; i < 250; i++ {
+						puts = append(puts, utils.GetTestKey(i))
+					}
+					for i := 150; i < 200; i++ {
+						deletes = append(deletes, utils.GetTestKey(i))
+					}
+
+					db.mergeHook = func(s string) {
+						if s != stage {
+							return
+						}
+						if committed {
+							wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+							for _, key := range puts {
+								assert.Nil(t, wb.Put(key, []byte("new")))
+							}
+							for _, key := range deletes {
+								assert.Nil(t, wb.Delete(key))
+							}
+							assert.Nil(t, wb.Commit())
+						} else {
+							assert.Nil(t, writeUncommittedBatch(db, puts, deletes))
+						}
+						panic(errCrash)
+					}
+					func() {
+						defer func() {
+							assert.Equal(t, errCrash, recover())
+						}()
+						_ = db.Merge()
+					}()
+					simulateCrash(db)
+
+					db2, err := Open(opts)
+					assert.Nil(t, err)
+					defer destoryDB(db2)
+
+					for i := 0; i < 50; i++ {
+						_, err := db2.Get(utils.GetTestKey(i))
+						assert.Equal(t, ErrKeyNotFound, err)
+					}
+					for i := 50; i < 100; i++ {
+						val, err := db2.Get(utils.GetTestKey(i))
+						assert.Nil(t, err)
+						assert.Equal(t, "old", string(val))
+					}
+					if committed {
+						for _, key := range puts {
+							val, err := db2.Get(key)
+							assert.Nil(t, err)
+							assert.Equal(t, "new", string(val))
+						}
+						for _, key := range deletes {
+							_, err := db2.Get(key)
+							assert.Equal(t, ErrKeyNotFound, err)
+						}
+						assert.Equal(t, 150, len(listKeys(t, db2)))
+					} else {
+						for i := 100; i < 200; i++ {
+							val, err := db2.Get(utils.GetTestKey(i))
+							assert.Nil(t, err)
+							assert.Equal(t, "old", string(val))
+						}
+						for i := 200; i < 250; i++ {
+							_, err := db2.Get(utils.GetTestKey(i))
+							assert.Equal(t, ErrKeyNotFound, err)
+						}
+						assert.Equal(t, 150, len(listKeys(t, db2)))
+					}
+				})
+			}
+		}
+	}
+}
+
+// hint 文件不完整或者不存在时，从 merge 文件中重新加载索引
+func TestDB_Merge_Invalid_Hint(t *testing.T) {
+	indexTypes := map[string]IndexerType{"btree": BTree, "bptree": BPlusTree}
+	corruptions := map[string]func(hintPath string) error{
+		"truncated": func(hintPath string) error {
+			stat, err := os.Stat(hintPath)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(hintPath, stat.Size()/2)
+		},
+		"missing": os.Remove,
+	}
+	for indexName, indexType := range indexTypes {
+		for corruptionName, corrupt := range corruptions {
+			t.Run(indexName+"-"+corruptionName, func(t *testing.T) {
+				opts := DefaultOptions
+				dir, _ := os.MkdirTemp("", "bitcask-go-merge-hint")
+				opts.DirPath = dir
+				opts.DataFileSize = 64 * 1024
+				opts.DataFileMergeRatio = 0
+				opts.IndexType = indexType
+				db, err := Open(opts)
+				assert.Nil(t, err)
+
+				for i := 0; i < 2000; i++ {
+					err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+					assert.Nil(t, err)
+				}
+				for i := 0; i < 1000; i++ {
+					err := db.Delete(utils.GetTestKey(i))
+					assert.Nil(t, err)
+				}
+				err = db.Merge()
+				assert.Nil(t, err)
+				for i := 2000; i < 2100; i++ {
+					err := db.Put(utils.GetTestKey(i), utils.GetRandomValue(64))
+					assert.Nil(t, err)
+				}
+				err = corrupt(path.Join(db.getMergePath(), data.HintFileName))
+				assert.Nil(t, err)
+				err = db.Close()
+				assert.Nil(t, err)
+
+				for i := 0; i < 2; i++ {
+					db2, err := Open(opts)
+					assert.Nil(t, err)
+					assert.Equal(t, 1100, len(listKeys(t, db2)))
+					for i := 0; i < 2100; i++ {
+						val, err := db2.Get(utils.GetTestKey(i))
+						if i < 1000 {
+							assert.Equal(t, ErrKeyNotFound, err)
+						} else {
+							assert.Nil(t, err)
+							assert.Equal(t, 64, len(val))
+						}
+					}
+					if i == 0 {
+						err = db2.Close()
+						assert.Nil(t, err)
+					} else {
+						destoryDB(db2)
+					}
+				}
+			})
+		}
+	}
+}
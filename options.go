@@ -1,13 +1,39 @@
 package bitcask_go
 
+import (
+	"bitcask-go/fio"
+	"time"
+)
+
 type Options struct {
-	DirPath            string      // 数据库数据目录
-	DataFileSize       int64       // 文件大小
-	SyncWrites         bool        // 写数据是否持久化
-	BytesPerSync       uint        // 累计写到多少字节后进行持久化
-	IndexType          IndexerType // 索引类型
-	MMapAtStartup      bool        // 是否在启动时使用 MMap 打开数据文件
-	DataFileMergeRatio float32     // 数据文件合并的阈值
+	DirPath            string         // 数据库数据目录
+	DataFileSize       int64          // 文件大小
+	SyncWrites         bool           // 写数据是否持久化
+	BytesPerSync       uint           // 累计写到多少字节后进行持久化
+	IndexType          IndexerType    // 索引类型
+	MMapAtStartup      bool           // 是否在启动时使用 MMap 打开数据文件
+	DataFileMergeRatio float32        // 数据文件合并的阈值
+	IOType             IOType         // 数据文件读写使用的 IO 类型
+	FS                 fio.FileSystem // 数据文件所在的文件系统，为空时使用操作系统的文件系统
+	// 活跃数据文件写缓冲区的大小，为 0 时每次写入都直接写到文件中。
+	// 没有开启 SyncWrites 时，缓冲区中的数据还没有交给操作系统，进程崩溃时会丢失最多 WriteBufferSize 大小已经写入成功的数据；
+	// 不开启缓冲时这些数据在操作系统的页缓存中，只有机器掉电才会丢失
+	WriteBufferSize int
+	// 创建数据文件时是否预先分配 DataFileSize 大小的磁盘空间，减少文件系统碎片和扩展文件时的元数据持久化。
+	// 标准 IO 和直接 IO 预分配时不改变文件大小；无论哪种 IO 类型，启动时都会截断活跃文件末尾全零的数据
+	PreallocateDataFiles bool
+	// 索引分片的数量，大于 1 时按照 key 的哈希值将索引分散到多个使用独立锁的子索引中，减少并发读写时的锁竞争；
+	// 单个 Put 和 Get 在数据库锁之外更新和查找索引。迭代器分别获取每个分片的快照，得到的不是同一时刻的快照
+	IndexShardNum int
+	// 后台写入索引检查点的间隔，为 0 时不在后台写入。开启之后关闭数据库时也会写入检查点，
+	// 启动时只需要回放检查点之后的数据。B+ 树索引本身是持久化的，不需要检查点
+	IndexCheckpointInterval time.Duration
+	// 启动时并行解析数据文件的协程数量，为 0 时使用 CPU 的核数
+	IndexLoadConcurrency int
+	// 启动过程中每个阶段完成之后的回调，参数是阶段和耗时，为 nil 时不回调
+	OnOpenPhase func(phase OpenPhase, elapsed time.Duration)
+	// value 缓存的容量，字节为单位，按照数据的位置缓存最近读取的 value，为 0 时不开启缓存
+	ValueCacheSize int64
 }
 
 // 索引迭代器配置项
@@ -29,6 +55,16 @@ type WriteBatchOptions struct {
 	SyncWrites bool
 }
 
+// BulkLoaderOptions 批量导入配置项
+type BulkLoaderOptions struct {
+	DirPath         string         // 生成的数据目录，必须不存在或者为空
+	DataFileSize    int64          // 每个数据文件的大小
+	FS              fio.FileSystem // 数据目录所在的文件系统，为空时使用操作系统的文件系统
+	WriteBufferSize int            // 数据文件和 hint 文件写缓冲区的大小
+	// 输入是否已经按照 key 排序，排序的输入不需要在内存中保存所有 key 的位置，重复的 key 也只写入最后一个 value
+	Sorted bool
+}
+
 // 索引类型
 type IndexerType = int8
 
@@ -39,16 +75,58 @@ const (
 	ART
 	// BPlusTree 索引
 	BPlusTree
+	// Hash 哈希表索引，点查询是 O(1) 的，迭代时需要对所有 key 排序
+	Hash
+)
+
+// IO 类型
+type IOType = byte
+
+const (
+	// StandardIO 标准文件 IO
+	StandardIO IOType = iota
+	// MemoryMap 内存文件映射 IO
+	MemoryMap
+	// DirectIO 绕过页缓存的直接 IO
+	DirectIO
+)
+
+// OpenPhase 启动过程中的阶段
+type OpenPhase string
+
+const (
+	// OpenPhaseMergeFiles 安装上次 merge 生成的文件
+	OpenPhaseMergeFiles OpenPhase = "merge-files"
+	// OpenPhaseHint 从索引检查点或者 hint 文件中加载索引
+	OpenPhaseHint OpenPhase = "hint"
+	// OpenPhaseDataReplay 回放数据文件，加载其中的索引
+	OpenPhaseDataReplay OpenPhase = "data-replay"
 )
 
 var DefaultOptions = Options{
-	DirPath:            "/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database",
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexType:          BTree,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:                 "/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database",
+	DataFileSize:            256 * 1024 * 1024, // 256MB
+	SyncWrites:              false,
+	BytesPerSync:            0,
+	IndexType:               BTree,
+	MMapAtStartup:           true,
+	DataFileMergeRatio:      0.5,
+	IOType:                  StandardIO,
+	FS:                      fio.OSFileSystem,
+	WriteBufferSize:         0,
+	PreallocateDataFiles:    false,
+	IndexShardNum:           0,
+	IndexCheckpointInterval: 0,
+	IndexLoadConcurrency:    0,
+	OnOpenPhase:             nil,
+	ValueCacheSize:          0,
+}
+
+var DefaultBulkLoaderOptions = BulkLoaderOptions{
+	DataFileSize:    256 * 1024 * 1024, // 256MB
+	FS:              fio.OSFileSystem,
+	WriteBufferSize: 1024 * 1024, // 1MB
+	Sorted:          false,
 }
 
 var DefaultWriteBatchOptions = WriteBatchOptions{
@@ -1,25 +1,38 @@
 package utils
 
 import (
+	"bitcask-go/fio"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
 // DirSize 获取一个文件夹的大小
-func DirSize(dirPath string) (int64, error) {
+func DirSize(fs fio.FileSystem, dirPath string) (int64, error) {
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+
 	var size int64
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, entry := range entries {
+		path := filepath.Join(dirPath, entry.Name())
+		if entry.IsDir() {
+			subSize, err := DirSize(fs, path)
+			if err != nil {
+				return 0, err
+			}
+			size += subSize
+			continue
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		info, err := fs.Stat(path)
+		if err != nil {
+			return 0, err
 		}
-		return nil
-	})
-	return size, err
+		size += info.Size()
+	}
+	return size, nil
 }
 
 // AvailableDiskSize 获取次盘剩余可用空间大小
@@ -39,38 +52,74 @@ func AvailableDiskSize() (uint64, error) {
 }
 
 // 拷贝数据目录
-func CopyDir(src string, dest string, exclude []string) error {
+func CopyDir(fs fio.FileSystem, src string, dest string, exclude []string) error {
 	// 创建对应文件夹
-	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		if err := os.MkdirAll(dest, os.ModePerm); err != nil {
-			return err
-		}
+	if err := fs.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
 	}
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-		fileName := strings.Replace(path, src, "", 1)
-		if fileName == "" {
-			return nil
-		}
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
 
+Entries:
+	for _, entry := range entries {
 		for _, e := range exclude {
-			matched, err := filepath.Match(e, info.Name())
+			matched, err := filepath.Match(e, entry.Name())
 			if err != nil {
 				return err
 			}
 			if matched {
-				return nil
+				continue Entries
 			}
 		}
 
-		if info.IsDir() {
-			return os.MkdirAll(filepath.Join(dest, fileName), info.Mode())
+		srcPath, destPath := filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())
+		if entry.IsDir() {
+			if err := CopyDir(fs, srcPath, destPath, exclude); err != nil {
+				return err
+			}
+			continue
 		}
-
-		data, err := os.ReadFile(filepath.Join(src, fileName))
-		if err != nil {
+		if err := CopyFile(fs, srcPath, destPath); err != nil {
 			return err
 		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
-	})
+	}
+	return nil
+}
+
+// LinkOrCopyFile 为不会再修改的文件创建硬链接，不支持硬链接（例如跨文件系统）时拷贝文件并持久化
+func LinkOrCopyFile(fs fio.FileSystem, src, dest string) error {
+	if err := fs.Link(src, dest); err == nil {
+		return nil
+	}
+	return CopyFile(fs, src, dest)
+}
+
+// CopyFile 拷贝文件并持久化
+func CopyFile(fs fio.FileSystem, src, dest string) error {
+	srcFile, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	destFile, err := fs.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, io.NewSectionReader(srcFile, 0, info.Size())); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
 }
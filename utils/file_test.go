@@ -1,13 +1,17 @@
 package utils
 
 import (
+	"bitcask-go/fio"
+	"bitcask-go/fio/faultfs"
+	"bitcask-go/fio/memfs"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
 func TestDirSize(t *testing.T) {
 	dirPath := "/Volumes/kioxia/Repo/Distribution/bitcask-go/bitcask-go/Database/datafileTest"
-	size, err := DirSize(dirPath)
+	size, err := DirSize(fio.OSFileSystem, dirPath)
 	assert.Nil(t, err)
 	assert.True(t, size > 0)
 }
@@ -17,3 +21,32 @@ func TestAvailableDiskSize(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, size > 0)
 }
+
+func TestLinkOrCopyFile(t *testing.T) {
+	fs := memfs.New()
+	err := fs.MkdirAll("/db", os.ModePerm)
+	assert.Nil(t, err)
+	f, err := fs.OpenFile("/db/1.data", os.O_CREATE|os.O_RDWR, fio.DateFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("data"))
+	assert.Nil(t, err)
+
+	// 创建硬链接，之后的修改两边都可见
+	err = LinkOrCopyFile(fs, "/db/1.data", "/db/link.data")
+	assert.Nil(t, err)
+
+	// 不能创建硬链接时拷贝文件
+	faultFS := faultfs.New(fs)
+	faultFS.Inject(1, faultfs.Error)
+	err = LinkOrCopyFile(faultFS, "/db/1.data", "/db/copy.data")
+	assert.Nil(t, err)
+
+	_, err = f.Write([]byte("-more"))
+	assert.Nil(t, err)
+	info, err := fs.Stat("/db/link.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), info.Size())
+	info, err = fs.Stat("/db/copy.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+}